@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// streamAccess streams a client may read, nil lets it read every stream
+type streamAccess struct {
+	patterns []string
+}
+
+// newStreamAccess returns streams of the entries of source.access matching
+// the subject or a SAN of the client certificate, nil without source.access
+func newStreamAccess(access []ConfigAccess, user string, sans []string) *streamAccess {
+	if len(access) == 0 {
+		return nil
+	}
+	allowed := &streamAccess{patterns: make([]string, 0)}
+	for _, entry := range access {
+		if user != "" && entry.Identity == user || slices.Contains(sans, entry.Identity) {
+			allowed.patterns = append(allowed.patterns, entry.Streams...)
+		}
+	}
+	return allowed
+}
+
+// allows tells whether stream may be read
+func (access *streamAccess) allows(stream string) bool {
+	if access == nil {
+		return true
+	}
+	for _, pattern := range access.patterns {
+		if globMatch(pattern, stream) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error when no stream may be read or one of the named
+// streams isn't allowed, patterns are narrowed once streams are found
+func (access *streamAccess) check(streams []string) error {
+	if access == nil {
+		return nil
+	}
+	if len(access.patterns) == 0 {
+		return errors.New("no stream allowed")
+	}
+	for _, stream := range streams {
+		if !strings.ContainsAny(stream, `*?[\`) && !access.allows(stream) {
+			return fmt.Errorf("stream [%s] is not allowed", stream)
+		}
+	}
+	return nil
+}
+
+// checkGlob returns path.ErrBadPattern for a pattern with an unterminated
+// character class or a trailing backslash
+func checkGlob(pattern string) error {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i++; i == len(pattern) {
+				return path.ErrBadPattern
+			}
+		case '[':
+			for i++; i < len(pattern) && pattern[i] != ']'; i++ {
+				if pattern[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(pattern) {
+				return path.ErrBadPattern
+			}
+		}
+	}
+	return nil
+}
+
+// globMatch reports whether name matches pattern the way redis KEYS and SCAN
+// MATCH do, unlike path.Match * and ? match / too: * any characters, ? one,
+// [abc], [a-z] and [^abc] one of a class, \ escapes the next character
+func globMatch(pattern string, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			for i := len(name); i >= 0; i-- {
+				if globMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		case '[':
+			if len(name) == 0 {
+				return false
+			}
+			end, matched := globClass(pattern, name[0])
+			if !matched {
+				return false
+			}
+			pattern, name = pattern[end:], name[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return len(name) == 0
+}
+
+// globClass matches c against the character class pattern starts with,
+// returns the length of the class and whether c is in it
+func globClass(pattern string, c byte) (int, bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+	matched := false
+	for i < len(pattern) && pattern[i] != ']' {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			matched = matched || pattern[i+1] == c
+			i += 2
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			low, high := pattern[i], pattern[i+2]
+			if low > high {
+				low, high = high, low
+			}
+			matched = matched || low <= c && c <= high
+			i += 3
+		default:
+			matched = matched || pattern[i] == c
+			i++
+		}
+	}
+	return min(i+1, len(pattern)), matched != negate
+}
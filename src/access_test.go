@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testAccess entries of source.access used by the tests below
+var testAccess = []ConfigAccess{
+	{Identity: "CN=billing", Streams: []string{"orders.*", "invoices"}},
+	{Identity: "spiffe://example.org/audit", Streams: []string{"audit"}},
+	{Identity: "CN=nobody", Streams: []string{"secrets"}},
+}
+
+func TestStreamAccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		access  []ConfigAccess
+		user    string
+		sans    []string
+		allowed []string
+		denied  []string
+	}{
+		{name: "without source.access", allowed: []string{"orders.a", "secrets"}},
+		{name: "by subject", access: testAccess, user: "CN=billing", allowed: []string{"orders.a", "orders.eu/west", "invoices"}, denied: []string{"orders", "audit", "secrets"}},
+		{name: "by san", access: testAccess, user: "CN=auditor", sans: []string{"auditor.example.org", "spiffe://example.org/audit"}, allowed: []string{"audit"}, denied: []string{"orders.a"}},
+		{name: "subject and san", access: testAccess, user: "CN=billing", sans: []string{"spiffe://example.org/audit"}, allowed: []string{"orders.a", "audit"}, denied: []string{"secrets"}},
+		{name: "unknown identity", access: testAccess, user: "CN=guest", denied: []string{"orders.a", "audit"}},
+		{name: "no certificate", access: testAccess, denied: []string{"orders.a", "audit"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			access := newStreamAccess(test.access, test.user, test.sans)
+			for _, stream := range test.allowed {
+				if !access.allows(stream) {
+					t.Errorf("stream %s denied", stream)
+				}
+			}
+			for _, stream := range test.denied {
+				if access.allows(stream) {
+					t.Errorf("stream %s allowed", stream)
+				}
+			}
+		})
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{pattern: "orders", name: "orders", matched: true},
+		{pattern: "orders", name: "orders.a"},
+		{pattern: "orders.*", name: "orders.", matched: true},
+		{pattern: "orders.*", name: "orders.eu/west", matched: true},
+		{pattern: "*", name: "a/b/c", matched: true},
+		{pattern: "*/audit", name: "eu/west/audit", matched: true},
+		{pattern: "a**b", name: "a/x/b", matched: true},
+		{pattern: "*b", name: "a/x/c"},
+		{pattern: "h?llo", name: "h/llo", matched: true},
+		{pattern: "h?llo", name: "hllo"},
+		{pattern: "h[ae]llo", name: "hello", matched: true},
+		{pattern: "h[ae]llo", name: "hillo"},
+		{pattern: "h[^e]llo", name: "hallo", matched: true},
+		{pattern: "h[^e]llo", name: "hello"},
+		{pattern: "h[a-c]llo", name: "hbllo", matched: true},
+		{pattern: "h[c-a]llo", name: "hbllo", matched: true},
+		{pattern: "h[a-c]llo", name: "hdllo"},
+		{pattern: `h[\]]llo`, name: "h]llo", matched: true},
+		{pattern: `orders\*`, name: "orders*", matched: true},
+		{pattern: `orders\*`, name: "orders.a"},
+		{pattern: `a\?`, name: "ab"},
+	}
+	for _, test := range tests {
+		if matched := globMatch(test.pattern, test.name); matched != test.matched {
+			t.Errorf("pattern %s name %s matched %v, expected %v", test.pattern, test.name, matched, test.matched)
+		}
+	}
+	for pattern, valid := range map[string]bool{"orders.*": true, `a\*`: true, "[a-z]?": true, "audit[": false, `audit\`: false, `[a\]`: false} {
+		if err := checkGlob(pattern); (err == nil) != valid {
+			t.Errorf("pattern %s error %v, expected valid %v", pattern, err, valid)
+		}
+	}
+}
+
+func TestStreamAccessCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		streams []string
+		err     string
+	}{
+		{name: "allowed streams", user: "CN=billing", streams: []string{"invoices", "orders.eu"}},
+		{name: "patterns are narrowed later", user: "CN=billing", streams: []string{"*"}},
+		{name: "stream not allowed", user: "CN=billing", streams: []string{"invoices", "audit"}, err: "stream [audit] is not allowed"},
+		{name: "no entry", user: "CN=guest", streams: []string{"*"}, err: "no stream allowed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := newStreamAccess(testAccess, test.user, nil).check(test.streams)
+			if err == nil && test.err != "" || err != nil && err.Error() != test.err {
+				t.Errorf("error %v, expected %q", err, test.err)
+			}
+		})
+	}
+	if err := (*streamAccess)(nil).check([]string{"audit"}); err != nil {
+		t.Errorf("error %v without source.access", err)
+	}
+}
+
+func TestSubscribeAccess(t *testing.T) {
+	reader := testReader(t, ConfigSource{})
+	reader.access = newStreamAccess(testAccess, "CN=billing", nil)
+	reply := reader.handle(context.Background(), controlRequest{Op: "subscribe", Streams: []string{"s2"}, From: "0"})
+	expected := controlMessage{Event: "error", Op: "subscribe", Error: "stream [s2] is not allowed"}
+	if fmt.Sprintf("%+v", reply) != fmt.Sprintf("%+v", expected) {
+		t.Errorf("reply %+v, expected %+v", reply, expected)
+	}
+	if slices.Contains(reader.patterns, "s2") || reader.cursor.has("s2") {
+		t.Errorf("stream not allowed is subscribed")
+	}
+}
+
+func TestDiscoverAccess(t *testing.T) {
+	client, _ := newFakeRedis(scanReply(map[uint64][]string{0: {"orders.a", "invoices", "audit"}}, nil, nil))
+	defer client.Close()
+	sess := testSession(t, "access-discover", "rws.local:8800/ws")
+	reader := newStreamReader(sess, &RWSRedis{}, sess.id, client, redis.Options{}, discardLogger)
+	reader.access = newStreamAccess(testAccess, "CN=billing", nil)
+	added, err := reader.discover(context.Background(), []string{"*"}, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(added, []string{"invoices", "orders.a"}) {
+		t.Errorf("added %v, expected [invoices orders.a]", added)
+	}
+}
+
+func TestConnectAccess(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		cert  *x509.Certificate
+		// error of the refused upgrade, empty when the upgrade is tried
+		error string
+	}{
+		{name: "allowed", query: "?topics=invoices,orders.*", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}},
+		{name: "no certificate", query: "?topics=invoices", error: "no stream allowed"},
+		{name: "unknown identity", query: "?topics=invoices", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "guest"}}, error: "no stream allowed"},
+		{name: "stream not allowed", query: "?topics=invoices,audit", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}, error: "stream [audit] is not allowed"},
+		{name: "configured stream not allowed", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "nobody"}}, error: "stream [invoices] is not allowed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rws := testDrainRWS()
+			rwsConfig := &RWSRedis{Source: ConfigSource{Streams: []string{"invoices"}, Access: testAccess}}
+			r := httptest.NewRequest(http.MethodGet, "/ws"+test.query, nil)
+			if test.cert != nil {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{test.cert}}}
+			}
+			w := httptest.NewRecorder()
+			rws.serveWebSocket(w, r, rwsConfig)
+			if test.error == "" {
+				// the recorder can't be hijacked, so the upgrade itself fails
+				if w.Code == http.StatusForbidden {
+					t.Errorf("allowed streams refused: %s", w.Body.String())
+				}
+				return
+			}
+			if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), test.error) {
+				t.Errorf("response %d %q, expected %d %q", w.Code, w.Body.String(), http.StatusForbidden, test.error)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultAckTimeout time a client has to ack an entry before it is delivered again
+const defaultAckTimeout = 30 * time.Second
+
+// ackTimeout returns how long delivered entries may stay pending in the
+// group, zero without source.group
+func (reader *streamReader) ackTimeout() time.Duration {
+	if reader.source.Group == "" {
+		return 0
+	}
+	if reader.delivery.AckTimeout > 0 {
+		return reader.delivery.AckTimeout
+	}
+	return defaultAckTimeout
+}
+
+// startRead returns ID to read stream from: position of the resume token or
+// start resolved by startID, with source.group "0" to read pending entries of
+// the consumer first, the group is created at start when missing
+func (reader *streamReader) startRead(ctx context.Context, stream string, start string) (string, error) {
+	if reader.source.Group == "" {
+		if id, exists := reader.resumed[stream]; exists {
+			delete(reader.resumed, stream)
+			return id, nil
+		}
+		id, err := startID(ctx, reader.client, stream, start)
+		if err != nil {
+			reader.logger.Error("Can't read last entry of stream", "stream", stream, "error", err)
+		}
+		return id, err
+	}
+	err := reader.client.XGroupCreate(ctx, stream, reader.source.Group, start).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		reader.logger.Error("Can't create consumer group", "stream", stream, "group", reader.source.Group, "error", err)
+		return "", err
+	}
+	return "0", nil
+}
+
+// claim takes over entries of stream pending for longer than minIdle
+func (reader *streamReader) claim(ctx context.Context, stream string, minIdle time.Duration) ([]redis.XMessage, error) {
+	claimed := make([]redis.XMessage, 0)
+	start := "0-0"
+	for {
+		messages, next, err := reader.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    reader.source.Group,
+			Consumer: reader.consumer,
+			MinIdle:  minIdle,
+			Start:    start,
+			Count:    scanCount,
+		}).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				reader.logger.Error("Can't claim pending entries", "stream", stream, "error", err)
+			}
+			return nil, err
+		}
+		claimed = append(claimed, messages...)
+		metricReclaimed.add(float64(len(messages)), streamLabel(stream))
+		if next == "0-0" || next == start {
+			return claimed, nil
+		}
+		start = next
+	}
+}
+
+// delivered settles entries written to the client, with delivery.ack they
+// wait for the client's ack instead, replayed entries are left alone
+func (reader *streamReader) delivered(ctx context.Context, stream streamBatch) {
+	if stream.replayed {
+		return
+	}
+	ids := make([]string, len(stream.Messages))
+	for i, xMessage := range stream.Messages {
+		ids[i] = xMessage.ID
+	}
+	if reader.delivery.Ack {
+		reader.muUnacked.Lock()
+		if reader.unacked[stream.Stream] == nil {
+			reader.unacked[stream.Stream] = make(map[string]bool)
+		}
+		for _, id := range ids {
+			reader.unacked[stream.Stream][id] = true
+		}
+		reader.muUnacked.Unlock()
+		return
+	}
+	reader.settle(ctx, stream.Stream, ids)
+}
+
+// settle acks entries in the group and deletes them from stream
+func (reader *streamReader) settle(ctx context.Context, stream string, ids []string) {
+	if reader.source.Group != "" {
+		acked, err := reader.client.XAck(ctx, stream, reader.source.Group, ids...).Result()
+		if err != nil {
+			reader.logger.Error("Can't ack delivered messages", "stream", stream, "error", err)
+			return
+		}
+		metricAcked.add(float64(acked), streamLabel(stream))
+	}
+	if deleted, err := reader.client.XDel(ctx, stream, ids...).Result(); err != nil {
+		reader.logger.Error("Can't delete delivered messages", "stream", stream, "error", err)
+	} else {
+		metricDeleted.add(float64(deleted), streamLabel(stream))
+	}
+}
+
+// ack settles entries acked by the client, IDs are looked up in request
+// streams or, without them, in every stream
+func (reader *streamReader) ack(ctx context.Context, request controlRequest) controlMessage {
+	fail := func(err error) controlMessage {
+		return controlMessage{Event: "error", Op: request.Op, ID: request.ID, Error: err.Error()}
+	}
+	if !reader.delivery.Ack {
+		return fail(errors.New("acks are not enabled, see delivery.ack"))
+	}
+	if len(request.IDs) == 0 {
+		return fail(errors.New("ids are missing"))
+	}
+	for _, id := range request.IDs {
+		if !rexStreamID.MatchString(id) {
+			return fail(fmt.Errorf("invalid id [%s], expected an entry ID", id))
+		}
+	}
+
+	acked := make(map[string][]string)
+	unknown := slices.Clone(request.IDs)
+	reader.muUnacked.Lock()
+	for stream, pending := range reader.unacked {
+		if len(request.Streams) > 0 && !slices.Contains(request.Streams, stream) {
+			continue
+		}
+		for _, id := range request.IDs {
+			if pending[id] {
+				delete(pending, id)
+				acked[stream] = append(acked[stream], id)
+				unknown = slices.DeleteFunc(unknown, func(value string) bool { return value == id })
+			}
+		}
+	}
+	reader.muUnacked.Unlock()
+
+	streams := make([]string, 0, len(acked))
+	for stream, ids := range acked {
+		reader.settle(ctx, stream, ids)
+		streams = append(streams, stream)
+	}
+	slices.Sort(streams)
+	if len(unknown) > 0 {
+		return fail(fmt.Errorf("unknown or already acked ids %v", unknown))
+	}
+	return controlMessage{Event: "ack", Op: request.Op, ID: request.ID, Streams: streams}
+}
+
+// release removes the consumer from the group of every stream it has no
+// pending entries in, pending entries stay to be claimed after ack timeout
+func (reader *streamReader) release(ctx context.Context) {
+	if reader.source.Group == "" {
+		return
+	}
+	// the cursor belongs to run, positions of the session list the same streams
+	for stream := range reader.sess.info().Positions {
+		pending, err := reader.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   stream,
+			Group:    reader.source.Group,
+			Consumer: reader.consumer,
+			Start:    "-",
+			End:      "+",
+			Count:    1,
+		}).Result()
+		if err != nil || len(pending) > 0 {
+			continue
+		}
+		reader.client.XGroupDelConsumer(ctx, stream, reader.source.Group, reader.consumer)
+	}
+}
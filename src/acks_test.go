@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ackReader returns reader of group g1 with delivery.ack whose client acks
+// and deletes every entry it is asked to
+func ackReader(t *testing.T) (*streamReader, *fakeRedis) {
+	t.Helper()
+	client, fake := newFakeRedis(func(cmd redis.Cmder) error {
+		intCmd, ok := cmd.(*redis.IntCmd)
+		if !ok {
+			return fmt.Errorf("unexpected command %v", cmd.Args())
+		}
+		// XACK stream group id..., XDEL stream id...
+		ids := len(cmd.Args()) - 2
+		if cmd.Name() == "xack" {
+			ids--
+		}
+		intCmd.SetVal(int64(ids))
+		return nil
+	})
+	t.Cleanup(func() { client.Close() })
+	sess := testSession(t, "ack-"+t.Name(), "rws.local:8800/ws")
+	reader := newStreamReader(sess, &RWSRedis{Source: ConfigSource{Group: "g1"}, Delivery: ConfigDelivery{Ack: true}}, "c1", client, redis.Options{}, discardLogger)
+	reader.delivered(context.Background(), streamBatch{XStream: redis.XStream{Stream: "s1", Messages: []redis.XMessage{{ID: "1-0"}, {ID: "2-0"}}}})
+	reader.delivered(context.Background(), streamBatch{XStream: redis.XStream{Stream: "s2", Messages: []redis.XMessage{{ID: "2-0"}, {ID: "3-0"}}}})
+	// replayed entries are never acked
+	reader.delivered(context.Background(), streamBatch{XStream: redis.XStream{Stream: "s1", Messages: []redis.XMessage{{ID: "9-0"}}}, replayed: true})
+	return reader, fake
+}
+
+func TestAck(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  controlRequest
+		reply    controlMessage
+		commands []string
+	}{
+		{
+			name:     "known id",
+			request:  controlRequest{Op: "ack", ID: "a1", IDs: []string{"1-0"}},
+			reply:    controlMessage{Event: "ack", Op: "ack", ID: "a1", Streams: []string{"s1"}},
+			commands: []string{"xack s1 g1 1-0", "xdel s1 1-0"},
+		},
+		{
+			name:     "id of several streams",
+			request:  controlRequest{Op: "ack", IDs: []string{"2-0"}},
+			reply:    controlMessage{Event: "ack", Op: "ack", Streams: []string{"s1", "s2"}},
+			commands: []string{"xack s1 g1 2-0", "xdel s1 2-0", "xack s2 g1 2-0", "xdel s2 2-0"},
+		},
+		{
+			name:     "id of the given stream",
+			request:  controlRequest{Op: "ack", Streams: []string{"s2"}, IDs: []string{"2-0", "3-0"}},
+			reply:    controlMessage{Event: "ack", Op: "ack", Streams: []string{"s2"}},
+			commands: []string{"xack s2 g1 2-0 3-0", "xdel s2 2-0 3-0"},
+		},
+		{
+			name:    "unknown id",
+			request: controlRequest{Op: "ack", ID: "a2", IDs: []string{"7-0"}},
+			reply:   controlMessage{Event: "error", Op: "ack", ID: "a2", Error: "unknown or already acked ids [7-0]"},
+		},
+		{
+			name:     "known and unknown ids",
+			request:  controlRequest{Op: "ack", IDs: []string{"1-0", "7-0"}},
+			reply:    controlMessage{Event: "error", Op: "ack", Error: "unknown or already acked ids [7-0]"},
+			commands: []string{"xack s1 g1 1-0", "xdel s1 1-0"},
+		},
+		{
+			name:    "replayed id",
+			request: controlRequest{Op: "ack", IDs: []string{"9-0"}},
+			reply:   controlMessage{Event: "error", Op: "ack", Error: "unknown or already acked ids [9-0]"},
+		},
+		{
+			name:    "id of another stream",
+			request: controlRequest{Op: "ack", Streams: []string{"s2"}, IDs: []string{"1-0"}},
+			reply:   controlMessage{Event: "error", Op: "ack", Error: "unknown or already acked ids [1-0]"},
+		},
+		{
+			name:    "malformed id",
+			request: controlRequest{Op: "ack", IDs: []string{"1-0", "first"}},
+			reply:   controlMessage{Event: "error", Op: "ack", Error: "invalid id [first], expected an entry ID"},
+		},
+		{
+			name:    "no ids",
+			request: controlRequest{Op: "ack"},
+			reply:   controlMessage{Event: "error", Op: "ack", Error: "ids are missing"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, fake := ackReader(t)
+			reply := reader.ack(context.Background(), test.request)
+			if fmt.Sprintf("%+v", reply) != fmt.Sprintf("%+v", test.reply) {
+				t.Errorf("reply %+v, expected %+v", reply, test.reply)
+			}
+			// streams are settled in any order
+			commands := fake.sent()
+			slices.Sort(commands)
+			expected := slices.Clone(test.commands)
+			slices.Sort(expected)
+			if !slices.Equal(commands, expected) {
+				t.Errorf("commands %q, expected %q", fake.sent(), test.commands)
+			}
+		})
+	}
+}
+
+func TestAckTwice(t *testing.T) {
+	reader, fake := ackReader(t)
+	request := controlRequest{Op: "ack", Streams: []string{"s1"}, IDs: []string{"1-0"}}
+	if reply := reader.ack(context.Background(), request); reply.Event != "ack" {
+		t.Fatalf("first ack answered %+v", reply)
+	}
+	if reply := reader.ack(context.Background(), request); reply.Error != "unknown or already acked ids [1-0]" {
+		t.Errorf("second ack answered %+v", reply)
+	}
+	if commands := fake.sent(); len(commands) != 2 {
+		t.Errorf("commands %q, expected one xack and one xdel", commands)
+	}
+}
+
+func TestAckNotEnabled(t *testing.T) {
+	reader, _ := ackReader(t)
+	reader.delivery.Ack = false
+	reply := reader.ack(context.Background(), controlRequest{Op: "ack", IDs: []string{"1-0"}})
+	if reply.Error != "acks are not enabled, see delivery.ack" {
+		t.Errorf("reply %+v", reply)
+	}
+}
+
+// consumerRequest returns websocket request with query, from a client of the
+// verified certificate subject when it isn't empty
+func consumerRequest(query string, subject pkix.Name) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://rws.local:8800/ws"+query, nil)
+	if subject.CommonName != "" {
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: subject}}}}
+	}
+	return r
+}
+
+func TestSessionConsumer(t *testing.T) {
+	billing := pkix.Name{CommonName: "billing", Organization: []string{"Example"}}
+	tests := []struct {
+		name     string
+		r        *http.Request
+		expected string
+	}{
+		{name: "query parameter", r: consumerRequest("?consumer=worker-1", billing), expected: "worker-1"},
+		{name: "client certificate", r: consumerRequest("", billing), expected: "CN=billing,O=Example"},
+		{name: "anonymous client", r: consumerRequest("", pkix.Name{}), expected: "conn-1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if consumer := sessionConsumer(test.r, "conn-1"); consumer != test.expected {
+				t.Errorf("consumer %s, expected %s", consumer, test.expected)
+			}
+		})
+	}
+}
+
+func TestReconnectReadsPending(t *testing.T) {
+	subject := pkix.Name{CommonName: "billing", Organization: []string{"Example"}}
+	client, fake := newFakeRedis(func(cmd redis.Cmder) error {
+		switch cmd := cmd.(type) {
+		case *redis.XPendingExtCmd:
+			cmd.SetVal([]redis.XPendingExt{{ID: "1-0", Consumer: "CN=billing,O=Example", RetryCount: 1}})
+			return nil
+		case *redis.StatusCmd:
+			return errors.New("BUSYGROUP Consumer Group name already exists")
+		}
+		return fmt.Errorf("unexpected command %v", cmd.Args())
+	})
+	defer client.Close()
+	rwsConfig := &RWSRedis{Source: ConfigSource{Group: "g1"}, Delivery: ConfigDelivery{Ack: true}}
+
+	// the first connection closes with an entry not acked
+	first := newStreamReader(testSession(t, "conn-1", "rws.local:8800/ws"), rwsConfig, sessionConsumer(consumerRequest("", subject), "conn-1"), client, redis.Options{}, discardLogger)
+	first.sess.setPosition("s1", "1-0")
+	first.release(context.Background())
+
+	// the same client reconnects and reads pending entries of its consumer first
+	second := newStreamReader(testSession(t, "conn-2", "rws.local:8800/ws"), rwsConfig, sessionConsumer(consumerRequest("", subject), "conn-2"), client, redis.Options{}, discardLogger)
+	if second.consumer != first.consumer {
+		t.Errorf("consumer %s, expected %s of the first connection", second.consumer, first.consumer)
+	}
+	id, err := second.startRead(context.Background(), "s1", "$")
+	if err != nil || id != "0" {
+		t.Errorf("start %s %v, expected 0 to read pending entries", id, err)
+	}
+	expected := []string{"xpending s1 g1 - + 1 CN=billing,O=Example", "xgroup create s1 g1 $"}
+	if commands := fake.sent(); !slices.Equal(commands, expected) {
+		t.Errorf("commands %q, expected %q, the consumer with pending entries is kept", commands, expected)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// default paths of operational endpoints on admin.address
+const (
+	defaultMetricsPath  = "/metrics"
+	defaultHealthPath   = "/healthz"
+	defaultReadyPath    = "/readyz"
+	defaultSessionsPath = "/sessions"
+)
+
+// adminPath returns path of an operational endpoint, on admin.address every
+// endpoint is enabled with its default path, on endpoint addresses only
+// configured ones and only with admin.public, empty when it is not served
+func (config *Config) adminPath(path string, defaultPath string) string {
+	if config.AdminAddress == "" {
+		if !config.AdminPublic {
+			return ""
+		}
+		return path
+	}
+	if path == "" {
+		return defaultPath
+	}
+	return path
+}
+
+// adminHandler returns handler of operational endpoints or nil when none is enabled
+func (config *Config) adminHandler(running *listeners) *http.ServeMux {
+	mux := http.NewServeMux()
+	enabled := false
+	if path := config.adminPath(config.MetricsPath, defaultMetricsPath); path != "" {
+		mux.HandleFunc(path, serveMetrics)
+		enabled = true
+	}
+	if path := config.adminPath(config.HealthPath, defaultHealthPath); path != "" {
+		mux.HandleFunc(path, serveHealth)
+		enabled = true
+	}
+	if path := config.adminPath(config.ReadyPath, defaultReadyPath); path != "" {
+		timeout := config.ReadyTimeout
+		if timeout <= 0 {
+			timeout = defaultReadyTimeout
+		}
+		mux.Handle(path, readinessHandler(running, timeout))
+		enabled = true
+	}
+	// the sessions API is never served without admin.token
+	if path := config.adminPath(config.SessionsPath, defaultSessionsPath); path != "" && config.AdminToken != "" {
+		handler := sessionsHandler(path, config.AdminToken)
+		mux.Handle(path, handler)
+		mux.Handle(path+"/", handler)
+		enabled = true
+	}
+	if !enabled {
+		return nil
+	}
+	return mux
+}
+
+// adminServer dedicated listener of operational endpoints, a reload swaps
+// its handler so paths and admin.token follow the config
+type adminServer struct {
+	server   *http.Server
+	listener net.Listener
+
+	mu      sync.Mutex
+	handler *http.ServeMux
+}
+
+// startAdmin starts dedicated listener for operational endpoints when admin.address is set
+func startAdmin(config *Config, running *listeners) *adminServer {
+	if config.AdminAddress == "" {
+		return nil
+	}
+	admin := &adminServer{handler: config.adminHandler(running)}
+	admin.server = &http.Server{Addr: config.AdminAddress, Handler: admin}
+	listener, err := listen(config.AdminAddress, 0, "")
+	if err != nil {
+		fatal("Admin listener failed", "address", config.AdminAddress, "error", err)
+	}
+	admin.listener = listener
+	go func() {
+		if err := admin.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Admin listener failed", "address", config.AdminAddress, "error", err)
+		}
+	}()
+	return admin
+}
+
+// update replaces handler of operational endpoints with the one of reloaded
+// config, admin.address itself is read at startup only
+func (admin *adminServer) update(config *Config, running *listeners) {
+	if admin == nil {
+		return
+	}
+	if config.AdminAddress != admin.server.Addr {
+		slog.Warn("Reload: admin.address changes on restart only", "address", admin.server.Addr, "configured", config.AdminAddress)
+		return
+	}
+	handler := config.adminHandler(running)
+	admin.mu.Lock()
+	admin.handler = handler
+	admin.mu.Unlock()
+}
+
+func (admin *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	admin.mu.Lock()
+	handler := admin.handler
+	admin.mu.Unlock()
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// address returns admin.address the server listens on, empty without it
+func (admin *adminServer) address() string {
+	if admin == nil {
+		return ""
+	}
+	return admin.server.Addr
+}
+
+// boundListener returns listener of the server, nil without it
+func (admin *adminServer) boundListener() net.Listener {
+	if admin == nil {
+		return nil
+	}
+	return admin.listener
+}
+
+// stopAdmin stops listener started by startAdmin
+func stopAdmin(admin *adminServer) {
+	if admin == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+	if err := admin.server.Shutdown(ctx); err != nil {
+		slog.Warn("Shutdown", "address", admin.server.Addr, "error", err)
+	}
+}
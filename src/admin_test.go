@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		path     string
+		expected string
+	}{
+		{name: "admin address default", config: Config{AdminAddress: ":9100"}, expected: "/metrics"},
+		{name: "admin address configured", config: Config{AdminAddress: ":9100"}, path: "/m", expected: "/m"},
+		{name: "endpoint address without opt-in", config: Config{}, path: "/m", expected: ""},
+		{name: "endpoint address public", config: Config{AdminPublic: true}, path: "/m", expected: "/m"},
+		{name: "endpoint address public without path", config: Config{AdminPublic: true}, expected: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if path := test.config.adminPath(test.path, defaultMetricsPath); path != test.expected {
+				t.Errorf("path %q, expected %q", path, test.expected)
+			}
+		})
+	}
+}
+
+func TestAdminOnEndpointAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		public bool
+		status int
+	}{
+		{name: "off by default", status: http.StatusNotFound},
+		{name: "admin.public", public: true, status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{MetricsPath: "/metrics", HealthPath: "/healthz", AdminPublic: test.public}
+			rws := testDrainRWS()
+			rws.Admin = config.adminHandler(newListeners())
+			for _, path := range []string{"/metrics", "/healthz"} {
+				w := httptest.NewRecorder()
+				rws.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://rws.local:8800"+path, nil))
+				if w.Code != test.status {
+					t.Errorf("%s answered %d, expected %d", path, w.Code, test.status)
+				}
+			}
+		})
+	}
+}
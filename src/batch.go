@@ -0,0 +1,82 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultReadCount entries returned by one read of a stream
+const defaultReadCount = 1000
+
+// readCount returns COUNT of reads of the streams
+func (reader *streamReader) readCount() int64 {
+	if reader.source.ReadCount > 0 {
+		return reader.source.ReadCount
+	}
+	return defaultReadCount
+}
+
+// frame websocket message holding entries of a stream
+type frame struct {
+	payload  []byte
+	messages []redis.XMessage
+}
+
+// encodeFrames encodes messages of stream into frames of at most maxBytes,
+// a single entry larger than that gets a frame of its own, without maxBytes
+// all of them go into one frame
+func encodeFrames(format entryFormat, stream string, messages []redis.XMessage, messageType string, maxBytes int) ([]frame, error) {
+	frames := make([]frame, 0)
+	var elements [][]byte
+	first, size := 0, 0
+	flush := func(end int) {
+		if len(elements) > 0 {
+			frames = append(frames, frame{payload: format.join(stream, elements), messages: messages[first:end]})
+		}
+		first, elements, size = end, nil, 0
+	}
+	for i, message := range messages {
+		element, err := format.element(message, messageType)
+		if err != nil {
+			return nil, err
+		}
+		if maxBytes > 0 && len(elements) > 0 && format.size(stream, len(elements)+1, size+len(element)) > maxBytes {
+			flush(i)
+		}
+		elements = append(elements, element)
+		size += len(element)
+	}
+	flush(len(messages))
+	return frames, nil
+}
+
+// lingerBuffer holds batches for batch.linger, so entries of a stream read
+// in that time are sent in one frame
+type lingerBuffer struct {
+	linger  time.Duration
+	pending []streamBatch
+	chFlush <-chan time.Time
+}
+
+// add queues batch behind the queued entries of its stream
+func (buffer *lingerBuffer) add(batch streamBatch) {
+	for i := range buffer.pending {
+		if buffer.pending[i].Stream == batch.Stream && buffer.pending[i].replayed == batch.replayed {
+			buffer.pending[i].Messages = append(slices.Clip(buffer.pending[i].Messages), batch.Messages...)
+			return
+		}
+	}
+	buffer.pending = append(buffer.pending, batch)
+	if buffer.chFlush == nil {
+		buffer.chFlush = time.After(buffer.linger)
+	}
+}
+
+// take returns the queued batches and empties the buffer
+func (buffer *lingerBuffer) take() []streamBatch {
+	pending := buffer.pending
+	buffer.pending, buffer.chFlush = nil, nil
+	return pending
+}
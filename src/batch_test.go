@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testMessages returns count entries with a value of size bytes
+func testMessages(count int, size int) []redis.XMessage {
+	messages := make([]redis.XMessage, count)
+	for i := range messages {
+		messages[i] = redis.XMessage{ID: fmt.Sprintf("%d-0", i+1), Values: map[string]interface{}{"v": strings.Repeat("x", size)}}
+	}
+	return messages
+}
+
+// frameIDs returns IDs of the entries of every frame
+func frameIDs(frames []frame) [][]string {
+	ids := make([][]string, len(frames))
+	for i, frame := range frames {
+		for _, message := range frame.messages {
+			ids[i] = append(ids[i], message.ID)
+		}
+	}
+	return ids
+}
+
+func TestEncodeFrames(t *testing.T) {
+	// a text entry {"ID":"1-0","Values":{"v":"xxxxxxxxxx"}} takes 40 bytes
+	mixed := testMessages(3, 10)
+	mixed[1].Values["v"] = strings.Repeat("x", 100)
+	tests := []struct {
+		name     string
+		protocol string
+		messages []redis.XMessage
+		maxBytes int
+		expected [][]string
+	}{
+		{name: "no entries", protocol: protocolJSON, messages: nil, maxBytes: 0, expected: [][]string{}},
+		{name: "no limit", protocol: protocolJSON, messages: testMessages(5, 10), maxBytes: 0, expected: [][]string{{"1-0", "2-0", "3-0", "4-0", "5-0"}}},
+		{name: "limit above batch", protocol: protocolJSON, messages: testMessages(3, 10), maxBytes: 1000, expected: [][]string{{"1-0", "2-0", "3-0"}}},
+		// [e,e] is 2+40+1+40 = 83 bytes
+		{name: "exact fit", protocol: protocolJSON, messages: testMessages(4, 10), maxBytes: 83, expected: [][]string{{"1-0", "2-0"}, {"3-0", "4-0"}}},
+		{name: "one byte short", protocol: protocolJSON, messages: testMessages(3, 10), maxBytes: 82, expected: [][]string{{"1-0"}, {"2-0"}, {"3-0"}}},
+		{name: "oversized entry gets own frame", protocol: protocolJSON, messages: testMessages(3, 100), maxBytes: 50, expected: [][]string{{"1-0"}, {"2-0"}, {"3-0"}}},
+		{name: "oversized entry among small ones", protocol: protocolJSON, messages: mixed, maxBytes: 100, expected: [][]string{{"1-0"}, {"2-0"}, {"3-0"}}},
+		// a msgpack entry takes 29 bytes, two of them with the array header 59
+		{name: "msgpack", protocol: protocolMsgpack, messages: testMessages(5, 10), maxBytes: 70, expected: [][]string{{"1-0", "2-0"}, {"3-0", "4-0"}, {"5-0"}}},
+		// {"event":"entries","stream":"orders","entries":[e,e]} is 48+40+1+40+2 = 131 bytes
+		{name: "envelope counts its prefix", protocol: protocolEnvelope, messages: testMessages(3, 10), maxBytes: 131, expected: [][]string{{"1-0", "2-0"}, {"3-0"}}},
+		{name: "envelope one byte short", protocol: protocolEnvelope, messages: testMessages(2, 10), maxBytes: 130, expected: [][]string{{"1-0"}, {"2-0"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format := entryFormats[test.protocol]
+			frames, err := encodeFrames(format, "orders", test.messages, "text", test.maxBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := frameIDs(frames)
+			if !slices.EqualFunc(ids, test.expected, slices.Equal[[]string]) {
+				t.Fatalf("frames %v, expected %v", ids, test.expected)
+			}
+			for _, frame := range frames {
+				// splits rely on the size of a frame being known before it is joined
+				elementBytes := 0
+				for _, message := range frame.messages {
+					element, _ := format.element(message, "text")
+					elementBytes += len(element)
+				}
+				if size := format.size("orders", len(frame.messages), elementBytes); size != len(frame.payload) {
+					t.Errorf("size %d of a frame of %d bytes", size, len(frame.payload))
+				}
+				if test.maxBytes > 0 && len(frame.messages) > 1 && len(frame.payload) > test.maxBytes {
+					t.Errorf("frame of %d entries has %d bytes, limit %d", len(frame.messages), len(frame.payload), test.maxBytes)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeFramesPayload(t *testing.T) {
+	messages := []redis.XMessage{
+		{ID: "1-0", Values: map[string]interface{}{"a": "1"}},
+		{ID: "2-0", Values: map[string]interface{}{"b": `{"c":2}`}},
+	}
+	tests := []struct {
+		name        string
+		protocol    string
+		messageType string
+		expected    []string
+	}{
+		{
+			name:        "json array",
+			protocol:    protocolJSON,
+			messageType: "json",
+			expected:    []string{`[{"ID":"1-0","Values":{"a":"1"}}]`, `[{"ID":"2-0","Values":{"b":{"c":2}}}]`},
+		},
+		{
+			name:        "text values stay strings",
+			protocol:    protocolJSON,
+			messageType: "text",
+			expected:    []string{`[{"ID":"1-0","Values":{"a":"1"}}]`, `[{"ID":"2-0","Values":{"b":"{\"c\":2}"}}]`},
+		},
+		{
+			name:        "envelope",
+			protocol:    protocolEnvelope,
+			messageType: "json",
+			expected: []string{
+				`{"event":"entries","stream":"orders","entries":[{"ID":"1-0","Values":{"a":"1"}}]}`,
+				`{"event":"entries","stream":"orders","entries":[{"ID":"2-0","Values":{"b":{"c":2}}}]}`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format := entryFormats[test.protocol]
+			// one byte less than both entries forces a frame per entry
+			whole, err := encodeFrames(format, "orders", messages, test.messageType, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames, err := encodeFrames(format, "orders", messages, test.messageType, len(whole[0].payload)-1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != len(test.expected) {
+				t.Fatalf("%d frames, expected %d", len(frames), len(test.expected))
+			}
+			for i, frame := range frames {
+				if string(frame.payload) != test.expected[i] {
+					t.Errorf("frame %d\n%s\nexpected\n%s", i, frame.payload, test.expected[i])
+				}
+				if !json.Valid(frame.payload) {
+					t.Errorf("frame %d is not valid JSON", i)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeFramesMsgpack(t *testing.T) {
+	messages := testMessages(3, 10)
+	frames, err := encodeFrames(entryFormats[protocolMsgpack], "orders", messages, "text", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("%d frames, expected 1", len(frames))
+	}
+	// an array of 3 followed by the elements
+	expected := []byte{0x93}
+	for _, message := range messages {
+		element, _ := msgpackElement(message, "text")
+		expected = append(expected, element...)
+	}
+	if !bytes.Equal(frames[0].payload, expected) {
+		t.Errorf("payload %x, expected %x", frames[0].payload, expected)
+	}
+}
+
+func TestEncodeFramesError(t *testing.T) {
+	messages := []redis.XMessage{{ID: "1-0", Values: map[string]interface{}{"a": "{broken"}}}
+	for _, protocol := range []string{protocolJSON, protocolMsgpack, protocolEnvelope} {
+		if _, err := encodeFrames(entryFormats[protocol], "orders", messages, "json", 0); err == nil {
+			t.Errorf("%s: no error for invalid JSON value", protocol)
+		}
+	}
+}
+
+func TestLingerBuffer(t *testing.T) {
+	buffer := &lingerBuffer{linger: time.Hour}
+	first := testMessages(2, 1)
+	buffer.add(streamBatch{XStream: redis.XStream{Stream: "a", Messages: first[:1]}})
+	buffer.add(streamBatch{XStream: redis.XStream{Stream: "b", Messages: first[:1]}})
+	buffer.add(streamBatch{XStream: redis.XStream{Stream: "a", Messages: first[1:]}})
+	buffer.add(streamBatch{XStream: redis.XStream{Stream: "a", Messages: first[:1]}, replayed: true})
+	if buffer.chFlush == nil {
+		t.Error("no flush timer")
+	}
+	pending := buffer.take()
+	summary := make([]string, 0, len(pending))
+	for _, batch := range pending {
+		summary = append(summary, fmt.Sprintf("%s:%d:%v", batch.Stream, len(batch.Messages), batch.replayed))
+	}
+	if got := strings.Join(summary, " "); got != "a:2:false b:1:false a:1:true" {
+		t.Errorf("batches %s", got)
+	}
+	// entries of a stream are appended to a copy, first keeps its entries
+	if len(first) != 2 || first[1].ID != "2-0" {
+		t.Errorf("input changed to %v", first)
+	}
+	if buffer.take() != nil || buffer.chFlush != nil {
+		t.Error("buffer not empty after take")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// defaultCompressionMinSize messages smaller than this are sent uncompressed
+const defaultCompressionMinSize = 256
+
+// deflateTail end of a flushed deflate block, left out of messages
+var deflateTail = []byte{0, 0, 0xff, 0xff}
+
+// compressionExtension returns permessage-deflate extension of delivery, the
+// client always has to drop its context, so client messages can be read on their own
+func compressionExtension(delivery ConfigDelivery) *wsflate.Extension {
+	return &wsflate.Extension{
+		Parameters: wsflate.Parameters{
+			ServerNoContextTakeover: !delivery.CompressionContextTakeover,
+			ClientNoContextTakeover: true,
+		},
+	}
+}
+
+// negotiateCompression accepts permessage-deflate, a client asking the
+// server to drop its context gets it even with context takeover configured
+func negotiateCompression(extension *wsflate.Extension) func(httphead.Option) (httphead.Option, error) {
+	return func(option httphead.Option) (httphead.Option, error) {
+		var offer wsflate.Parameters
+		if bytes.Equal(option.Name, wsflate.ExtensionNameBytes) && offer.Parse(option) == nil && offer.ServerNoContextTakeover {
+			extension.Parameters.ServerNoContextTakeover = true
+		}
+		return extension.Negotiate(option)
+	}
+}
+
+// deflater compresses messages of a websocket, with context takeover the
+// window of earlier messages is kept
+type deflater struct {
+	level    int
+	minSize  int
+	takeover bool
+
+	buf    bytes.Buffer
+	writer *flate.Writer
+}
+
+// newDeflater returns deflater of delivery for negotiated extension, nil when
+// compression was not negotiated
+func newDeflater(delivery ConfigDelivery, extension *wsflate.Extension) *deflater {
+	if extension == nil {
+		return nil
+	}
+	if _, accepted := extension.Accepted(); !accepted {
+		return nil
+	}
+	compressor := &deflater{
+		level:    delivery.CompressionLevel,
+		minSize:  delivery.CompressionMinSize,
+		takeover: !extension.Parameters.ServerNoContextTakeover,
+	}
+	if compressor.level == 0 {
+		compressor.level = flate.DefaultCompression
+	}
+	if compressor.minSize == 0 {
+		compressor.minSize = defaultCompressionMinSize
+	}
+	return compressor
+}
+
+// compress returns payload of a compressed message, valid until the next call
+func (compressor *deflater) compress(payload []byte) ([]byte, error) {
+	compressor.buf.Reset()
+	if compressor.writer == nil {
+		writer, err := flate.NewWriter(&compressor.buf, compressor.level)
+		if err != nil {
+			return nil, err
+		}
+		compressor.writer = writer
+	} else if !compressor.takeover {
+		compressor.writer.Reset(&compressor.buf)
+	}
+	if _, err := compressor.writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := compressor.writer.Flush(); err != nil {
+		return nil, err
+	}
+	compressed, found := bytes.CutSuffix(compressor.buf.Bytes(), deflateTail)
+	if !found {
+		return nil, errors.New("unexpected end of deflate block")
+	}
+	return compressed, nil
+}
+
+// messageWriter writes messages of a websocket, compressed when
+// permessage-deflate was negotiated and they are large enough, frames of
+// the main loop and answers to control frames of the client are serialized
+type messageWriter struct {
+	conn       net.Conn
+	endpoint   string
+	compressor *deflater
+
+	mu sync.Mutex
+}
+
+// write sends payload as one message
+func (writer *messageWriter) write(op ws.OpCode, payload []byte) error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	if writer.compressor == nil || len(payload) < writer.compressor.minSize {
+		return wsutil.WriteServerMessage(writer.conn, op, payload)
+	}
+	compressed, err := writer.compressor.compress(payload)
+	if err != nil {
+		return err
+	}
+	frame := ws.NewFrame(op, true, compressed)
+	if frame.Header, err = wsflate.SetBit(frame.Header); err != nil {
+		return err
+	}
+	metricCompressionInput.add(float64(len(payload)), writer.endpoint)
+	metricCompressionOutput.add(float64(len(compressed)), writer.endpoint)
+	return ws.WriteFrame(writer.conn, frame)
+}
+
+// control answers a control frame of the client read from src: a pong for a
+// ping, a close frame for a close, which is returned as wsutil.ClosedError
+func (writer *messageWriter) control(header ws.Header, src io.Reader) error {
+	var answer bytes.Buffer
+	err := (wsutil.ControlHandler{Src: src, Dst: &answer, State: ws.StateServerSide, DisableSrcCiphering: true}).Handle(header)
+	if answer.Len() > 0 {
+		writer.mu.Lock()
+		_, writeErr := writer.conn.Write(answer.Bytes())
+		writer.mu.Unlock()
+		if err == nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+// readClientMessage reads the next text or binary message of the client from
+// conn, decompressed when the writer compresses and the client compressed it
+func readClientMessage(conn net.Conn, writer *messageWriter) ([]byte, ws.OpCode, error) {
+	var state wsflate.MessageState
+	reader := wsutil.Reader{
+		Source:         conn,
+		State:          ws.StateServerSide,
+		OnIntermediate: writer.control,
+	}
+	if writer.compressor != nil {
+		reader.State |= ws.StateExtended
+		reader.Extensions = []wsutil.RecvExtension{&state}
+	}
+	for {
+		header, err := reader.NextFrame()
+		if err != nil {
+			return nil, 0, err
+		}
+		if header.OpCode.IsControl() {
+			if err := writer.control(header, &reader); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if header.OpCode&(ws.OpText|ws.OpBinary) == 0 {
+			if err := reader.Discard(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if !state.IsCompressed() {
+			payload, err := io.ReadAll(&reader)
+			return payload, header.OpCode, err
+		}
+		decompressor := wsflate.NewReader(&reader, func(r io.Reader) wsflate.Decompressor {
+			return flate.NewReader(r)
+		})
+		payload, err := io.ReadAll(decompressor)
+		return payload, header.OpCode, err
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+)
+
+// inflate returns payload of a compressed message, dict holds the messages
+// sent before with context takeover
+func inflate(t *testing.T, payload []byte, dict []byte) []byte {
+	t.Helper()
+	// the removed tail and an empty final block end the deflate stream
+	stream := append(append(bytes.Clone(payload), deflateTail...), 1, 0, 0, 0xff, 0xff)
+	reader := flate.NewReaderDict(bytes.NewReader(stream), dict)
+	defer reader.Close()
+	inflated, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inflated
+}
+
+// serverFrames writes messages with writer over a pipe and returns the frames the client reads
+func serverFrames(t *testing.T, compressor *deflater, messages []string) []ws.Frame {
+	t.Helper()
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		writer := &messageWriter{conn: server, endpoint: "rws.local:8800/ws", compressor: compressor}
+		for _, message := range messages {
+			if err := writer.write(ws.OpText, []byte(message)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	frames := make([]ws.Frame, 0, len(messages))
+	for range messages {
+		frame, err := ws.ReadFrame(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func TestServerCompression(t *testing.T) {
+	large := strings.Repeat(`{"stream":"orders","id":"1-0","values":{"sku":"A-1"}}`, 10)
+	tests := []struct {
+		name       string
+		takeover   bool
+		messages   []string
+		compressed []bool
+	}{
+		{name: "small messages are not compressed", messages: []string{"ping", large}, compressed: []bool{false, true}},
+		{name: "no context takeover", messages: []string{large, large}, compressed: []bool{true, true}},
+		{name: "context takeover", takeover: true, messages: []string{large, large, "pong", large}, compressed: []bool{true, true, false, true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			extension := compressionExtension(ConfigDelivery{Compression: true, CompressionContextTakeover: test.takeover})
+			if _, err := extension.Negotiate(wsflate.Parameters{ClientNoContextTakeover: true}.Option()); err != nil {
+				t.Fatal(err)
+			}
+			compressor := newDeflater(ConfigDelivery{Compression: true}, extension)
+			if compressor == nil || compressor.takeover != test.takeover {
+				t.Fatalf("deflater %+v, expected takeover %v", compressor, test.takeover)
+			}
+			var dict []byte
+			for i, frame := range serverFrames(t, compressor, test.messages) {
+				compressed, err := wsflate.IsCompressed(frame.Header)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if compressed != test.compressed[i] {
+					t.Fatalf("message %d compressed %v, expected %v", i, compressed, test.compressed[i])
+				}
+				payload := frame.Payload
+				if compressed {
+					if len(payload) >= len(test.messages[i]) {
+						t.Errorf("message %d of %d bytes compressed to %d", i, len(test.messages[i]), len(payload))
+					}
+					payload = inflate(t, payload, dict)
+					if test.takeover {
+						dict = append(dict, payload...)
+					}
+				}
+				if string(payload) != test.messages[i] {
+					t.Errorf("message %d %q, expected %q", i, payload, test.messages[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNewDeflaterNotNegotiated(t *testing.T) {
+	if compressor := newDeflater(ConfigDelivery{Compression: true}, nil); compressor != nil {
+		t.Errorf("deflater without extension")
+	}
+	if compressor := newDeflater(ConfigDelivery{Compression: true}, compressionExtension(ConfigDelivery{})); compressor != nil {
+		t.Errorf("deflater without an offer of the client")
+	}
+}
+
+// compressedFrame returns a frame of payload compressed as a client without context takeover does
+func compressedFrame(t *testing.T, op ws.OpCode, payload string) ws.Frame {
+	t.Helper()
+	compressed, err := (&deflater{level: flate.DefaultCompression}).compress([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := ws.NewFrame(op, true, bytes.Clone(compressed))
+	if frame.Header, err = wsflate.SetBit(frame.Header); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestReadClientMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed bool
+		frames     func(t *testing.T) []ws.Frame
+		payload    string
+		op         ws.OpCode
+	}{
+		{
+			name:       "compressed text",
+			compressed: true,
+			frames: func(t *testing.T) []ws.Frame {
+				return []ws.Frame{compressedFrame(t, ws.OpText, `{"type":"ack","ids":{"orders":["1-0"]}}`)}
+			},
+			payload: `{"type":"ack","ids":{"orders":["1-0"]}}`,
+			op:      ws.OpText,
+		},
+		{
+			name:       "compressed binary",
+			compressed: true,
+			frames: func(t *testing.T) []ws.Frame {
+				return []ws.Frame{compressedFrame(t, ws.OpBinary, "\x81\xa4type")}
+			},
+			payload: "\x81\xa4type",
+			op:      ws.OpBinary,
+		},
+		{
+			name:       "uncompressed with compression negotiated",
+			compressed: true,
+			frames: func(t *testing.T) []ws.Frame {
+				return []ws.Frame{ws.NewTextFrame([]byte(`{"type":"pause"}`))}
+			},
+			payload: `{"type":"pause"}`,
+			op:      ws.OpText,
+		},
+		{
+			name:       "fragmented compressed message",
+			compressed: true,
+			frames: func(t *testing.T) []ws.Frame {
+				frame := compressedFrame(t, ws.OpText, `{"type":"resume"}`)
+				half := len(frame.Payload) / 2
+				first := ws.NewFrame(ws.OpText, false, frame.Payload[:half])
+				first.Header = frame.Header
+				first.Header.Fin, first.Header.Length = false, int64(half)
+				return []ws.Frame{first, ws.NewFrame(ws.OpContinuation, true, frame.Payload[half:])}
+			},
+			payload: `{"type":"resume"}`,
+			op:      ws.OpText,
+		},
+		{
+			name: "without compression",
+			frames: func(t *testing.T) []ws.Frame {
+				return []ws.Frame{ws.NewTextFrame([]byte(`{"type":"resume"}`))}
+			},
+			payload: `{"type":"resume"}`,
+			op:      ws.OpText,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frames := test.frames(t)
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				defer client.Close()
+				for _, frame := range frames {
+					if err := ws.WriteFrame(client, ws.MaskFrameInPlace(frame)); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			writer := &messageWriter{conn: server}
+			if test.compressed {
+				writer.compressor = &deflater{level: flate.DefaultCompression}
+			}
+			payload, op, err := readClientMessage(server, writer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != test.payload || op != test.op {
+				t.Errorf("message %q %v, expected %q %v", payload, op, test.payload, test.op)
+			}
+		})
+	}
+}
+
+func TestControlFramesSerialized(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	writer := &messageWriter{conn: server, endpoint: "rws.local:8800/ws"}
+	const messages = 50
+	// the main loop writes entries while the client's pings are answered
+	go func() {
+		for i := 0; i < messages; i++ {
+			if err := writer.write(ws.OpBinary, []byte(strings.Repeat("e", 100))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	chRead := make(chan error, 1)
+	go func() {
+		_, _, err := readClientMessage(server, writer)
+		chRead <- err
+	}()
+	go func() {
+		for i := 0; i < messages; i++ {
+			if err := ws.WriteFrame(client, ws.MaskFrameInPlace(ws.NewPingFrame([]byte("p")))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		ws.WriteFrame(client, ws.MaskFrameInPlace(ws.NewTextFrame([]byte(`{"op":"pause"}`))))
+	}()
+	pongs, entries := 0, 0
+	for pongs < messages || entries < messages {
+		frame, err := ws.ReadFrame(client)
+		if err != nil {
+			t.Fatalf("after %d pongs and %d entries: %v", pongs, entries, err)
+		}
+		switch {
+		case frame.Header.OpCode == ws.OpPong && string(frame.Payload) == "p":
+			pongs++
+		case frame.Header.OpCode == ws.OpBinary && len(frame.Payload) == 100:
+			entries++
+		default:
+			t.Fatalf("unexpected frame %+v", frame.Header)
+		}
+	}
+	if err := <-chRead; err != nil {
+		t.Error(err)
+	}
+}
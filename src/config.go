@@ -1,156 +1,345 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
-	"path/filepath"
+	"log/slog"
 	"strings"
-
-	yaml "gopkg.in/yaml.v2"
+	"time"
 )
 
-const initConfig = `schema.version: "1.0"
+const initConfig = `schema.version: "2.0"
 # tls.cert.file: my-domain.crt
 # tls.key.file: my-domain.key
-redis.to.websocket:
-  - redis.client.config:
-      # https://github.com/edenhill/librdredis/blob/master/CONFIGURATION.md#global-configuration-properties
-      metadata.broker.list: localhost:6379
-      group.id: my-redis-group
-    redis.default.stream.config:
-      auto.offset.reset: latest
-    redis.streams:
-      - my.redis.stream
-    address: :9999
-    # message.details: false
-    # message.type: json
-    # endpoint.prefix: ""
-    # endpoint.websocket: ws
-    # endpoint.test: test
-    # on.close.key: my.redis.stream.is_closed
-    # on.close.value: true
+# tls.min.version: "1.2" # 1.0, 1.1, 1.2 or 1.3
+# tls.ciphers: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256] # TLS 1.2 and older only
+# tls.client.ca.file: clients-ca.crt # verify client certificates (mutual TLS)
+# tls.client.auth: require # request or require (default with tls.client.ca.file) a client certificate
+# listeners: # TLS per address instead of the tls.* settings above
+  # - address: :8800 # plain HTTP
+  # - address: unix:/run/rws/rws.sock # behind a local proxy
+    # socket.mode: "0660"
+    # socket.group: www-data
+  # - address: :443
+    # tls.certificates: # picked by the server name the client asks for (SNI)
+      # - { cert.file: a.example.com.crt, key.file: a.example.com.key }
+      # - { cert.file: b.example.com.crt, key.file: b.example.com.key }
+    # tls.client.ca.file: machines-ca.crt
+# trusted.proxies: [10.0.0.0/8, unix] # honor X-Forwarded-* and Forwarded headers from these
+# public.base.url: https://example.com/rws # websocket URL of test UIs behind a proxy
+# shutdown.timeout: 10s
+# config.watch.interval: 5s
+# log.level: info # debug, info, warn or error
+# log.format: text # text or json
+# admin.address: :9100 # dedicated listener for operational endpoints
+# admin.public: false # without admin.address serve the paths below on every endpoint address
+# metrics.path: /metrics # served on admin.address or, without it, on every endpoint address
+# metrics.lag.interval: 15s # how often consumer lag of the streams is read
+# metrics.stream.limit: 100 # streams labeled by name, further streams share the _other label
+# health.path: /healthz
+# ready.path: /readyz
+# ready.timeout: 2s
+# sessions.path: /sessions # API to list and close websockets, needs admin.token
+# admin.token: ${file:/run/secrets/rws_admin_token}
+# resume.secret: ${file:/run/secrets/rws_resume_secret} # signs resume tokens, enables them
+# resume.interval: 10s
+# resume.ttl: 24h
+endpoints:
+  - address: :9999
+    # path.prefix: ""
+    # path.websocket: ws
+    # path.test: test
+    connection:
+      address: localhost:6379
+      # ${ENV_VAR}, ${ENV_VAR:-default} and ${file:/path} are expanded anywhere
+      # username: ${REDIS_USERNAME}
+      # password: ${file:/run/secrets/redis_password}
+      # db: ${REDIS_DB:-0}
+    source:
+      streams:
+        - my.redis.stream
+      # start: "0" # "0" all entries, "$" only new ones or an entry ID
+      # group: my-redis-group # read as consumer of the group
+      # discovery.interval: 30s # pick up new streams matching patterns like my.redis.*
+      # read.count: 1000 # entries per read of a stream
+      # read.block: 0s # longest wait of a read for new entries, 0 waits until they come
+      # access: # streams clients with a verified certificate may read, by its subject or a SAN
+        # - identity: CN=billing,O=Example
+          # streams: [my.redis.orders.*]
+    # delivery:
+      # message.type: json # json, text or binary
+      # subprotocols: [rws.json.v1, rws.msgpack.v1, rws.envelope.v1] # wire formats offered to clients
+      # compression: false # permessage-deflate when the client supports it
+      # compression.level: 6 # 1 fastest to 9 smallest
+      # compression.min.size: 256 # smaller messages are sent uncompressed
+      # compression.context.takeover: false # keep the window across messages, costs memory per websocket
+      # on.close.key: my.redis.stream.is_closed
+      # on.close.value: true
+      # ack: false # settle entries once the client acks them, needs source.group
+      # ack.timeout: 30s # entries not acked in time are delivered again
+      # batch.max.bytes: 1048576 # entries are split into frames of at most this size
+      # batch.linger: 0s # hold entries this long to send them in fewer frames
+      # sentinel.field: CLOSE # an entry with the field closes, any value when sentinel.value is empty
+      # sentinel.value: CHANNEL
+      # sentinel.when: '{{eq .Values.type "end"}}' # predicate template of .Stream, .ID, .Values instead of field and value
+      # sentinel.scope: socket # socket, stream or none
+      # sentinel.deliver: false # deliver the closing entry itself
+      # sentinel.code: 1000 # close code sent to the client
+      # sentinel.reason: stream closed
+      # presence.key: rws.presence.dashboard # sorted set of connection IDs, metadata at key:ID
+      # presence.ttl: 30s # refreshed by heartbeats while the websocket is open
+      # on.open: # hooks, keys and values are templates of .ID, .Remote, .Endpoint, .Streams, .User, .SANs
+        # - command: set # set, xadd, publish or eval
+          # key: rws.online.{{.ID}}
+          # value: "{{.Remote}}"
+          # ttl: 1h
+      # on.close: # adds .Code, .Reason and .Positions, the last delivered entry IDs
+        # - command: xadd
+          # key: rws.events
+          # fields: { event: "{{.Event}}", conn: "{{.ID}}", reason: "{{.Reason}}", positions: "{{json .Positions}}" }
 `
 
-// ConfigRWS Redis to websocket YAML
-type ConfigRWS struct {
-	RedisClientConfig        map[string]interface{} `yaml:"redis.client.config"`
-	RedisDefaultStreamConfig map[string]interface{} `yaml:"redis.default.stream.config"`
-	RedisStreams             []string               `yaml:"redis.streams"`
-	Address                  string                 `yaml:"address"`
-	EndpointPrefix           string                 `yaml:"endpoint.prefix"`
-	EndpointTest             string                 `yaml:"endpoint.test"`
-	EndpointWS               string                 `yaml:"endpoint.websocket"`
-	OnCloseKey               string                 `yaml:"on.close.key"`
-	OnCloseValue             string                 `yaml:"on.close.value"`
-	MessageType              string                 `yaml:"message.type"`
-	Compression              bool                   `yaml:"compression"`
+// currentSchemaVersion schema version written by -init and -migrate
+const currentSchemaVersion = "2.0"
+
+// ConfigConnection redis connection
+type ConfigConnection struct {
+	Address  string `yaml:"address"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	DB       int    `yaml:"db,omitempty"`
+}
+
+// ConfigSource redis streams read by the endpoint
+type ConfigSource struct {
+	Streams []string `yaml:"streams,omitempty"`
+	// Start "0" reads all entries, "$" only new ones, otherwise entries after the ID
+	Start string `yaml:"start,omitempty"`
+	Group string `yaml:"group,omitempty"`
+	// DiscoveryInterval period of rediscovery of streams matching Streams, 0 disables it
+	DiscoveryInterval time.Duration `yaml:"discovery.interval,omitempty"`
+	// ReadCount COUNT of a read, ReadBlock longest time a read waits for entries, 0 waits until they come
+	ReadCount int64         `yaml:"read.count,omitempty"`
+	ReadBlock time.Duration `yaml:"read.block,omitempty"`
+	// Access streams clients may read by their certificate, without entries every client reads every stream
+	Access []ConfigAccess `yaml:"access,omitempty"`
+}
+
+// ConfigAccess streams a client certificate with the subject or SAN Identity may read
+type ConfigAccess struct {
+	Identity string   `yaml:"identity"`
+	Streams  []string `yaml:"streams"`
+}
+
+// ConfigDelivery how entries are delivered to the websocket
+type ConfigDelivery struct {
+	MessageType string `yaml:"message.type,omitempty"`
+	Compression bool   `yaml:"compression,omitempty"`
+	// Subprotocols offered to clients, all of them by default
+	Subprotocols []string `yaml:"subprotocols,omitempty"`
+	// CompressionLevel flate level 1-9, CompressionMinSize smallest message compressed
+	CompressionLevel           int    `yaml:"compression.level,omitempty"`
+	CompressionMinSize         int    `yaml:"compression.min.size,omitempty"`
+	CompressionContextTakeover bool   `yaml:"compression.context.takeover,omitempty"`
+	OnCloseKey                 string `yaml:"on.close.key,omitempty"`
+	OnCloseValue               string `yaml:"on.close.value,omitempty"`
+	// Ack entries are settled only once the client acks them, needs source.group
+	Ack        bool          `yaml:"ack,omitempty"`
+	AckTimeout time.Duration `yaml:"ack.timeout,omitempty"`
+	// BatchMaxBytes size limit of a frame, BatchLinger time entries are held to be sent in fewer frames
+	BatchMaxBytes int           `yaml:"batch.max.bytes,omitempty"`
+	BatchLinger   time.Duration `yaml:"batch.linger,omitempty"`
+	// Sentinel entries with field set to value (any value when empty), or
+	// entries SentinelWhen renders "true" for, close the stream or the websocket
+	SentinelField   string `yaml:"sentinel.field,omitempty"`
+	SentinelValue   string `yaml:"sentinel.value,omitempty"`
+	SentinelWhen    string `yaml:"sentinel.when,omitempty"`
+	SentinelScope   string `yaml:"sentinel.scope,omitempty"`
+	SentinelDeliver bool   `yaml:"sentinel.deliver,omitempty"`
+	SentinelCode    int    `yaml:"sentinel.code,omitempty"`
+	SentinelReason  string `yaml:"sentinel.reason,omitempty"`
+	// PresenceKey registers sessions in redis while they are open
+	PresenceKey string        `yaml:"presence.key,omitempty"`
+	PresenceTTL time.Duration `yaml:"presence.ttl,omitempty"`
+	// OnOpen and OnClose hooks run when a websocket opens and closes
+	OnOpen  []ConfigHook `yaml:"on.open,omitempty"`
+	OnClose []ConfigHook `yaml:"on.close,omitempty"`
+}
+
+// ConfigHook redis command of a lifecycle hook, keys and values are templates
+type ConfigHook struct {
+	// Command set, xadd, publish or eval
+	Command string `yaml:"command"`
+	// Key key of set, stream of xadd or channel of publish
+	Key    string            `yaml:"key,omitempty"`
+	Value  string            `yaml:"value,omitempty"`
+	TTL    time.Duration     `yaml:"ttl,omitempty"`
+	Fields map[string]string `yaml:"fields,omitempty"`
+	MaxLen int64             `yaml:"maxlen,omitempty"`
+	Script string            `yaml:"script,omitempty"`
+	Keys   []string          `yaml:"keys,omitempty"`
+	Args   []string          `yaml:"args,omitempty"`
 }
 
-// Config YAML config file
+// ConfigCertificate certificate and key files
+type ConfigCertificate struct {
+	CertFile string `yaml:"cert.file"`
+	KeyFile  string `yaml:"key.file"`
+}
+
+// ConfigListener TLS settings of an address, replacing the global tls.* ones,
+// without certificates the address serves plain HTTP
+type ConfigListener struct {
+	Address     string `yaml:"address"`
+	TLSCertFile string `yaml:"tls.cert.file,omitempty"`
+	TLSKeyFile  string `yaml:"tls.key.file,omitempty"`
+	// TLSCertificates more certificates, picked by the server name the client asks for
+	TLSCertificates []ConfigCertificate `yaml:"tls.certificates,omitempty"`
+	TLSMinVersion   string              `yaml:"tls.min.version,omitempty"`
+	TLSCiphers      []string            `yaml:"tls.ciphers,omitempty"`
+	// TLSClientCAFile CA certificates verifying client certificates
+	TLSClientCAFile string `yaml:"tls.client.ca.file,omitempty"`
+	TLSClientAuth   string `yaml:"tls.client.auth,omitempty"`
+	// SocketMode and SocketGroup permissions of a unix:/path address
+	SocketMode  string `yaml:"socket.mode,omitempty"`
+	SocketGroup string `yaml:"socket.group,omitempty"`
+}
+
+// ConfigEndpoint websocket endpoint and test UI served from redis stream(s)
+type ConfigEndpoint struct {
+	Address       string           `yaml:"address"`
+	PathPrefix    string           `yaml:"path.prefix,omitempty"`
+	PathWebSocket string           `yaml:"path.websocket,omitempty"`
+	PathTest      string           `yaml:"path.test,omitempty"`
+	Connection    ConfigConnection `yaml:"connection"`
+	Source        ConfigSource     `yaml:"source,omitempty"`
+	Delivery      ConfigDelivery   `yaml:"delivery,omitempty"`
+}
+
+// Config YAML config file, schema version 2.0 (1.0 files are migrated on read)
 type Config struct {
-	SchemaVersion string      `yaml:"schema.version"`
-	TLSCertFile   string      `yaml:"tls.cert.file"`
-	TLSKeyFile    string      `yaml:"tls.key.file"`
-	ConfigRWSs    []ConfigRWS `yaml:"redis.to.websocket"`
+	SchemaVersion   string           `yaml:"schema.version"`
+	TLSCertFile     string           `yaml:"tls.cert.file,omitempty"`
+	TLSKeyFile      string           `yaml:"tls.key.file,omitempty"`
+	TLSMinVersion   string           `yaml:"tls.min.version,omitempty"`
+	TLSCiphers      []string         `yaml:"tls.ciphers,omitempty"`
+	TLSClientCAFile string           `yaml:"tls.client.ca.file,omitempty"`
+	TLSClientAuth   string           `yaml:"tls.client.auth,omitempty"`
+	Listeners       []ConfigListener `yaml:"listeners,omitempty"`
+	TrustedProxies  []string         `yaml:"trusted.proxies,omitempty"`
+	PublicBaseURL   string           `yaml:"public.base.url,omitempty"`
+	ShutdownTimeout time.Duration    `yaml:"shutdown.timeout,omitempty"`
+	WatchInterval   time.Duration    `yaml:"config.watch.interval,omitempty"`
+	LogLevel        string           `yaml:"log.level,omitempty"`
+	LogFormat       string           `yaml:"log.format,omitempty"`
+	AdminAddress    string           `yaml:"admin.address,omitempty"`
+	// AdminPublic serves configured operational endpoints on every endpoint address without admin.address
+	AdminPublic    bool             `yaml:"admin.public,omitempty"`
+	MetricsPath    string           `yaml:"metrics.path,omitempty"`
+	LagInterval    time.Duration    `yaml:"metrics.lag.interval,omitempty"`
+	StreamLimit    int              `yaml:"metrics.stream.limit,omitempty"`
+	HealthPath     string           `yaml:"health.path,omitempty"`
+	ReadyPath      string           `yaml:"ready.path,omitempty"`
+	ReadyTimeout   time.Duration    `yaml:"ready.timeout,omitempty"`
+	SessionsPath   string           `yaml:"sessions.path,omitempty"`
+	AdminToken     string           `yaml:"admin.token,omitempty"`
+	ResumeSecret   string           `yaml:"resume.secret,omitempty"`
+	ResumeInterval time.Duration    `yaml:"resume.interval,omitempty"`
+	ResumeTTL      time.Duration    `yaml:"resume.ttl,omitempty"`
+	Endpoints      []ConfigEndpoint `yaml:"endpoints"`
 }
 
-// ReadRWS read config file and returns collection of RWS
-func ReadRWS(filename string) []*RWS {
-	fileContent, err := ioutil.ReadFile(filename)
+// defaultShutdownTimeout time given to open websockets to drain on shutdown
+const defaultShutdownTimeout = 10 * time.Second
+
+// ReadConfig reads and validates config file, warnings are logged and all
+// errors are returned at once as *ConfigError, a valid config sets up logging
+func ReadConfig(filename string) (*Config, error) {
+	src, err := parseConfig(filename)
 	if err != nil {
-		absPath, _ := filepath.Abs(filename)
-		log.Fatalf("Error while reading %v file: \n%v ", absPath, err)
+		return nil, err
 	}
-	log.Printf("%s\n%s", filename, string(fileContent))
-	var config Config
-	err = yaml.Unmarshal(fileContent, &config)
-	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+	issues := src.errors()
+	if len(issues) == 0 {
+		setupLogging(src.config.LogLevel, src.config.LogFormat)
 	}
-
-	certFile := ""
-	keyFile := ""
-	if config.TLSCertFile != "" && config.TLSKeyFile == "" || config.TLSCertFile == "" && config.TLSKeyFile != "" {
-		panic(fmt.Sprintf("Both certificate and key file must be defined %v", "."))
-	} else if config.TLSCertFile != "" {
-		if _, err := os.Stat(config.TLSCertFile); err == nil {
-			if _, err := os.Stat(config.TLSKeyFile); err == nil {
-				keyFile = config.TLSKeyFile
-				certFile = config.TLSCertFile
-			} else {
-				panic(fmt.Sprintf("key file %s does not exist", config.TLSKeyFile))
-			}
-		} else {
-			panic(fmt.Sprintf("certificate file %s does not exist", config.TLSKeyFile))
+	slog.Debug("Config", "file", filename, "content", src.redacted())
+	for _, issue := range src.issues {
+		if issue.Warning {
+			slog.Warn("Config", "issue", issue.Format(filename))
 		}
 	}
+	if len(issues) > 0 {
+		return nil, &ConfigError{Filename: filename, Issues: issues}
+	}
+	return &src.config, nil
+}
+
+// paths returns test UI and websocket paths of the endpoint
+func (endpoint *ConfigEndpoint) paths() (string, string) {
+	testPath := endpoint.PathTest
+	wsPath := endpoint.PathWebSocket
+	if testPath == "" && wsPath == "" {
+		testPath = "test"
+	}
+	if endpoint.PathPrefix != "" {
+		testPath = endpoint.PathPrefix + "/" + testPath
+		wsPath = endpoint.PathPrefix + "/" + wsPath
+	}
+	testPath = "/" + strings.TrimRight(testPath, "/")
+	wsPath = "/" + strings.TrimRight(wsPath, "/")
+	return testPath, wsPath
+}
+
+// RWSList returns collection of RWS for config validated by ReadConfig, filename is used in messages only
+func (config *Config) RWSList(filename string) []*RWS {
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	proxy, err := newProxySettings(config)
+	if err != nil {
+		slog.Error("Can't set up proxy settings", "error", err)
+	}
 	rwsMap := make(map[string]*RWS)
-	for _, rwsConfig := range config.ConfigRWSs {
+	for _, endpoint := range config.Endpoints {
 		var rws *RWS
 		var exists bool
-		if rws, exists = rwsMap[rwsConfig.Address]; !exists {
+		if rws, exists = rwsMap[endpoint.Address]; !exists {
 			rws = &RWS{
-				Address:     rwsConfig.Address,
-				TLSCertFile: certFile,
-				TLSKeyFile:  keyFile,
-				SourceFile:  filename,
-				WebSockets:  make(map[string]*RWSRedis),
-				TestUIs:     make(map[string]*string),
+				Address:         endpoint.Address,
+				SourceFile:      filename,
+				ShutdownTimeout: config.ShutdownTimeout,
+				Proxy:           proxy,
+				WebSockets:      make(map[string]*RWSRedis),
+				TestUIs:         make(map[string]*string),
+				chDone:          make(chan struct{}),
 			}
-			rwsMap[rwsConfig.Address] = rws
-		}
-		if rwsConfig.MessageType == "" {
-			rwsConfig.MessageType = "json"
-		}
-		testPath := rwsConfig.EndpointTest
-		wsPath := rwsConfig.EndpointWS
-		if testPath == "" && wsPath == "" {
-			testPath = "test"
-		}
-		if rwsConfig.EndpointPrefix != "" {
-			testPath = rwsConfig.EndpointPrefix + "/" + testPath
-			wsPath = rwsConfig.EndpointPrefix + "/" + wsPath
-		}
-		testPath = "/" + strings.TrimRight(testPath, "/")
-		wsPath = "/" + strings.TrimRight(wsPath, "/")
-
-		if testPath == wsPath {
-			panic(fmt.Sprintf("test path and websocket path can't be same [%s]", rwsConfig.EndpointTest))
-		}
-		if rwsConfig.RedisClientConfig["metadata.broker.list"] == "" {
-			panic(fmt.Sprintf("metadata.broker.list must be defined, address [%s]", rwsConfig.Address))
-		}
-		// if rwsConfig.RedisClientConfig["group.id"] == "" {
-		// 	panic(fmt.Sprintf("group.id must be defined, address [%s]", rwsConfig.Address))
-		// }
-		if _, exists := rws.TestUIs[testPath]; exists {
-			panic(fmt.Sprintf("test path [%s] already defined", testPath))
-		}
-		if _, exists := rws.WebSockets[testPath]; exists {
-			panic(fmt.Sprintf("test path [%s] already defined as websocket path", testPath))
-		}
-		if _, exists := rws.WebSockets[wsPath]; exists {
-			panic(fmt.Sprintf("websocket path [%s] already defined", wsPath))
+			listener := config.listener(endpoint.Address)
+			if rws.TLS, rws.tlsErr = newListenerTLS(listener); rws.tlsErr != nil {
+				slog.Error("Can't set up tls", "address", endpoint.Address, "error", rws.tlsErr)
+			}
+			rws.SocketMode, _ = listener.socketMode()
+			rws.SocketGroup = listener.SocketGroup
+			rwsMap[endpoint.Address] = rws
 		}
-		if _, exists := rws.TestUIs[wsPath]; exists {
-			panic(fmt.Sprintf("websocket path [%s] already defined as test path", wsPath))
+		if endpoint.Source.Start == "" {
+			endpoint.Source.Start = "0"
 		}
-		if rwsConfig.MessageType != "json" &&
-			rwsConfig.MessageType != "text" &&
-			rwsConfig.MessageType != "binary" {
-			panic(fmt.Sprintf("invalid message.type [%s]", rwsConfig.MessageType))
+		if endpoint.Delivery.MessageType == "" {
+			endpoint.Delivery.MessageType = "json"
 		}
+		endpoint.Delivery.sentinelDefaults()
+		// validation reports an invalid predicate
+		sentinelWhen, _ := compileSentinel(endpoint.Delivery.SentinelWhen)
+		testPath, wsPath := endpoint.paths()
 		rws.TestUIs[testPath] = &wsPath
 		rws.WebSockets[wsPath] = &RWSRedis{
-			RedisClientConfig:        rwsConfig.RedisClientConfig,
-			RedisDefaultStreamConfig: rwsConfig.RedisDefaultStreamConfig,
-			RedisStreams:             rwsConfig.RedisStreams,
-			MessageType:              rwsConfig.MessageType,
-			Compression:              rwsConfig.Compression,
-			OnCloseKey:               rwsConfig.OnCloseKey,
-			OnCloseValue:             rwsConfig.OnCloseValue,
+			Connection:   endpoint.Connection,
+			Source:       endpoint.Source,
+			Delivery:     endpoint.Delivery,
+			resume:       config.resumeSettings(),
+			onOpen:       compileHooks(endpoint.Delivery.OnOpen),
+			onClose:      compileHooks(endpoint.Delivery.OnClose),
+			sentinelWhen: sentinelWhen,
+			chRemoved:    make(chan struct{}),
 		}
 	}
 	rwsSlice := make([]*RWS, len(rwsMap))
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/gobwas/ws"
+)
+
+// controlRequest JSON text message of the client's control protocol:
+// subscribe, unsubscribe, pause, resume, seek or ack
+type controlRequest struct {
+	Op      string   `json:"op"`
+	ID      string   `json:"id,omitempty"`
+	Streams []string `json:"streams,omitempty"`
+	From    string   `json:"from,omitempty"`
+	IDs     []string `json:"ids,omitempty"`
+}
+
+// controlMessage JSON text message sent to the client besides entries,
+// which are always sent as binary messages
+type controlMessage struct {
+	Event   string   `json:"event"`
+	Op      string   `json:"op,omitempty"`
+	ID      string   `json:"id,omitempty"`
+	Streams []string `json:"streams,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Token   string   `json:"token,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+}
+
+// writeControl sends message to the client as a text message
+func writeControl(writer *messageWriter, message controlMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return writer.write(ws.OpText, payload)
+}
+
+// parseControl decodes a text message of the client
+func parseControl(payload []byte) (controlRequest, error) {
+	var request controlRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return request, fmt.Errorf("invalid control message: %v", err)
+	}
+	if request.Op == "" {
+		return request, errors.New("invalid control message: op is missing")
+	}
+	return request, nil
+}
+
+// handle applies request of the client and returns the ack or error to send back
+func (reader *streamReader) handle(ctx context.Context, request controlRequest) controlMessage {
+	reply := controlMessage{Event: "ack", Op: request.Op, ID: request.ID}
+	var err error
+	switch request.Op {
+	case "subscribe":
+		reply.Streams, err = reader.subscribe(ctx, request.Streams, request.From)
+	case "unsubscribe":
+		reply.Streams, err = reader.unsubscribe(request.Streams)
+	case "seek":
+		reply.Streams, err = reader.seek(ctx, request.Streams, request.From)
+	case "pause":
+		reader.paused = true
+	case "resume":
+		reader.paused = false
+	default:
+		err = fmt.Errorf("unknown op [%s], expected subscribe, unsubscribe, pause, resume, seek or ack", request.Op)
+	}
+	if err != nil {
+		reader.logger.Debug("Control request failed", "op", request.Op, "error", err)
+		return controlMessage{Event: "error", Op: request.Op, ID: request.ID, Error: err.Error()}
+	}
+	reader.logger.Debug("Control request", "op", request.Op, "streams", reply.Streams)
+	return reply
+}
+
+// subscribe starts reading streams matching patterns from start, streams
+// already read keep their position, returns the added streams
+func (reader *streamReader) subscribe(ctx context.Context, patterns []string, start string) ([]string, error) {
+	if len(patterns) == 0 {
+		return nil, errors.New("streams are missing")
+	}
+	if start == "" {
+		start = reader.source.Start
+	} else if start != "$" && !rexStreamID.MatchString(start) {
+		return nil, fmt.Errorf("invalid from [%s], expected \"0\", \"$\" or an entry ID", start)
+	}
+	if err := reader.access.check(patterns); err != nil {
+		return nil, err
+	}
+	for _, pattern := range patterns {
+		delete(reader.excluded, pattern)
+		if !slices.Contains(reader.patterns, pattern) {
+			reader.patterns = append(reader.patterns, pattern)
+		}
+	}
+	reader.sess.setStreams(reader.patterns)
+	return reader.discover(ctx, patterns, start)
+}
+
+// unsubscribe stops reading streams and streams found by patterns, a stream
+// unsubscribed by name is not rediscovered, returns the removed streams
+func (reader *streamReader) unsubscribe(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, errors.New("streams are missing")
+	}
+	for _, name := range names {
+		if !slices.Contains(reader.patterns, name) && !reader.cursor.has(name) {
+			return nil, fmt.Errorf("stream [%s] is not subscribed", name)
+		}
+	}
+	removed := make([]string, 0)
+	for _, name := range names {
+		if i := slices.Index(reader.patterns, name); i >= 0 {
+			reader.patterns = append(reader.patterns[:i], reader.patterns[i+1:]...)
+			removed = append(removed, reader.cursor.foundBy(name)...)
+		}
+		if reader.cursor.has(name) {
+			reader.excluded[name] = true
+			if !slices.Contains(removed, name) {
+				removed = append(removed, name)
+			}
+		}
+	}
+	for _, stream := range removed {
+		reader.cursor.remove(stream)
+		reader.sess.forget(stream)
+	}
+	reader.sess.setStreams(reader.patterns)
+	return removed, nil
+}
+
+// seek moves read streams to start, entries already delivered are deleted from
+// redis, so only the remaining ones are read again
+func (reader *streamReader) seek(ctx context.Context, streams []string, start string) ([]string, error) {
+	if reader.source.Group != "" {
+		return nil, errors.New("seek is not supported with source.group")
+	}
+	if len(streams) == 0 {
+		streams = reader.cursor.names
+	}
+	if start == "" {
+		return nil, errors.New("from is missing")
+	}
+	if start != "$" && !rexStreamID.MatchString(start) {
+		return nil, fmt.Errorf("invalid from [%s], expected \"0\", \"$\" or an entry ID", start)
+	}
+	for _, stream := range streams {
+		if !reader.cursor.has(stream) {
+			return nil, fmt.Errorf("stream [%s] is not subscribed", stream)
+		}
+	}
+	moved := make([]string, 0, len(streams))
+	for _, stream := range streams {
+		id, err := startID(ctx, reader.client, stream, start)
+		if err != nil {
+			return nil, err
+		}
+		reader.cursor.set(stream, id)
+		reader.sess.setPosition(stream, id)
+		moved = append(moved, stream)
+	}
+	return moved, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testReader returns reader of s1 and of orders.a and orders.b found by
+// orders.*, redis knows s2 as a stream besides them
+func testReader(t *testing.T, source ConfigSource) *streamReader {
+	t.Helper()
+	client, _ := newFakeRedis(scanReply(nil, nil, map[string]string{"s1": "stream", "s2": "stream"}))
+	t.Cleanup(func() { client.Close() })
+	sess := testSession(t, "control-"+strings.ReplaceAll(t.Name(), "/", "-"), "rws.local:8800/ws")
+	sess.setStreams([]string{"s1", "orders.*"})
+	reader := newStreamReader(sess, &RWSRedis{Source: source}, sess.id, client, redis.Options{}, discardLogger)
+	reader.cursor.add("s1", "1-0", "s1")
+	reader.cursor.add("orders.a", "2-0", "orders.*")
+	reader.cursor.add("orders.b", "3-0", "orders.*")
+	return reader
+}
+
+func TestParseControl(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		request controlRequest
+		err     string
+	}{
+		{name: "subscribe", payload: `{"op":"subscribe","id":"7","streams":["s1"],"from":"$"}`, request: controlRequest{Op: "subscribe", ID: "7", Streams: []string{"s1"}, From: "$"}},
+		{name: "pause", payload: `{"op":"pause"}`, request: controlRequest{Op: "pause"}},
+		{name: "ack", payload: `{"op":"ack","ids":["1-0"]}`, request: controlRequest{Op: "ack", IDs: []string{"1-0"}}},
+		{name: "not json", payload: `subscribe s1`, err: "invalid control message: invalid character"},
+		{name: "truncated", payload: `{"op":"subscribe"`, err: "invalid control message: unexpected end of JSON input"},
+		{name: "streams not a list", payload: `{"op":"subscribe","streams":"s1"}`, err: "invalid control message: json: cannot unmarshal string"},
+		{name: "op missing", payload: `{"streams":["s1"]}`, err: "invalid control message: op is missing"},
+		{name: "empty object", payload: `{}`, err: "invalid control message: op is missing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := parseControl([]byte(test.payload))
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Errorf("error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(request) != fmt.Sprint(test.request) {
+				t.Errorf("request %+v, expected %+v", request, test.request)
+			}
+		})
+	}
+}
+
+func TestControlHandle(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  ConfigSource
+		request controlRequest
+		reply   controlMessage
+		// streams read and patterns subscribed afterwards
+		streams  []string
+		patterns []string
+	}{
+		{
+			name:     "subscribe",
+			request:  controlRequest{Op: "subscribe", ID: "1", Streams: []string{"s2"}, From: "0"},
+			reply:    controlMessage{Event: "ack", Op: "subscribe", ID: "1", Streams: []string{"s2"}},
+			streams:  []string{"s1", "orders.a", "orders.b", "s2"},
+			patterns: []string{"s1", "orders.*", "s2"},
+		},
+		{
+			name:     "subscribe from source.start",
+			source:   ConfigSource{Start: "0"},
+			request:  controlRequest{Op: "subscribe", Streams: []string{"s2"}},
+			reply:    controlMessage{Event: "ack", Op: "subscribe", Streams: []string{"s2"}},
+			streams:  []string{"s1", "orders.a", "orders.b", "s2"},
+			patterns: []string{"s1", "orders.*", "s2"},
+		},
+		{
+			name:    "subscribe read stream",
+			request: controlRequest{Op: "subscribe", Streams: []string{"s1"}, From: "0"},
+			reply:   controlMessage{Event: "ack", Op: "subscribe", Streams: []string{}},
+		},
+		{
+			name:    "subscribe without streams",
+			request: controlRequest{Op: "subscribe", ID: "2"},
+			reply:   controlMessage{Event: "error", Op: "subscribe", ID: "2", Error: "streams are missing"},
+		},
+		{
+			name:    "subscribe invalid from",
+			request: controlRequest{Op: "subscribe", Streams: []string{"s2"}, From: "latest"},
+			reply:   controlMessage{Event: "error", Op: "subscribe", Error: `invalid from [latest], expected "0", "$" or an entry ID`},
+		},
+		{
+			name:     "unsubscribe pattern",
+			request:  controlRequest{Op: "unsubscribe", Streams: []string{"orders.*"}},
+			reply:    controlMessage{Event: "ack", Op: "unsubscribe", Streams: []string{"orders.a", "orders.b"}},
+			streams:  []string{"s1"},
+			patterns: []string{"s1"},
+		},
+		{
+			name:    "unsubscribe stream found by pattern",
+			request: controlRequest{Op: "unsubscribe", Streams: []string{"orders.b"}},
+			reply:   controlMessage{Event: "ack", Op: "unsubscribe", Streams: []string{"orders.b"}},
+			streams: []string{"s1", "orders.a"},
+		},
+		{
+			name:    "unsubscribe unknown stream",
+			request: controlRequest{Op: "unsubscribe", Streams: []string{"s1", "s9"}},
+			reply:   controlMessage{Event: "error", Op: "unsubscribe", Error: "stream [s9] is not subscribed"},
+		},
+		{
+			name:    "unsubscribe without streams",
+			request: controlRequest{Op: "unsubscribe"},
+			reply:   controlMessage{Event: "error", Op: "unsubscribe", Error: "streams are missing"},
+		},
+		{
+			name:    "seek every stream",
+			request: controlRequest{Op: "seek", From: "0"},
+			reply:   controlMessage{Event: "ack", Op: "seek", Streams: []string{"s1", "orders.a", "orders.b"}},
+		},
+		{
+			name:    "seek stream",
+			request: controlRequest{Op: "seek", Streams: []string{"orders.a"}, From: "1-5"},
+			reply:   controlMessage{Event: "ack", Op: "seek", Streams: []string{"orders.a"}},
+		},
+		{
+			name:    "seek without from",
+			request: controlRequest{Op: "seek", Streams: []string{"s1"}},
+			reply:   controlMessage{Event: "error", Op: "seek", Error: "from is missing"},
+		},
+		{
+			name:    "seek invalid from",
+			request: controlRequest{Op: "seek", From: "-"},
+			reply:   controlMessage{Event: "error", Op: "seek", Error: `invalid from [-], expected "0", "$" or an entry ID`},
+		},
+		{
+			name:    "seek unknown stream",
+			request: controlRequest{Op: "seek", Streams: []string{"s9"}, From: "0"},
+			reply:   controlMessage{Event: "error", Op: "seek", Error: "stream [s9] is not subscribed"},
+		},
+		{
+			name:    "seek with group",
+			source:  ConfigSource{Group: "g1"},
+			request: controlRequest{Op: "seek", From: "0"},
+			reply:   controlMessage{Event: "error", Op: "seek", Error: "seek is not supported with source.group"},
+		},
+		{
+			name:    "unknown op",
+			request: controlRequest{Op: "rewind", ID: "9"},
+			reply:   controlMessage{Event: "error", Op: "rewind", ID: "9", Error: "unknown op [rewind], expected subscribe, unsubscribe, pause, resume, seek or ack"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := testReader(t, test.source)
+			reply := reader.handle(context.Background(), test.request)
+			if fmt.Sprintf("%+v", reply) != fmt.Sprintf("%+v", test.reply) {
+				t.Errorf("reply %+v, expected %+v", reply, test.reply)
+			}
+			streams, patterns := test.streams, test.patterns
+			if streams == nil {
+				streams = []string{"s1", "orders.a", "orders.b"}
+			}
+			if patterns == nil {
+				patterns = []string{"s1", "orders.*"}
+			}
+			if !slices.Equal(reader.cursor.names, streams) {
+				t.Errorf("streams %v, expected %v", reader.cursor.names, streams)
+			}
+			if !slices.Equal(reader.patterns, patterns) || !slices.Equal(reader.sess.info().Streams, patterns) {
+				t.Errorf("patterns %v, session streams %v, expected %v", reader.patterns, reader.sess.info().Streams, patterns)
+			}
+		})
+	}
+}
+
+func TestControlSeekMoves(t *testing.T) {
+	reader := testReader(t, ConfigSource{})
+	reader.handle(context.Background(), controlRequest{Op: "seek", Streams: []string{"orders.a"}, From: "0"})
+	if id := reader.cursor.ids["orders.a"]; id != "0" {
+		t.Errorf("orders.a at %s, expected 0", id)
+	}
+	if id := reader.sess.info().Positions["orders.a"]; id != "0" {
+		t.Errorf("position of orders.a %s, expected 0", id)
+	}
+	if id := reader.cursor.ids["s1"]; id != "1-0" {
+		t.Errorf("s1 moved to %s", id)
+	}
+}
+
+func TestControlPauseResume(t *testing.T) {
+	reader := testReader(t, ConfigSource{})
+	for _, step := range []struct {
+		op     string
+		paused bool
+	}{{"pause", true}, {"pause", true}, {"resume", false}, {"resume", false}} {
+		if reply := reader.handle(context.Background(), controlRequest{Op: step.op}); reply.Event != "ack" || reader.paused != step.paused {
+			t.Errorf("%s: reply %+v, paused %v", step.op, reply, reader.paused)
+		}
+	}
+}
+
+func TestControlUnsubscribedNotRediscovered(t *testing.T) {
+	reader := testReader(t, ConfigSource{})
+	reader.handle(context.Background(), controlRequest{Op: "unsubscribe", Streams: []string{"s1"}})
+	if !reader.excluded["s1"] {
+		t.Fatal("stream unsubscribed by name is not excluded")
+	}
+	// subscribing by name again lifts the exclusion
+	reply := reader.handle(context.Background(), controlRequest{Op: "subscribe", Streams: []string{"s1"}, From: "0"})
+	if !slices.Equal(reply.Streams, []string{"s1"}) || reader.excluded["s1"] {
+		t.Errorf("reply %+v, excluded %v", reply, reader.excluded)
+	}
+}
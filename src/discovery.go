@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scanCount COUNT hint of SCAN requests made by stream discovery
+const scanCount = 1000
+
+// streamCursor streams read by a websocket, ID of the last entry read from
+// each and the pattern each was found by
+type streamCursor struct {
+	names   []string
+	ids     map[string]string
+	origins map[string]string
+}
+
+func newStreamCursor() *streamCursor {
+	return &streamCursor{ids: make(map[string]string), origins: make(map[string]string)}
+}
+
+// has reports whether stream is read
+func (cursor *streamCursor) has(stream string) bool {
+	_, exists := cursor.ids[stream]
+	return exists
+}
+
+// add starts reading stream found by pattern after id
+func (cursor *streamCursor) add(stream string, id string, pattern string) {
+	if !cursor.has(stream) {
+		cursor.names = append(cursor.names, stream)
+		cursor.origins[stream] = pattern
+	}
+	cursor.ids[stream] = id
+}
+
+// set moves stream to id
+func (cursor *streamCursor) set(stream string, id string) {
+	if cursor.has(stream) {
+		cursor.ids[stream] = id
+	}
+}
+
+// remove stops reading stream
+func (cursor *streamCursor) remove(stream string) {
+	if !cursor.has(stream) {
+		return
+	}
+	delete(cursor.ids, stream)
+	delete(cursor.origins, stream)
+	for i, name := range cursor.names {
+		if name == stream {
+			cursor.names = append(cursor.names[:i], cursor.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// foundBy returns streams found by pattern
+func (cursor *streamCursor) foundBy(pattern string) []string {
+	streams := make([]string, 0)
+	for _, stream := range cursor.names {
+		if cursor.origins[stream] == pattern {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+// args returns STREAMS arguments of XREAD
+func (cursor *streamCursor) args() []string {
+	args := make([]string, 0, len(cursor.names)*2)
+	args = append(args, cursor.names...)
+	for _, stream := range cursor.names {
+		args = append(args, cursor.ids[stream])
+	}
+	return args
+}
+
+// discoverStreams returns streams matching patterns: names without glob
+// characters are checked directly, patterns are matched by a full SCAN
+// iteration restricted to keys of type stream
+func discoverStreams(ctx context.Context, client *redis.Client, patterns []string) ([]string, error) {
+	found := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, `*?[\`) {
+			kind, err := client.Type(ctx, pattern).Result()
+			if err != nil {
+				return nil, err
+			}
+			if kind == "stream" && !seen[pattern] {
+				seen[pattern] = true
+				found = append(found, pattern)
+			}
+			continue
+		}
+		matches := make([]string, 0)
+		iter := client.ScanType(ctx, 0, pattern, scanCount, "stream").Iterator()
+		for iter.Next(ctx) {
+			// SCAN may return a key more than once
+			if stream := iter.Val(); !seen[stream] {
+				seen[stream] = true
+				matches = append(matches, stream)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		found = append(found, matches...)
+	}
+	return found, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis answers commands of a client with reply instead of a server and
+// records them in the order they were sent
+type fakeRedis struct {
+	reply func(cmd redis.Cmder) error
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// newFakeRedis returns client whose commands are answered by reply
+func newFakeRedis(reply func(cmd redis.Cmder) error) (*redis.Client, *fakeRedis) {
+	fake := &fakeRedis{reply: reply}
+	client := redis.NewClient(&redis.Options{Addr: "fake.invalid:6379"})
+	client.AddHook(fake)
+	return client, fake
+}
+
+func (fake *fakeRedis) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (fake *fakeRedis) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		return fake.process(cmd)
+	}
+}
+
+func (fake *fakeRedis) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		var first error
+		for _, cmd := range cmds {
+			if err := fake.process(cmd); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+}
+
+// process records cmd and sets its reply
+func (fake *fakeRedis) process(cmd redis.Cmder) error {
+	fake.mu.Lock()
+	fake.commands = append(fake.commands, strings.TrimSuffix(strings.TrimPrefix(fmt.Sprint(cmd.Args()), "["), "]"))
+	fake.mu.Unlock()
+	err := fake.reply(cmd)
+	if err != nil {
+		cmd.SetErr(err)
+	}
+	return err
+}
+
+// sent returns commands sent so far
+func (fake *fakeRedis) sent() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return slices.Clone(fake.commands)
+}
+
+// scanReply answers SCAN with pages by cursor and TYPE with types of keys
+func scanReply(pages map[uint64][]string, next map[uint64]uint64, types map[string]string) func(cmd redis.Cmder) error {
+	return func(cmd redis.Cmder) error {
+		switch cmd := cmd.(type) {
+		case *redis.ScanCmd:
+			cursor := cmd.Args()[1].(uint64)
+			cmd.SetVal(pages[cursor], next[cursor])
+		case *redis.StatusCmd:
+			kind, exists := types[cmd.Args()[1].(string)]
+			if !exists {
+				kind = "none"
+			}
+			cmd.SetVal(kind)
+		default:
+			return fmt.Errorf("unexpected command %v", cmd.Args())
+		}
+		return nil
+	}
+}
+
+func TestDiscoverStreams(t *testing.T) {
+	// scans SCAN requests of a pattern for the pages below
+	scans := func(pattern string) []string {
+		return []string{
+			"scan 0 match " + pattern + " count 1000 type stream",
+			"scan 17 match " + pattern + " count 1000 type stream",
+			"scan 42 match " + pattern + " count 1000 type stream",
+		}
+	}
+	// SCAN returns orders.a twice and keeps going until the cursor is 0
+	pages := map[uint64][]string{
+		0:  {"orders.b", "orders.a"},
+		17: {},
+		42: {"orders.a", "orders.c"},
+	}
+	next := map[uint64]uint64{0: 17, 17: 42, 42: 0}
+	types := map[string]string{"orders": "stream", "orders.b": "stream", "cache": "string"}
+	tests := []struct {
+		name     string
+		patterns []string
+		found    []string
+		commands []string
+	}{
+		{
+			name:     "names are checked directly",
+			patterns: []string{"orders", "cache", "missing"},
+			found:    []string{"orders"},
+			commands: []string{"type orders", "type cache", "type missing"},
+		},
+		{
+			name:     "pattern iterates every page",
+			patterns: []string{"orders.*"},
+			found:    []string{"orders.a", "orders.b", "orders.c"},
+			commands: scans("orders.*"),
+		},
+		{
+			name:     "streams found twice are listed once",
+			patterns: []string{"orders.b", "orders.*", "orders.b"},
+			found:    []string{"orders.b", "orders.a", "orders.c"},
+			commands: append(append([]string{"type orders.b"}, scans("orders.*")...), "type orders.b"),
+		},
+		{
+			name:     "glob characters",
+			patterns: []string{"orders.?", "orders.[ab]", `orders\*`},
+			found:    []string{"orders.a", "orders.b", "orders.c"},
+			commands: append(append(scans("orders.?"), scans("orders.[ab]")...), scans(`orders\*`)...),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, fake := newFakeRedis(scanReply(pages, next, types))
+			defer client.Close()
+			found, err := discoverStreams(context.Background(), client, test.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(found, test.found) {
+				t.Errorf("found %v, expected %v", found, test.found)
+			}
+			if !slices.Equal(fake.sent(), test.commands) {
+				t.Errorf("commands %q, expected %q", fake.sent(), test.commands)
+			}
+		})
+	}
+}
+
+func TestDiscoverStreamsError(t *testing.T) {
+	client, _ := newFakeRedis(func(cmd redis.Cmder) error {
+		return fmt.Errorf("LOADING redis is loading the dataset")
+	})
+	defer client.Close()
+	for _, patterns := range [][]string{{"orders"}, {"orders.*"}} {
+		if found, err := discoverStreams(context.Background(), client, patterns); err == nil {
+			t.Errorf("%v found %v without error", patterns, found)
+		}
+	}
+}
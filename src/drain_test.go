@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testDrainRWS returns rws serving one websocket endpoint at /ws
+func testDrainRWS() *RWS {
+	return &RWS{
+		Address:    "rws.local:8800",
+		WebSockets: map[string]*RWSRedis{"/ws": {chRemoved: make(chan struct{})}},
+		TestUIs:    map[string]*string{},
+		chDone:     make(chan struct{}),
+	}
+}
+
+func TestDrainWaitsForSessions(t *testing.T) {
+	rws := testDrainRWS()
+	if !rws.acquireSession() {
+		t.Fatal("session refused before drain")
+	}
+	chDrained := make(chan error, 1)
+	go func() {
+		chDrained <- rws.Drain(context.Background(), shutdownClose)
+	}()
+
+	select {
+	case <-rws.chDone:
+	case <-time.After(time.Second):
+		t.Fatal("open websockets are not asked to close")
+	}
+	if closing := rws.drainClose(); closing != shutdownClose {
+		t.Errorf("close frame %v, expected %v", closing, shutdownClose)
+	}
+	// upgrades after drain started are turned away
+	w := httptest.NewRecorder()
+	rws.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://rws.local:8800/ws", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("upgrade during drain answered %d, expected %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if rws.acquireSession() {
+		t.Error("session admitted during drain")
+	}
+	select {
+	case err := <-chDrained:
+		t.Fatalf("drain returned %v before the session finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rws.sessions.Done()
+	select {
+	case err := <-chDrained:
+		if err != nil {
+			t.Errorf("drain error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drain did not return once the session finished")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	rws := testDrainRWS()
+	if !rws.acquireSession() {
+		t.Fatal("session refused before drain")
+	}
+	defer rws.sessions.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := rws.Drain(ctx, shutdownClose); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("drain error %v, expected %v", err, context.DeadlineExceeded)
+	}
+	// a second drain keeps the close frame of the first one
+	restart := sessionClose{code: 1012, reason: "server restart"}
+	expired, cancelExpired := context.WithCancel(context.Background())
+	cancelExpired()
+	rws.Drain(expired, restart)
+	if closing := rws.drainClose(); closing != shutdownClose {
+		t.Errorf("close frame %v, expected %v", closing, shutdownClose)
+	}
+}
+
+func TestCleanupContext(t *testing.T) {
+	rws := testDrainRWS()
+	ctx, stop := rws.cleanupContext(context.Background())
+	if ctx.Err() != nil {
+		t.Errorf("cleanup cancelled without a drain: %v", ctx.Err())
+	}
+	stop()
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelDrain()
+	go rws.Drain(drainCtx, shutdownClose)
+	<-rws.chDone
+	ctx, stop = rws.cleanupContext(context.Background())
+	defer stop()
+	// on.close hooks and the presence cleanup give up with the drain
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("cleanup outlives the drain deadline")
+	}
+}
@@ -1,17 +1,17 @@
-module main
+module rws
 
 go 1.21
 
 require (
+	github.com/gobwas/httphead v0.1.0
 	github.com/gobwas/ws v1.3.1
 	github.com/redis/go-redis/v9 v9.3.1
-	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 )
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultReadyTimeout time redis has to answer PING in readiness checks
+const defaultReadyTimeout = 2 * time.Second
+
+// endpointReadiness readiness of a websocket endpoint
+type endpointReadiness struct {
+	Path      string  `json:"path"`
+	Redis     string  `json:"redis"`
+	Ready     bool    `json:"ready"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+
+	connection ConfigConnection
+}
+
+// listenerReadiness readiness of a listener and its endpoints
+type listenerReadiness struct {
+	Address   string              `json:"address"`
+	Bound     bool                `json:"bound"`
+	Endpoints []endpointReadiness `json:"endpoints"`
+}
+
+// readiness response of the readiness endpoint
+type readiness struct {
+	Ready     bool                `json:"ready"`
+	Listeners []listenerReadiness `json:"listeners"`
+}
+
+// serveHealth answers while the process is up
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readinessHandler answers 200 when every listener is bound and every redis
+// answers PING within timeout, 503 otherwise, with details in both cases
+func readinessHandler(running *listeners, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		list := running.list()
+		sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+
+		// every redis is pinged once, concurrently
+		pings := make(map[ConfigConnection]*endpointReadiness)
+		result := readiness{Ready: len(list) > 0, Listeners: make([]listenerReadiness, 0, len(list))}
+		for _, rws := range list {
+			_, webSockets, _ := rws.routes()
+			listener := listenerReadiness{Address: rws.Address, Bound: rws.Bound()}
+			result.Ready = result.Ready && listener.Bound
+			for path, rwsConfig := range webSockets {
+				listener.Endpoints = append(listener.Endpoints, endpointReadiness{
+					Path:       path,
+					Redis:      rwsConfig.Connection.Address,
+					connection: rwsConfig.Connection,
+				})
+				if _, exists := pings[rwsConfig.Connection]; !exists {
+					pings[rwsConfig.Connection] = &endpointReadiness{}
+				}
+			}
+			sort.Slice(listener.Endpoints, func(i, j int) bool { return listener.Endpoints[i].Path < listener.Endpoints[j].Path })
+			result.Listeners = append(result.Listeners, listener)
+		}
+		var wg sync.WaitGroup
+		for connection, ping := range pings {
+			wg.Add(1)
+			go func(connection ConfigConnection, ping *endpointReadiness) {
+				defer wg.Done()
+				pingRedis(ctx, connection, ping)
+			}(connection, ping)
+		}
+		wg.Wait()
+
+		for i := range result.Listeners {
+			for j := range result.Listeners[i].Endpoints {
+				endpoint := &result.Listeners[i].Endpoints[j]
+				ping := pings[endpoint.connection]
+				endpoint.Ready, endpoint.LatencyMS, endpoint.Error = ping.Ready, ping.LatencyMS, ping.Error
+				result.Ready = result.Ready && endpoint.Ready
+			}
+		}
+
+		status := http.StatusOK
+		if !result.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, result)
+	})
+}
+
+// pingRedis sends PING to redis and stores outcome in ping
+func pingRedis(ctx context.Context, connection ConfigConnection, ping *endpointReadiness) {
+	options := redisOptionsFromRwsConfiguration(connection, nil)
+	client := redis.NewClient(&options)
+	defer client.Close()
+	start := time.Now()
+	err := client.Ping(ctx).Err()
+	ping.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		ping.Error = err.Error()
+		return
+	}
+	ping.Ready = true
+}
+
+// writeJSON writes value as JSON response with status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
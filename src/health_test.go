@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pingServer serves PONG to PING and an error to every other command,
+// so redis clients fall back to RESP2, it returns the address and the PING count
+func pingServer(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	pings := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(reader)
+					if err != nil {
+						return
+					}
+					reply := "-ERR unknown command\r\n"
+					if strings.EqualFold(args[0], "ping") {
+						pings.Add(1)
+						reply = "+PONG\r\n"
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), pings
+}
+
+// readCommand reads a command sent as RESP array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || count < 1 {
+		return nil, strconv.ErrSyntax
+	}
+	args := make([]string, count)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		value, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(value, "\r\n")
+	}
+	return args, nil
+}
+
+// unreachableAddress returns an address nothing listens on
+func unreachableAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func TestReadinessHandler(t *testing.T) {
+	up, pings := pingServer(t)
+	down := unreachableAddress(t)
+	tests := []struct {
+		name      string
+		endpoints map[string]string
+		status    int
+		ready     map[string]bool
+		pings     int32
+	}{
+		{
+			name:      "all redis up",
+			endpoints: map[string]string{"/orders": up},
+			status:    http.StatusOK,
+			ready:     map[string]bool{"/orders": true},
+			pings:     1,
+		},
+		{
+			name:      "failing redis is named",
+			endpoints: map[string]string{"/orders": up, "/audit": down},
+			status:    http.StatusServiceUnavailable,
+			ready:     map[string]bool{"/orders": true, "/audit": false},
+			pings:     1,
+		},
+		{
+			name:      "same redis pinged once",
+			endpoints: map[string]string{"/orders": up, "/audit": up, "/events": up},
+			status:    http.StatusOK,
+			ready:     map[string]bool{"/orders": true, "/audit": true, "/events": true},
+			pings:     1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rws := &RWS{Address: ":8800", WebSockets: make(map[string]*RWSRedis), bound: true}
+			for path, address := range test.endpoints {
+				rws.WebSockets[path] = &RWSRedis{Connection: ConfigConnection{Address: address}}
+			}
+			running := newListeners()
+			running.rwsMap[rws.Address] = rws
+			pings.Store(0)
+
+			response := httptest.NewRecorder()
+			readinessHandler(running, time.Second).ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if response.Code != test.status {
+				t.Errorf("status %d, expected %d", response.Code, test.status)
+			}
+			var result readiness
+			if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Ready != (test.status == http.StatusOK) {
+				t.Errorf("ready %v, expected %v", result.Ready, test.status == http.StatusOK)
+			}
+			if len(result.Listeners) != 1 || len(result.Listeners[0].Endpoints) != len(test.endpoints) {
+				t.Fatalf("listeners %+v, expected one with %d endpoints", result.Listeners, len(test.endpoints))
+			}
+			for _, endpoint := range result.Listeners[0].Endpoints {
+				if endpoint.Redis != test.endpoints[endpoint.Path] {
+					t.Errorf("endpoint %s redis %s, expected %s", endpoint.Path, endpoint.Redis, test.endpoints[endpoint.Path])
+				}
+				if endpoint.Ready != test.ready[endpoint.Path] {
+					t.Errorf("endpoint %s ready %v, expected %v", endpoint.Path, endpoint.Ready, test.ready[endpoint.Path])
+				}
+				if endpoint.Ready == (endpoint.Error != "") {
+					t.Errorf("endpoint %s ready %v with error %q", endpoint.Path, endpoint.Ready, endpoint.Error)
+				}
+			}
+			if count := pings.Load(); count != test.pings {
+				t.Errorf("pings %d, expected %d", count, test.pings)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"text/template"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// hookData values available to templates of lifecycle hooks
+type hookData struct {
+	Event    string // open or close
+	ID       string
+	Remote   string // IP address of the client
+	Endpoint string
+	Streams  []string
+	User     string
+	SANs     []string
+	// Code, Reason and Positions are set on close only
+	Code      int
+	Reason    string
+	Positions map[string]string
+}
+
+// newHookData returns hook data of a session
+func newHookData(event string, sess *session) hookData {
+	info := sess.info()
+	remote := info.Remote
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	return hookData{
+		Event:    event,
+		ID:       info.ID,
+		Remote:   remote,
+		Endpoint: info.Endpoint,
+		Streams:  info.Streams,
+		User:     info.User,
+		SANs:     info.SANs,
+	}
+}
+
+// hookFuncs functions available to templates of lifecycle hooks
+var hookFuncs = template.FuncMap{
+	"join": strings.Join,
+	"json": func(value any) (string, error) {
+		payload, err := json.Marshal(value)
+		return string(payload), err
+	},
+}
+
+// hook compiled lifecycle hook
+type hook struct {
+	config ConfigHook
+	key    *template.Template
+	value  *template.Template
+	fields map[string]*template.Template
+	keys   []*template.Template
+	args   []*template.Template
+	script *redis.Script
+}
+
+// compileHook parses templates of config and checks them against sample data
+func compileHook(config ConfigHook) (*hook, error) {
+	switch config.Command {
+	case "set", "publish":
+		if config.Key == "" {
+			return nil, fmt.Errorf("key of %s is missing", config.Command)
+		}
+	case "xadd":
+		if config.Key == "" {
+			return nil, errors.New("key of xadd is missing")
+		}
+		if len(config.Fields) == 0 {
+			return nil, errors.New("fields of xadd are missing")
+		}
+	case "eval":
+		if config.Script == "" {
+			return nil, errors.New("script of eval is missing")
+		}
+	default:
+		return nil, fmt.Errorf("invalid command [%s], expected set, xadd, publish or eval", config.Command)
+	}
+	if config.TTL < 0 {
+		return nil, errors.New("ttl can't be negative")
+	}
+
+	compiled := &hook{config: config, fields: make(map[string]*template.Template)}
+	parse := func(name string, text string) (*template.Template, error) {
+		tmpl, err := template.New(name).Funcs(hookFuncs).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		// unknown fields only show up on execution
+		if err := tmpl.Execute(&strings.Builder{}, hookData{}); err != nil {
+			return nil, err
+		}
+		return tmpl, nil
+	}
+	var err error
+	if compiled.key, err = parse("key", config.Key); err != nil {
+		return nil, err
+	}
+	if compiled.value, err = parse("value", config.Value); err != nil {
+		return nil, err
+	}
+	for field, value := range config.Fields {
+		if compiled.fields[field], err = parse(field, value); err != nil {
+			return nil, err
+		}
+	}
+	for i, key := range config.Keys {
+		tmpl, err := parse(fmt.Sprintf("keys[%d]", i), key)
+		if err != nil {
+			return nil, err
+		}
+		compiled.keys = append(compiled.keys, tmpl)
+	}
+	for i, arg := range config.Args {
+		tmpl, err := parse(fmt.Sprintf("args[%d]", i), arg)
+		if err != nil {
+			return nil, err
+		}
+		compiled.args = append(compiled.args, tmpl)
+	}
+	if config.Command == "eval" {
+		compiled.script = redis.NewScript(config.Script)
+	}
+	return compiled, nil
+}
+
+// compileHooks returns compiled hooks of configs, invalid ones are left out
+// as validation reports them
+func compileHooks(configs []ConfigHook) []*hook {
+	hooks := make([]*hook, 0, len(configs))
+	for _, config := range configs {
+		if compiled, err := compileHook(config); err == nil {
+			hooks = append(hooks, compiled)
+		}
+	}
+	return hooks
+}
+
+// run executes the hook's command with templates filled in from data
+func (hook *hook) run(ctx context.Context, client *redis.Client, data hookData) error {
+	render := func(tmpl *template.Template) string {
+		var text strings.Builder
+		tmpl.Execute(&text, data)
+		return text.String()
+	}
+	switch hook.config.Command {
+	case "set":
+		return client.Set(ctx, render(hook.key), render(hook.value), hook.config.TTL).Err()
+	case "publish":
+		return client.Publish(ctx, render(hook.key), render(hook.value)).Err()
+	case "xadd":
+		values := make(map[string]interface{}, len(hook.fields))
+		for field, tmpl := range hook.fields {
+			values[field] = render(tmpl)
+		}
+		return client.XAdd(ctx, &redis.XAddArgs{
+			Stream: render(hook.key),
+			MaxLen: hook.config.MaxLen,
+			Approx: hook.config.MaxLen > 0,
+			Values: values,
+		}).Err()
+	case "eval":
+		keys := make([]string, len(hook.keys))
+		for i, tmpl := range hook.keys {
+			keys[i] = render(tmpl)
+		}
+		args := make([]interface{}, len(hook.args))
+		for i, tmpl := range hook.args {
+			args[i] = render(tmpl)
+		}
+		err := hook.script.Run(ctx, client, keys, args...).Err()
+		if errors.Is(err, redis.Nil) {
+			// a script returning nothing is fine
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// runHooks runs hooks in order, a failing hook is logged and the next one runs
+func runHooks(ctx context.Context, client *redis.Client, hooks []*hook, data hookData, logger *slog.Logger) {
+	for i, hook := range hooks {
+		if err := hook.run(ctx, client, data); err != nil {
+			logger.Warn("Lifecycle hook failed", "event", data.Event, "hook", i, "command", hook.config.Command, "error", err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestCompileHookErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ConfigHook
+		err    string
+	}{
+		{name: "unknown command", config: ConfigHook{Command: "del", Key: "k"}, err: "invalid command [del], expected set, xadd, publish or eval"},
+		{name: "no command", config: ConfigHook{Key: "k"}, err: "invalid command [], expected set, xadd, publish or eval"},
+		{name: "set without key", config: ConfigHook{Command: "set", Value: "v"}, err: "key of set is missing"},
+		{name: "publish without key", config: ConfigHook{Command: "publish", Value: "v"}, err: "key of publish is missing"},
+		{name: "xadd without key", config: ConfigHook{Command: "xadd", Fields: map[string]string{"f": "v"}}, err: "key of xadd is missing"},
+		{name: "xadd without fields", config: ConfigHook{Command: "xadd", Key: "events"}, err: "fields of xadd are missing"},
+		{name: "eval without script", config: ConfigHook{Command: "eval", Keys: []string{"k"}}, err: "script of eval is missing"},
+		{name: "negative ttl", config: ConfigHook{Command: "set", Key: "k", TTL: -time.Second}, err: "ttl can't be negative"},
+		{name: "unclosed action", config: ConfigHook{Command: "set", Key: "online.{{.ID"}, err: "template: key:1: unclosed action"},
+		{name: "unknown field", config: ConfigHook{Command: "set", Key: "online.{{.Session}}"}, err: "template: key:1:9: executing \"key\" at <.Session>: can't evaluate field Session"},
+		{name: "unknown function", config: ConfigHook{Command: "publish", Key: "c", Value: "{{upper .ID}}"}, err: "template: value:1: function \"upper\" not defined"},
+		{name: "invalid field template", config: ConfigHook{Command: "xadd", Key: "events", Fields: map[string]string{"who": "{{.User"}}, err: "template: who:1: unclosed action"},
+		{name: "invalid keys template", config: ConfigHook{Command: "eval", Script: "return 1", Keys: []string{"{{.Code}", "k"}}, err: "template: keys[0]:1: bad character U+007D '}'"},
+		{name: "invalid args template", config: ConfigHook{Command: "eval", Script: "return 1", Args: []string{"a", "{{end}}"}}, err: "template: args[1]:1: unexpected {{end}}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hook, err := compileHook(test.config)
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("error %v, expected %q", err, test.err)
+			}
+			if hook != nil {
+				t.Errorf("invalid hook compiled")
+			}
+		})
+	}
+}
+
+func TestHookRun(t *testing.T) {
+	open := hookData{Event: "open", ID: "c1", Remote: "203.0.113.7", Endpoint: "rws.local:8800/ws", Streams: []string{"s1", "s2"}, User: "CN=alice"}
+	closed := open
+	closed.Event, closed.Code, closed.Reason, closed.Positions = "close", 1000, "bye", map[string]string{"s1": "5-0"}
+	tests := []struct {
+		name    string
+		config  ConfigHook
+		data    hookData
+		command string
+	}{
+		{
+			name:    "set",
+			config:  ConfigHook{Command: "set", Key: "online.{{.ID}}", Value: "{{.Remote}}"},
+			data:    open,
+			command: "set online.c1 203.0.113.7",
+		},
+		{
+			name:    "set with ttl",
+			config:  ConfigHook{Command: "set", Key: "online.{{.ID}}", Value: "{{join .Streams \",\"}}", TTL: time.Minute},
+			data:    open,
+			command: "set online.c1 s1,s2 ex 60",
+		},
+		{
+			name:    "publish",
+			config:  ConfigHook{Command: "publish", Key: "sessions", Value: "{{.Event}} {{.ID}} {{.User}}"},
+			data:    open,
+			command: "publish sessions open c1 CN=alice",
+		},
+		{
+			name:    "xadd",
+			config:  ConfigHook{Command: "xadd", Key: "closed.{{.Endpoint}}", Fields: map[string]string{"positions": "{{json .Positions}}"}, MaxLen: 100},
+			data:    closed,
+			command: `xadd closed.rws.local:8800/ws maxlen ~ 100 * positions {"s1":"5-0"}`,
+		},
+		{
+			name:    "eval",
+			config:  ConfigHook{Command: "eval", Script: "return 1", Keys: []string{"online.{{.ID}}"}, Args: []string{"{{.Code}}", "{{.Reason}}"}},
+			data:    closed,
+			command: "evalsha e0e1f9fabfc9d4800c877a703b823ac0578ff8db 1 online.c1 1000 bye",
+		},
+		{
+			name:    "missing values are empty",
+			config:  ConfigHook{Command: "set", Key: "closed.{{.ID}}", Value: "{{.Code}}:{{.Positions.s9}}"},
+			data:    open,
+			command: "set closed.c1 0:",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hook, err := compileHook(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, fake := newFakeRedis(func(cmd redis.Cmder) error {
+				switch cmd := cmd.(type) {
+				case *redis.StatusCmd:
+					cmd.SetVal("OK")
+				case *redis.IntCmd:
+					cmd.SetVal(1)
+				case *redis.StringCmd:
+					cmd.SetVal("1-0")
+				case *redis.Cmd:
+					cmd.SetVal(int64(1))
+				default:
+					return fmt.Errorf("unexpected command %v", cmd.Args())
+				}
+				return nil
+			})
+			defer client.Close()
+			if err := hook.run(context.Background(), client, test.data); err != nil {
+				t.Fatal(err)
+			}
+			if commands := fake.sent(); !slices.Equal(commands, []string{test.command}) {
+				t.Errorf("commands %q, expected %q", commands, test.command)
+			}
+		})
+	}
+}
+
+func TestCompileHooksDropsInvalid(t *testing.T) {
+	hooks := compileHooks([]ConfigHook{
+		{Command: "set", Key: "a"},
+		{Command: "set"},
+		{Command: "publish", Key: "b"},
+	})
+	if len(hooks) != 2 || hooks[0].config.Key != "a" || hooks[1].config.Key != "b" {
+		t.Errorf("compiled %d hooks", len(hooks))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// minSecretLength shorter resolved secrets are not redacted, they would mask unrelated text
+const minSecretLength = 4
+
+var rexPlaceholder = regexp.MustCompile(`\$\$|\$\{([^}]*)\}`)
+
+// interpolate expands ${ENV_VAR}, ${ENV_VAR:-default} and ${file:/path} in
+// scalar values of node, "$$" stands for a literal "$". Values read from files
+// or assigned to secret looking keys are remembered for redaction.
+func (src *configSource) interpolate(node *yaml.Node, secret bool) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			src.interpolate(child, secret)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			src.interpolate(node.Content[i+1], secret || rexSecretKey.MatchString(node.Content[i].Value))
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "$") {
+			return
+		}
+		value := rexPlaceholder.ReplaceAllStringFunc(node.Value, func(placeholder string) string {
+			if placeholder == "$$" {
+				return "$"
+			}
+			resolved, fromFile := src.resolve(node, placeholder[2:len(placeholder)-1])
+			if fromFile || secret {
+				src.secrets = append(src.secrets, resolved)
+			}
+			return resolved
+		})
+		if value != node.Value {
+			node.Value = value
+			if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) == 0 {
+				// let the decoder resolve type of the expanded plain value
+				node.Tag = ""
+			}
+		}
+	}
+}
+
+// warnPlaceholders warns about placeholders in scalar values of node, values
+// of schema 1.0 files are interpolated although they used to be taken literally
+func (src *configSource) warnPlaceholders(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			src.warnPlaceholders(child)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			src.warnPlaceholders(node.Content[i+1])
+		}
+	case yaml.ScalarNode:
+		if placeholders := rexPlaceholder.FindAllString(node.Value, -1); len(placeholders) > 0 {
+			src.warnf(node, "placeholders %v are interpolated in schema 1.0 files too, write $$ for a literal $", placeholders)
+		}
+	}
+}
+
+// resolve returns value of a single placeholder expression and whether it was read from a file
+func (src *configSource) resolve(node *yaml.Node, expression string) (string, bool) {
+	if path, isFile := strings.CutPrefix(expression, "file:"); isFile {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			src.errorf(node, "can't read secret file %s: %v", path, err)
+			return "", true
+		}
+		return strings.TrimRight(string(content), "\r\n"), true
+	}
+	name, defaultValue, hasDefault := strings.Cut(expression, ":-")
+	if name == "" {
+		src.errorf(node, "empty placeholder ${%s}", expression)
+		return "", false
+	}
+	if value, exists := os.LookupEnv(name); exists && (value != "" || !hasDefault) {
+		return value, false
+	}
+	if hasDefault {
+		return defaultValue, false
+	}
+	src.errorf(node, "environment variable %s is not set", name)
+	return "", false
+}
+
+// redact masks resolved secrets in text
+func (src *configSource) redact(text string) string {
+	for _, secret := range src.secrets {
+		if len(secret) >= minSecretLength {
+			text = strings.ReplaceAll(text, secret, "******")
+		}
+	}
+	return text
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestInterpolate(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cr3t-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RWS_TEST_HOST", "redis.internal")
+	t.Setenv("RWS_TEST_EMPTY", "")
+	t.Setenv("RWS_TEST_PASSWORD", "hunter22")
+
+	tests := []struct {
+		name     string
+		key      string
+		value    string
+		expected any
+		secret   bool
+		errors   []string
+	}{
+		{name: "variable", key: "address", value: "${RWS_TEST_HOST}:6379", expected: "redis.internal:6379"},
+		{name: "default when unset", key: "address", value: "${RWS_TEST_MISSING:-localhost}:6379", expected: "localhost:6379"},
+		{name: "default when empty", key: "address", value: "${RWS_TEST_EMPTY:-localhost}", expected: "localhost"},
+		{name: "empty without default", key: "address", value: "<${RWS_TEST_EMPTY}>", expected: "<>"},
+		{name: "variable wins over default", key: "address", value: "${RWS_TEST_HOST:-localhost}", expected: "redis.internal"},
+		{name: "empty default", key: "address", value: "${RWS_TEST_MISSING:-}", expected: nil},
+		{name: "file", key: "address", value: "${file:" + secretFile + "}", expected: "s3cr3t-from-file", secret: true},
+		{name: "secret key", key: "password", value: "${RWS_TEST_PASSWORD}", expected: "hunter22", secret: true},
+		{name: "literal dollar", key: "password", value: "pa$$word", expected: "pa$word"},
+		{name: "escaped placeholder", key: "address", value: "$${RWS_TEST_HOST}", expected: "${RWS_TEST_HOST}"},
+		{name: "lone dollar", key: "address", value: "a$b", expected: "a$b"},
+		{name: "plain value is typed", key: "db", value: "${RWS_TEST_MISSING:-3}", expected: 3},
+		{name: "quoted value stays string", key: "db", value: `"${RWS_TEST_MISSING:-3}"`, expected: "3"},
+		{name: "unset variable", key: "address", value: "${RWS_TEST_MISSING}", expected: nil, errors: []string{"environment variable RWS_TEST_MISSING is not set"}},
+		{name: "empty placeholder", key: "address", value: "${}", expected: nil, errors: []string{"empty placeholder ${}"}},
+		{name: "missing file", key: "address", value: "${file:/nonexistent/secret}", expected: nil, secret: true, errors: []string{"can't read secret file /nonexistent/secret"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := &configSource{}
+			if err := yaml.Unmarshal([]byte(test.key+": "+test.value+"\n"), &src.root); err != nil {
+				t.Fatal(err)
+			}
+			src.interpolate(&src.root, false)
+			values := make(map[string]any)
+			if err := src.root.Decode(&values); err != nil {
+				t.Fatal(err)
+			}
+			if values[test.key] != test.expected {
+				t.Errorf("value %#v, expected %#v", values[test.key], test.expected)
+			}
+			if secret := len(src.secrets) > 0; secret != test.secret {
+				t.Errorf("secret %v, expected %v", secret, test.secret)
+			}
+			if len(src.issues) != len(test.errors) {
+				t.Fatalf("issues %v, expected %v", src.issues, test.errors)
+			}
+			for i, issue := range src.issues {
+				if issue.Warning || issue.Line != 1 || !strings.HasPrefix(issue.Message, test.errors[i]) {
+					t.Errorf("issue %+v, expected error on line 1 %q", issue, test.errors[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	t.Setenv("RWS_TEST_PASSWORD", "hunter22")
+	t.Setenv("RWS_TEST_TOKEN", "abc")
+	t.Setenv("RWS_TEST_USER", "admin")
+	src := &configSource{}
+	content := `connection:
+  username: ${RWS_TEST_USER}
+  password: ${RWS_TEST_PASSWORD}
+admin.token: ${RWS_TEST_TOKEN}
+`
+	if err := yaml.Unmarshal([]byte(content), &src.root); err != nil {
+		t.Fatal(err)
+	}
+	src.interpolate(&src.root, false)
+
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{text: "password hunter22 of admin", expected: "password ****** of admin"},
+		{text: "hunter22hunter22", expected: "************"},
+		// shorter secrets would mask unrelated text
+		{text: "token abc", expected: "token abc"},
+		{text: "nothing to hide", expected: "nothing to hide"},
+	}
+	for _, test := range tests {
+		if redacted := src.redact(test.text); redacted != test.expected {
+			t.Errorf("redact(%q) = %q, expected %q", test.text, redacted, test.expected)
+		}
+	}
+}
+
+func TestInterpolateSchemaVersion(t *testing.T) {
+	t.Setenv("RWS_TEST_PASSWORD", "hunter22")
+	tests := []struct {
+		name     string
+		content  string
+		password string
+	}{
+		{
+			name: "2.0 is interpolated",
+			content: `schema.version: "2.0"
+endpoints:
+  - address: :8800
+    connection:
+      address: redis:6379
+      password: ${RWS_TEST_PASSWORD}$$
+`,
+			password: "hunter22$",
+		},
+		{
+			name: "1.0 is interpolated",
+			content: `schema.version: "1.0"
+redis.to.websocket:
+  - redis.client.config:
+      metadata.broker.list: redis:6379
+      password: ${RWS_TEST_PASSWORD}$$
+    address: :8800
+`,
+			password: "hunter22$",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src, err := parseConfig(writeTestConfig(t, test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if issues := src.errors(); len(issues) > 0 {
+				t.Fatalf("errors %v", issues)
+			}
+			if password := src.config.Endpoints[0].Connection.Password; password != test.password {
+				t.Errorf("password %q, expected %q", password, test.password)
+			}
+		})
+	}
+}
+
+func TestPlaceholderWarnings(t *testing.T) {
+	t.Setenv("RWS_TEST_PASSWORD", "hunter22")
+	legacy := `schema.version: "1.0"
+redis.to.websocket:
+  - redis.client.config:
+      metadata.broker.list: redis:6379
+      password: ${RWS_TEST_PASSWORD}$$
+    address: :8800
+`
+	warning := "FILE:5:17: warning: placeholders [${RWS_TEST_PASSWORD} $$] are interpolated in schema 1.0 files too, write $$ for a literal $"
+
+	filename := writeTestConfig(t, legacy)
+	output := captureStdout(t, func() { checkConfig(filename) })
+	if !strings.Contains(output, strings.ReplaceAll(warning, "FILE", filename)) {
+		t.Errorf("-check output\n%s\nexpected the warning\n%s", output, warning)
+	}
+	output = captureStdout(t, func() { migrateConfig(filename) })
+	if !strings.Contains(output, strings.ReplaceAll(warning, "FILE", filename)) {
+		t.Errorf("-migrate output\n%s\nexpected the warning\n%s", output, warning)
+	}
+	// the migrated 2.0 file keeps the value without a warning
+	src, err := parseConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(src.issues) > 0 {
+		t.Errorf("issues %v of the migrated file, expected none", src.issues)
+	}
+	if password := src.config.Endpoints[0].Connection.Password; password != "hunter22$" {
+		t.Errorf("password %q, expected %q", password, "hunter22$")
+	}
+}
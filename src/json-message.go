@@ -30,20 +30,9 @@ func JSONBytesMake(messages []redis.XMessage, messageType string) ([]byte, error
 	if messageType == "json" {
 		jsonMessages := messages
 		for i, message := range messages {
-			unescapedValues := make(map[string]interface{})
-			for key, value := range message.Values {
-				textValue := fmt.Sprintf("%v", value)
-				// Unpack json object (cause redis doesn't have complex field types)
-				if strings.HasPrefix(textValue, "{") || strings.HasPrefix(textValue, "[") {
-					var objectValue map[string]interface{}
-					err := json.Unmarshal([]byte(textValue), &objectValue)
-					if err != nil {
-						return nil, err
-					}
-					unescapedValues[key] = objectValue
-				} else {
-					unescapedValues[key] = value
-				}
+			unescapedValues, err := unescapeValues(message.Values)
+			if err != nil {
+				return nil, err
 			}
 			jsonMessages[i] = redis.XMessage{
 				ID:     message.ID,
@@ -60,3 +49,23 @@ func JSONBytesMake(messages []redis.XMessage, messageType string) ([]byte, error
 
 	return bytes, err
 }
+
+// unescapeValues returns values with JSON objects unpacked, as redis doesn't
+// have complex field types
+func unescapeValues(values map[string]interface{}) (map[string]interface{}, error) {
+	unescapedValues := make(map[string]interface{})
+	for key, value := range values {
+		textValue := fmt.Sprintf("%v", value)
+		if strings.HasPrefix(textValue, "{") || strings.HasPrefix(textValue, "[") {
+			var objectValue map[string]interface{}
+			err := json.Unmarshal([]byte(textValue), &objectValue)
+			if err != nil {
+				return nil, err
+			}
+			unescapedValues[key] = objectValue
+		} else {
+			unescapedValues[key] = value
+		}
+	}
+	return unescapedValues, nil
+}
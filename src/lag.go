@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultLagInterval how often consumer lag is read from redis
+const defaultLagInterval = 15 * time.Second
+
+// lagTarget redis and consumer group (empty without one) whose streams are read
+type lagTarget struct {
+	connection ConfigConnection
+	group      string
+}
+
+// lagInterval returns how often consumer lag is refreshed, 0 when metrics are not served
+func (config *Config) lagInterval() time.Duration {
+	if config.adminPath(config.MetricsPath, defaultMetricsPath) == "" {
+		return 0
+	}
+	if config.LagInterval > 0 {
+		return config.LagInterval
+	}
+	return defaultLagInterval
+}
+
+// lagTargets returns streams read by endpoints of list: the configured ones
+// without glob characters and the ones read by open websockets
+func lagTargets(list []*RWS) map[lagTarget][]string {
+	found := make(map[lagTarget]map[string]bool)
+	add := func(target lagTarget, stream string) {
+		if found[target] == nil {
+			found[target] = make(map[string]bool)
+		}
+		found[target][stream] = true
+	}
+	for _, rws := range list {
+		_, webSockets, _ := rws.routes()
+		for path, rwsConfig := range webSockets {
+			target := lagTarget{connection: rwsConfig.Connection, group: rwsConfig.Source.Group}
+			for _, stream := range rwsConfig.Source.Streams {
+				if !strings.ContainsAny(stream, `*?[\`) {
+					add(target, stream)
+				}
+			}
+			for _, sess := range findSessions("", rws.Address+path) {
+				for stream := range sess.info().Positions {
+					add(target, stream)
+				}
+			}
+		}
+	}
+	targets := make(map[lagTarget][]string, len(found))
+	for target, streams := range found {
+		for stream := range streams {
+			targets[target] = append(targets[target], stream)
+		}
+		sort.Strings(targets[target])
+	}
+	return targets
+}
+
+// streamLag returns entries of stream not delivered yet: lag of the group in
+// XINFO GROUPS (redis 7 or later), without a group the length of the stream,
+// as delivered entries are deleted
+func streamLag(ctx context.Context, client *redis.Client, stream string, group string) (int64, bool, error) {
+	if group == "" {
+		length, err := client.XLen(ctx, stream).Result()
+		return length, true, err
+	}
+	groups, err := client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		// the stream is not created yet
+		if strings.Contains(err.Error(), "no such key") {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	for _, info := range groups {
+		if info.Name == group {
+			return info.Lag, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// lagCollector refreshes metricConsumerLag of streams read by running listeners
+type lagCollector struct {
+	running *listeners
+
+	mu       sync.Mutex
+	interval time.Duration
+	chStop   chan struct{}
+	// reported label values of the series set by the last refresh
+	reported map[[2]string]bool
+}
+
+// restart runs the collector every interval, 0 stops it
+func (collector *lagCollector) restart(interval time.Duration) {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if interval == collector.interval {
+		return
+	}
+	if collector.chStop != nil {
+		close(collector.chStop)
+		collector.chStop = nil
+	}
+	collector.interval = interval
+	if interval > 0 {
+		collector.chStop = make(chan struct{})
+		go collector.run(interval, collector.chStop)
+	}
+}
+
+// run refreshes the lag every interval until chStop is closed
+func (collector *lagCollector) run(interval time.Duration, chStop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-chStop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		collector.refresh(ctx, lagTargets(collector.running.list()))
+		cancel()
+	}
+}
+
+// refresh reads the lag of every stream of targets, series of streams no
+// longer read or whose lag can't be read are removed
+func (collector *lagCollector) refresh(ctx context.Context, targets map[lagTarget][]string) {
+	reported := make(map[[2]string]bool)
+	active := make(map[string]bool)
+	for target, streams := range targets {
+		options := redisOptionsFromRwsConfiguration(target.connection, nil)
+		client := redis.NewClient(&options)
+		for _, stream := range streams {
+			active[stream] = true
+			if streamLabel(stream) != stream {
+				continue
+			}
+			lag, exists, err := streamLag(ctx, client, stream, target.group)
+			if err != nil {
+				if ctx.Err() == nil && err != redis.Nil {
+					slog.Warn("Can't read consumer lag", "redis", target.connection.Address, "stream", stream, "group", target.group, "error", err)
+				}
+				continue
+			}
+			if exists {
+				metricConsumerLag.set(float64(lag), stream, target.group)
+				reported[[2]string{stream, target.group}] = true
+			}
+		}
+		client.Close()
+	}
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	for labels := range collector.reported {
+		if !reported[labels] {
+			metricConsumerLag.remove(labels[0], labels[1])
+		}
+	}
+	collector.reported = reported
+	retainStreams(active)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLagInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		interval time.Duration
+	}{
+		{name: "metrics not served", config: Config{LagInterval: time.Second}, interval: 0},
+		{name: "metrics path not public", config: Config{MetricsPath: "/metrics"}, interval: 0},
+		{name: "public metrics path", config: Config{MetricsPath: "/metrics", AdminPublic: true}, interval: defaultLagInterval},
+		{name: "admin address", config: Config{AdminAddress: ":9100"}, interval: defaultLagInterval},
+		{name: "configured", config: Config{MetricsPath: "/metrics", AdminPublic: true, LagInterval: time.Second}, interval: time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if interval := test.config.lagInterval(); interval != test.interval {
+				t.Errorf("interval %v, expected %v", interval, test.interval)
+			}
+		})
+	}
+}
+
+func TestLagTargets(t *testing.T) {
+	redisA := ConfigConnection{Address: "redis-a:6379"}
+	redisB := ConfigConnection{Address: "redis-b:6379"}
+	rws := &RWS{
+		Address: ":8800",
+		WebSockets: map[string]*RWSRedis{
+			"/orders": {Connection: redisA, Source: ConfigSource{Streams: []string{"orders", "orders.*"}, Group: "billing"}},
+			"/events": {Connection: redisA, Source: ConfigSource{Streams: []string{"events"}}},
+			"/topics": {Connection: redisB},
+		},
+	}
+	// streams read by open websockets, found by patterns or passed as topics
+	orders := openSession("lag-orders", httptest.NewRequest(http.MethodGet, "/orders", nil), ":8800/orders", []string{"orders", "orders.*"}, nil)
+	defer orders.close()
+	orders.setPosition("orders", "1-0")
+	orders.setPosition("orders.eu", "2-0")
+	topics := openSession("lag-topics", httptest.NewRequest(http.MethodGet, "/topics", nil), ":8800/topics", []string{"t1"}, nil)
+	defer topics.close()
+	topics.setPosition("t1", "0")
+	other := openSession("lag-other", httptest.NewRequest(http.MethodGet, "/other", nil), ":8801/topics", []string{"t2"}, nil)
+	defer other.close()
+	other.setPosition("t2", "0")
+
+	expected := map[lagTarget][]string{
+		{connection: redisA, group: "billing"}: {"orders", "orders.eu"},
+		{connection: redisA}:                   {"events"},
+		{connection: redisB}:                   {"t1"},
+	}
+	if targets := lagTargets([]*RWS{rws}); !reflect.DeepEqual(targets, expected) {
+		t.Errorf("targets %v, expected %v", targets, expected)
+	}
+}
+
+func TestLagRefreshRemovesSeries(t *testing.T) {
+	collector := &lagCollector{reported: map[[2]string]bool{{"gone", "g1"}: true}}
+	metricConsumerLag.set(42, "gone", "g1")
+	defer metricConsumerLag.remove("gone", "g1")
+	// no stream is read anymore
+	collector.refresh(context.Background(), nil)
+	var output strings.Builder
+	metricConsumerLag.write(&output)
+	if strings.Contains(output.String(), `stream="gone"`) {
+		t.Errorf("series of a stream no longer read is kept\n%s", output.String())
+	}
+	if len(collector.reported) != 0 {
+		t.Errorf("reported %v, expected none", collector.reported)
+	}
+}
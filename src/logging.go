@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel level of the default logger, changed by config reload
+var logLevel = new(slog.LevelVar)
+
+// logLevels values of log.level
+var logLevels = map[string]slog.Level{
+	"debug":   slog.LevelDebug,
+	"info":    slog.LevelInfo,
+	"warn":    slog.LevelWarn,
+	"warning": slog.LevelWarn,
+	"error":   slog.LevelError,
+}
+
+// setupLogging installs default logger for log.level and log.format, the
+// standard log package is routed through it as well
+func setupLogging(level string, format string) {
+	if level == "" {
+		level = "info"
+	}
+	logLevel.Set(logLevels[strings.ToLower(level)])
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if strings.ToLower(format) == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs error and stops the process
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newConnectionID returns random identifier of a websocket connection
+func newConnectionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const productVersion = "1.0.5"
@@ -14,11 +19,17 @@ const releaseTag = "helena navarro"
 func main() {
 	configFile := flag.String("config", "config.yaml", "Config file location")
 	initiate := flag.Bool("init", false, "Create initial config file")
+	check := flag.Bool("check", false, "Validate config file and exit")
+	migrate := flag.Bool("migrate", false, "Rewrite schema 1.0 config file to schema "+currentSchemaVersion)
 	version := flag.Bool("v", false, "Print product version")
 	flag.Parse()
 
 	if *version {
 		fmt.Printf("Rws %s (%s)\n", productVersion, releaseTag)
+	} else if *check {
+		os.Exit(checkConfig(*configFile))
+	} else if *migrate {
+		os.Exit(migrateConfig(*configFile))
 	} else if *initiate {
 		if _, err := os.Stat(*configFile); os.IsNotExist(err) {
 			if err := os.WriteFile(*configFile, []byte(initConfig), 0644); err == nil {
@@ -30,18 +41,86 @@ func main() {
 			fmt.Printf("Config file %s already exists.\n", *configFile)
 		}
 	} else {
-		list := ReadRWS(*configFile)
-		for i := range list {
-			go func(rws *RWS) {
-				err := rws.Start()
+		config, err := ReadConfig(*configFile)
+		if err != nil {
+			fatal("Config", "error", err)
+		}
+		running := newListeners()
+		running.apply(config, *configFile, true)
+		admin := startAdmin(config, running)
+		// listeners are bound by now
+		notify("READY=1")
+		reportReady()
+
+		var chSignal = make(chan os.Signal, 1)
+		signal.Notify(chSignal, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+		var chStopWatch chan struct{}
+		watch := func(interval time.Duration) {
+			if chStopWatch != nil {
+				close(chStopWatch)
+				chStopWatch = nil
+			}
+			if interval > 0 {
+				chStopWatch = make(chan struct{})
+				go watchConfig(*configFile, interval, chSignal, chStopWatch)
+			}
+		}
+		watch(config.WatchInterval)
+		setStreamLimit(config.StreamLimit)
+		lag := &lagCollector{running: running}
+		lag.restart(config.lagInterval())
+		for sig := range chSignal {
+			if sig == syscall.SIGHUP {
+				slog.Info("Reloading", "signal", sig, "file", *configFile)
+				if next := running.reload(*configFile); next != nil {
+					admin.update(next, running)
+					if next.WatchInterval != config.WatchInterval {
+						watch(next.WatchInterval)
+					}
+					setStreamLimit(next.StreamLimit)
+					lag.restart(next.lagInterval())
+					config = next
+				}
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				slog.Info("Restarting", "signal", sig)
+				pid, err := restart(running.list(), admin.address(), admin.boundListener())
 				if err != nil {
-					log.Fatalln(err)
+					slog.Error("Restart failed, keep serving", "error", err)
+					continue
 				}
-			}(list[i])
+				// the new process serves the listeners, open websockets drain here,
+				// probes and scrapes go to the new process only
+				notify("MAINPID=" + strconv.Itoa(pid))
+				stopAdmin(admin)
+				slog.Info("Restarted, draining websockets", "pid", pid)
+				shutdown(running.list(), restartClose)
+				return
+			}
+			slog.Info("Shutting down", "signal", sig)
+			notify("STOPPING=1")
+			shutdown(running.list(), shutdownClose)
+			stopAdmin(admin)
+			return
 		}
+	}
+}
 
-		var chExit = make(chan os.Signal, 1)
-		signal.Notify(chExit, os.Interrupt)
-		<-chExit
+// shutdown drains every RWS in parallel with close frame closing, each
+// within its own shutdown timeout
+func shutdown(list []*RWS, closing sessionClose) {
+	var wg sync.WaitGroup
+	for i := range list {
+		wg.Add(1)
+		go func(rws *RWS) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), rws.ShutdownTimeout)
+			defer cancel()
+			if err := rws.Drain(ctx, closing); err != nil {
+				slog.Warn("Shutdown", "address", rws.Address, "error", err)
+			}
+		}(list[i])
 	}
+	wg.Wait()
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// metric family exposed in prometheus text format
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+// metricSeries values of metric for one set of label values
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+// metrics registered metric families in exposition order
+var metrics []*metric
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+var ageBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 60, 300, 3600}
+
+// defaultMetricsStreamLimit streams labeled by name when metrics.stream.limit isn't set
+const defaultMetricsStreamLimit = 100
+
+// otherStreams stream label of streams past metrics.stream.limit
+const otherStreams = "_other"
+
+// metricStreams streams having series of their own in metrics labeled by stream,
+// streams discovered by patterns past the limit share the otherStreams series
+var metricStreams = struct {
+	mu    sync.Mutex
+	limit int
+	known map[string]bool
+}{limit: defaultMetricsStreamLimit, known: make(map[string]bool)}
+
+var (
+	metricConnections       = newMetric("gauge", "rws_websocket_connections", "Open websocket connections.", "endpoint")
+	metricUpgrades          = newMetric("counter", "rws_websocket_upgrades_total", "Successful websocket upgrades.", "endpoint")
+	metricUpgradeFailures   = newMetric("counter", "rws_websocket_upgrade_failures_total", "Failed websocket upgrades.", "endpoint")
+	metricMessagesSent      = newMetric("counter", "rws_messages_sent_total", "Stream entries sent to websockets.", "stream")
+	metricBytesSent         = newMetric("counter", "rws_bytes_sent_total", "Payload bytes sent to websockets.", "stream")
+	metricCompressionInput  = newMetric("counter", "rws_compression_input_bytes_total", "Bytes of messages before permessage-deflate compression.", "endpoint")
+	metricCompressionOutput = newMetric("counter", "rws_compression_output_bytes_total", "Bytes of messages after permessage-deflate compression.", "endpoint")
+	metricEncodingErrors    = newMetric("counter", "rws_encoding_errors_total", "Batches of stream entries that could not be encoded.", "endpoint")
+	metricDeleted           = newMetric("counter", "rws_entries_deleted_total", "Stream entries deleted after delivery.", "stream")
+	metricAcked             = newMetric("counter", "rws_entries_acked_total", "Stream entries acked in their consumer group.", "stream")
+	metricReclaimed         = newMetric("counter", "rws_entries_reclaimed_total", "Pending stream entries claimed for redelivery after ack timeout.", "stream")
+	metricConsumerLag       = newMetric("gauge", "rws_consumer_lag_entries", "Stream entries not delivered yet, lag of the consumer group or, without group, entries left in the stream.", "stream", "group")
+	metricEntryAge          = newHistogram("rws_delivered_entry_age_seconds", "Age of live stream entries when sent to a websocket, derived from their IDs.", ageBuckets, "stream")
+	metricRedisErrors       = newMetric("counter", "rws_redis_errors_total", "Failed redis commands.", "command")
+	metricRedisLatency      = newHistogram("rws_redis_command_duration_seconds", "Latency of non blocking redis commands.", latencyBuckets, "command")
+)
+
+func newMetric(kind string, name string, help string, labels ...string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric("histogram", name, help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+// get returns series for label values, m.mu must be held
+func (m *metric) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, exists := m.series[key]
+	if !exists {
+		s = &metricSeries{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds value to counter or gauge
+func (m *metric) add(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += value
+}
+
+// set sets gauge value
+func (m *metric) set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = value
+}
+
+// remove drops series of label values
+func (m *metric) remove(labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.series, strings.Join(labelValues, "\xff"))
+}
+
+// removeStream drops series labeled by stream
+func (m *metric) removeStream(stream string) {
+	if len(m.labels) == 0 || m.labels[0] != "stream" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.series {
+		if s.labelValues[0] == stream {
+			delete(m.series, key)
+		}
+	}
+}
+
+// observe records value in histogram
+func (m *metric) observe(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, bucket := range m.buckets {
+		if value <= bucket {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// write writes metric family in prometheus text format
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, helpEscaper.Replace(m.help), m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelPairs(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		for i, bucket := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labelValues, formatFloat(bucket)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelPairs(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelPairs(s.labelValues, ""), s.count)
+	}
+}
+
+// labelPairs formats {label="value",...}, le is added for histogram buckets
+func (m *metric) labelPairs(labelValues []string, le string) string {
+	pairs := make([]string, 0, len(labelValues)+1)
+	for i, value := range labelValues {
+		pairs = append(pairs, m.labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// streamLabel returns label of stream, its name until metrics.stream.limit streams
+// are labeled, otherStreams past it
+func streamLabel(stream string) string {
+	metricStreams.mu.Lock()
+	defer metricStreams.mu.Unlock()
+	if metricStreams.known[stream] {
+		return stream
+	}
+	if len(metricStreams.known) >= metricStreams.limit {
+		return otherStreams
+	}
+	metricStreams.known[stream] = true
+	return stream
+}
+
+// setStreamLimit sets how many streams are labeled by name, 0 is the default limit,
+// streams labeled already keep their series
+func setStreamLimit(limit int) {
+	if limit == 0 {
+		limit = defaultMetricsStreamLimit
+	}
+	metricStreams.mu.Lock()
+	defer metricStreams.mu.Unlock()
+	metricStreams.limit = limit
+}
+
+// retainStreams removes series of labeled streams missing in active, freeing
+// their labels for other streams
+func retainStreams(active map[string]bool) {
+	metricStreams.mu.Lock()
+	defer metricStreams.mu.Unlock()
+	for stream := range metricStreams.known {
+		if active[stream] {
+			continue
+		}
+		delete(metricStreams.known, stream)
+		for _, m := range metrics {
+			m.removeStream(stream)
+		}
+	}
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// serveMetrics writes every registered metric
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// entryAge returns age of stream entry derived from the millisecond timestamp of its ID
+func entryAge(id string, now time.Time) (time.Duration, bool) {
+	at, ok := entryTime(id)
+	if !ok {
+		return 0, false
+	}
+	return now.Sub(at), true
+}
+
+// metricsHook records latency and errors of redis commands
+type metricsHook struct{}
+
+func (metricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (metricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		recordRedisCommand(ctx, cmd, time.Since(start), err)
+		return err
+	}
+}
+
+func (metricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			recordRedisCommand(ctx, cmd, time.Since(start), cmd.Err())
+		}
+		return err
+	}
+}
+
+// recordRedisCommand updates redis metrics, latency of blocking reads is not recorded
+// and errors caused by closing the websocket are not counted
+func recordRedisCommand(ctx context.Context, cmd redis.Cmder, elapsed time.Duration, err error) {
+	if err != nil && err != redis.Nil && ctx.Err() == nil {
+		metricRedisErrors.add(1, cmd.Name())
+	}
+	for _, arg := range cmd.Args() {
+		if s, ok := arg.(string); ok && strings.EqualFold(s, "block") {
+			return
+		}
+	}
+	metricRedisLatency.observe(elapsed.Seconds(), cmd.Name())
+}
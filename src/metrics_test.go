@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		metric   *metric
+		record   func(m *metric)
+		expected string
+	}{
+		{
+			name:   "counter escapes label values",
+			metric: &metric{name: "rws_test_total", help: "Test counter.", kind: "counter", labels: []string{"stream"}},
+			record: func(m *metric) {
+				m.add(2, `a"b`)
+				m.add(1, "back\\slash")
+				m.add(0.5, "new\nline")
+			},
+			expected: `# HELP rws_test_total Test counter.
+# TYPE rws_test_total counter
+rws_test_total{stream="a\"b"} 2
+rws_test_total{stream="back\\slash"} 1
+rws_test_total{stream="new\nline"} 0.5
+`,
+		},
+		{
+			name:   "gauge escapes help",
+			metric: &metric{name: "rws_test", help: "Help with \\ and\nnewline.", kind: "gauge"},
+			record: func(m *metric) {
+				m.set(-3)
+			},
+			expected: `# HELP rws_test Help with \\ and\nnewline.
+# TYPE rws_test gauge
+rws_test -3
+`,
+		},
+		{
+			name:   "histogram buckets are cumulative",
+			metric: &metric{name: "rws_test_seconds", help: "Test histogram.", kind: "histogram", labels: []string{"command"}, buckets: []float64{.5, 1}},
+			record: func(m *metric) {
+				m.observe(0.25, "get")
+				m.observe(0.75, "get")
+				m.observe(2, "get")
+			},
+			expected: `# HELP rws_test_seconds Test histogram.
+# TYPE rws_test_seconds histogram
+rws_test_seconds_bucket{command="get",le="0.5"} 1
+rws_test_seconds_bucket{command="get",le="1"} 2
+rws_test_seconds_bucket{command="get",le="+Inf"} 3
+rws_test_seconds_sum{command="get"} 3
+rws_test_seconds_count{command="get"} 3
+`,
+		},
+		{
+			name:     "family without series",
+			metric:   &metric{name: "rws_test_total", help: "Test counter.", kind: "counter", labels: []string{"endpoint"}},
+			record:   func(m *metric) {},
+			expected: "# HELP rws_test_total Test counter.\n# TYPE rws_test_total counter\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.metric.series = make(map[string]*metricSeries)
+			test.record(test.metric)
+			var output strings.Builder
+			test.metric.write(&output)
+			if output.String() != test.expected {
+				t.Errorf("output\n%s\nexpected\n%s", output.String(), test.expected)
+			}
+		})
+	}
+}
+
+func TestStreamLabel(t *testing.T) {
+	known, limit := metricStreams.known, metricStreams.limit
+	metricStreams.known = make(map[string]bool)
+	defer func() {
+		metricStreams.known, metricStreams.limit = known, limit
+	}()
+	setStreamLimit(2)
+	for _, stream := range []string{"a", "b", "c"} {
+		metricMessagesSent.add(1, streamLabel(stream))
+	}
+	defer metricMessagesSent.remove(otherStreams)
+	defer metricMessagesSent.remove("b")
+	defer metricMessagesSent.remove("c")
+
+	series := func() string {
+		var output strings.Builder
+		metricMessagesSent.write(&output)
+		return output.String()
+	}
+	for _, expected := range []string{`stream="a"} 1`, `stream="b"} 1`, `stream="_other"} 1`} {
+		if !strings.Contains(series(), expected) {
+			t.Errorf("series without %s\n%s", expected, series())
+		}
+	}
+	if strings.Contains(series(), `stream="c"`) {
+		t.Errorf("stream past the limit has its own series\n%s", series())
+	}
+
+	retainStreams(map[string]bool{"b": true, "c": true})
+	if strings.Contains(series(), `stream="a"`) {
+		t.Errorf("series of a stream no longer read is kept\n%s", series())
+	}
+	if !strings.Contains(series(), `stream="b"} 1`) {
+		t.Errorf("series of a stream still read is removed\n%s", series())
+	}
+	if label := streamLabel("c"); label != "c" {
+		t.Errorf("label %s, expected c once a label is freed", label)
+	}
+	if label := streamLabel("d"); label != otherStreams {
+		t.Errorf("label %s, expected %s past the limit", label, otherStreams)
+	}
+}
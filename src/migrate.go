@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// migrationKeys schema 1.0 endpoint keys and their place in schema 2.0
+var migrationKeys = map[string][]string{
+	"address":            {"address"},
+	"endpoint.prefix":    {"path.prefix"},
+	"endpoint.websocket": {"path.websocket"},
+	"endpoint.test":      {"path.test"},
+	"redis.streams":      {"source", "streams"},
+	"message.type":       {"delivery", "message.type"},
+	"compression":        {"delivery", "compression"},
+	"on.close.key":       {"delivery", "on.close.key"},
+	"on.close.value":     {"delivery", "on.close.value"},
+}
+
+// migrationMapKeys keys of schema 1.0 free form maps and their place in schema 2.0
+var migrationMapKeys = map[string]map[string][]string{
+	"redis.client.config": {
+		"metadata.broker.list": {"connection", "address"},
+		"username":             {"connection", "username"},
+		"password":             {"connection", "password"},
+		"db":                   {"connection", "db"},
+		"group.id":             {"source", "group"},
+	},
+	"redis.default.stream.config": {
+		"auto.offset.reset": {"source", "start"},
+	},
+}
+
+// migrationBehaviorKeys schema 1.0 keys rws 1.0 ignored, mapping them turns on
+// consumer groups or moves the start of reading, so only -migrate does it
+var migrationBehaviorKeys = map[string]bool{
+	"group.id":          true,
+	"auto.offset.reset": true,
+}
+
+// endpointKeyOrder order of keys in migrated endpoint and its sections
+var endpointKeyOrder = []string{
+	"address", "path.prefix", "path.websocket", "path.test",
+	"connection", "username", "password", "db",
+	"source", "streams", "start", "group",
+	"delivery", "message.type", "compression", "on.close.key", "on.close.value",
+}
+
+// schemaVersion returns schema.version of the document and its node, a file
+// without schema.version is 1.0 when it has redis.to.websocket section
+func schemaVersion(doc *yaml.Node) (string, *yaml.Node) {
+	if versionNode := mappingValue(doc, "schema.version"); versionNode != nil {
+		return versionNode.Value, versionNode
+	}
+	if mappingValue(doc, "redis.to.websocket") != nil {
+		return "1.0", nil
+	}
+	return currentSchemaVersion, nil
+}
+
+// migrate rewrites schema 1.0 document into schema 2.0 in place, the nodes
+// keep their positions so issues still point into the original file. Keys of
+// migrationBehaviorKeys are mapped only when rewrite is set, on read they are
+// dropped with a warning so a 1.0 file keeps working the way it did
+func (src *configSource) migrate(doc *yaml.Node, rewrite bool) {
+	if doc.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		keyNode, valueNode := doc.Content[i], doc.Content[i+1]
+		switch keyNode.Value {
+		case "schema.version":
+			valueNode.Value = currentSchemaVersion
+			valueNode.Tag = "!!str"
+			valueNode.Style = yaml.DoubleQuotedStyle
+		case "redis.to.websocket":
+			keyNode.Value = "endpoints"
+			if valueNode.Kind == yaml.SequenceNode {
+				for j, item := range valueNode.Content {
+					valueNode.Content[j] = src.migrateEndpoint(item, rewrite)
+				}
+			}
+		}
+	}
+}
+
+// migrateEndpoint returns schema 2.0 endpoint for schema 1.0 redis.to.websocket item
+func (src *configSource) migrateEndpoint(item *yaml.Node, rewrite bool) *yaml.Node {
+	if item.Kind != yaml.MappingNode {
+		return item
+	}
+	endpoint := &yaml.Node{
+		Kind:        yaml.MappingNode,
+		Tag:         "!!map",
+		Line:        item.Line,
+		Column:      item.Column,
+		HeadComment: item.HeadComment,
+	}
+	for i := 0; i+1 < len(item.Content); i += 2 {
+		keyNode, valueNode := item.Content[i], item.Content[i+1]
+		if path, exists := migrationKeys[keyNode.Value]; exists {
+			setNodePath(endpoint, keyNode, valueNode, path)
+			continue
+		}
+		subKeys, exists := migrationMapKeys[keyNode.Value]
+		if !exists {
+			src.warnf(keyNode, "unknown key %q in redis.to.websocket is ignored", keyNode.Value)
+			continue
+		}
+		if valueNode.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(valueNode.Content); j += 2 {
+			subKeyNode, subValueNode := valueNode.Content[j], valueNode.Content[j+1]
+			path, exists := subKeys[subKeyNode.Value]
+			if !exists {
+				src.warnf(subKeyNode, "unknown key %q in %s is ignored", subKeyNode.Value, keyNode.Value)
+				continue
+			}
+			if migrationBehaviorKeys[subKeyNode.Value] && !rewrite {
+				src.warnf(subKeyNode, "%s is ignored by schema 1.0, rws -migrate converts it to %s", subKeyNode.Value, strings.Join(path, "."))
+				continue
+			}
+			if subKeyNode.Value == "auto.offset.reset" {
+				if !migrateStart(subValueNode) {
+					src.warnf(subValueNode, "auto.offset.reset %q has no stream start, it is not migrated", subValueNode.Value)
+					continue
+				}
+				// the comment describes the 1.0 value
+				subKeyNode.LineComment, subValueNode.LineComment = "", ""
+			}
+			setNodePath(endpoint, subKeyNode, subValueNode, path)
+		}
+	}
+	dropStaleComments(endpoint)
+	sortEndpointKeys(endpoint)
+	// a head comment of the first key would be written after "- ", it goes above the item
+	if len(endpoint.Content) > 0 && endpoint.Content[0].HeadComment != "" {
+		endpoint.HeadComment = strings.TrimPrefix(endpoint.HeadComment+"\n"+endpoint.Content[0].HeadComment, "\n")
+		endpoint.Content[0].HeadComment = ""
+	}
+	return endpoint
+}
+
+// staleCommentKeys schema 1.0 keys which are gone or renamed in schema 2.0
+var staleCommentKeys = func() []string {
+	keys := []string{"redis.to.websocket"}
+	for key, path := range migrationKeys {
+		if key != path[len(path)-1] {
+			keys = append(keys, key)
+		}
+	}
+	for section, subKeys := range migrationMapKeys {
+		keys = append(keys, section)
+		for key, path := range subKeys {
+			if key != path[len(path)-1] {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}()
+
+// dropStaleComments removes comments of node and its children which name
+// schema 1.0 keys, they no longer match the migrated file
+func dropStaleComments(node *yaml.Node) {
+	stale := func(comment string) bool {
+		for _, key := range staleCommentKeys {
+			if strings.Contains(comment, key) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, comment := range []*string{&node.HeadComment, &node.LineComment, &node.FootComment} {
+		if stale(*comment) {
+			*comment = ""
+		}
+	}
+	for _, child := range node.Content {
+		dropStaleComments(child)
+	}
+}
+
+// sortEndpointKeys orders keys of mapping and its sections by endpointKeyOrder
+func sortEndpointKeys(mapping *yaml.Node) {
+	rank := func(key string) int {
+		for i, known := range endpointKeyOrder {
+			if known == key {
+				return i
+			}
+		}
+		return len(endpointKeyOrder)
+	}
+	pairs := make([][2]*yaml.Node, 0, len(mapping.Content)/2)
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		pairs = append(pairs, [2]*yaml.Node{mapping.Content[i], mapping.Content[i+1]})
+		if mapping.Content[i+1].Kind == yaml.MappingNode {
+			sortEndpointKeys(mapping.Content[i+1])
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return rank(pairs[i][0].Value) < rank(pairs[j][0].Value)
+	})
+	mapping.Content = mapping.Content[:0]
+	for _, pair := range pairs {
+		mapping.Content = append(mapping.Content, pair[0], pair[1])
+	}
+}
+
+// setNodePath adds value to mapping under path, missing sections are created
+func setNodePath(mapping *yaml.Node, keyNode *yaml.Node, valueNode *yaml.Node, path []string) {
+	for _, section := range path[:len(path)-1] {
+		sectionNode := mappingValue(mapping, section)
+		if sectionNode == nil {
+			sectionNode = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: keyNode.Line, Column: keyNode.Column}
+			mapping.Content = append(mapping.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: section, Line: keyNode.Line, Column: keyNode.Column},
+				sectionNode)
+		}
+		mapping = sectionNode
+	}
+	renamed := *keyNode
+	renamed.Value = path[len(path)-1]
+	mapping.Content = append(mapping.Content, &renamed, valueNode)
+}
+
+// migrateStart converts auto.offset.reset value into stream start ID, false
+// when the value has no counterpart
+func migrateStart(valueNode *yaml.Node) bool {
+	switch strings.ToLower(valueNode.Value) {
+	case "earliest", "smallest", "beginning":
+		valueNode.Value = "0"
+	case "latest", "largest", "end":
+		valueNode.Value = "$"
+	default:
+		return false
+	}
+	valueNode.Tag = "!!str"
+	valueNode.Style = yaml.DoubleQuotedStyle
+	return true
+}
+
+// migrateConfig rewrites schema 1.0 config file as schema 2.0, the original
+// is kept next to it with .bak suffix, returns process exit code
+func migrateConfig(filename string) int {
+	src, err := readConfigSource(filename)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if err := yaml.Unmarshal(src.content, &src.root); err != nil || src.root.Kind == 0 {
+		fmt.Printf("Can't parse config file %s: %v\n", filename, err)
+		return 1
+	}
+	doc := src.root.Content[0]
+	switch version, _ := schemaVersion(doc); version {
+	case currentSchemaVersion:
+		fmt.Printf("Config file %s already uses schema.version %s.\n", filename, currentSchemaVersion)
+		return 0
+	case "1.0":
+	default:
+		fmt.Printf("Config file %s has unsupported schema.version %q.\n", filename, version)
+		return 1
+	}
+	src.warnPlaceholders(doc)
+	src.migrate(doc, true)
+	if mappingValue(doc, "schema.version") == nil {
+		doc.Content = append([]*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: "schema.version"},
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: currentSchemaVersion, Style: yaml.DoubleQuotedStyle},
+		}, doc.Content...)
+	}
+	for _, issue := range src.issues {
+		fmt.Println(issue.Format(filename))
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&src.root); err != nil {
+		fmt.Printf("Can't encode config file %s: %v\n", filename, err)
+		return 1
+	}
+	encoder.Close()
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	backup := filename + ".bak"
+	if err := os.WriteFile(backup, src.content, mode); err != nil {
+		fmt.Printf("Can't save original config file as %s: %v\n", backup, err)
+		return 1
+	}
+	if err := os.WriteFile(filename, buffer.Bytes(), mode); err != nil {
+		fmt.Printf("Can't write config file %s: %v\n", filename, err)
+		return 1
+	}
+	fmt.Printf("Config file %s migrated to schema.version %s, original saved as %s.\n", filename, currentSchemaVersion, backup)
+	if len(src.issues) > 0 {
+		fmt.Println("Ignored keys were not migrated.")
+	}
+	return 0
+}
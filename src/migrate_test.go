@@ -0,0 +1,260 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const legacyConfig = `schema.version: "1.0"
+redis.to.websocket:
+  # first entry
+  - redis.client.config:
+      metadata.broker.list: redis:6379
+      password: pa$s
+      group.id: g1
+      enable.auto.commit: false
+    redis.default.stream.config:
+      auto.offset.reset: latest
+    redis.streams:
+      - s1
+    address: :8800
+    endpoint.prefix: ws
+    on.close.key: closed
+    include.headers: true
+  - redis.client.config:
+      metadata.broker.list: redis:6379
+    redis.default.stream.config:
+      auto.offset.reset: sometimes
+    address: :8802
+    message.type: text
+`
+
+func TestMigrateConfig(t *testing.T) {
+	filename := writeTestConfig(t, legacyConfig)
+	code := 0
+	output := captureStdout(t, func() { code = migrateConfig(filename) })
+	if code != 0 {
+		t.Fatalf("exit code %d, expected 0", code)
+	}
+	expectedOutput := strings.ReplaceAll(`FILE:8:7: warning: unknown key "enable.auto.commit" in redis.client.config is ignored
+FILE:16:5: warning: unknown key "include.headers" in redis.to.websocket is ignored
+FILE:20:26: warning: auto.offset.reset "sometimes" has no stream start, it is not migrated
+Config file FILE migrated to schema.version 2.0, original saved as FILE.bak.
+Ignored keys were not migrated.
+`, "FILE", filename)
+	if output != expectedOutput {
+		t.Errorf("output\n%s\nexpected\n%s", output, expectedOutput)
+	}
+
+	// group.id and auto.offset.reset are mapped
+	expected := `schema.version: "2.0"
+endpoints:
+  # first entry
+  - address: :8800
+    path.prefix: ws
+    connection:
+      address: redis:6379
+      password: pa$s
+    source:
+      streams:
+        - s1
+      start: "$"
+      group: g1
+    delivery:
+      on.close.key: closed
+  - address: :8802
+    connection:
+      address: redis:6379
+    delivery:
+      message.type: text
+`
+	if migrated, _ := os.ReadFile(filename); string(migrated) != expected {
+		t.Errorf("migrated file\n%s\nexpected\n%s", migrated, expected)
+	}
+	if backup, _ := os.ReadFile(filename + ".bak"); string(backup) != legacyConfig {
+		t.Errorf("backup\n%s\nexpected the original file", backup)
+	}
+
+	// the migrated file reads the same values the 1.0 file had
+	src, err := parseConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issues := src.errors(); len(issues) > 0 {
+		t.Fatalf("migrated file has errors %v", issues)
+	}
+	if password := src.config.Endpoints[0].Connection.Password; password != "pa$s" {
+		t.Errorf("password %q, expected %q", password, "pa$s")
+	}
+}
+
+func TestMigrateConfigCurrentVersion(t *testing.T) {
+	content := "schema.version: \"2.0\"\nendpoints: []\n"
+	filename := writeTestConfig(t, content)
+	code := 0
+	output := captureStdout(t, func() { code = migrateConfig(filename) })
+	if code != 0 || !strings.Contains(output, "already uses schema.version 2.0") {
+		t.Errorf("exit code %d, output %q", code, output)
+	}
+	if current, _ := os.ReadFile(filename); string(current) != content {
+		t.Errorf("file changed to\n%s", current)
+	}
+	if _, err := os.Stat(filename + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("backup written for a current file")
+	}
+}
+
+// TestMigrateConfigComments checks that comments naming 1.0 keys or values are
+// dropped and the others stay with their keys
+func TestMigrateConfigComments(t *testing.T) {
+	filename := writeTestConfig(t, `schema.version: "1.0"
+redis.to.websocket:
+  # first entry
+  - redis.client.config:
+      metadata.broker.list: redis:6379 # required
+      group.id: g1 # group.id of the consumers
+    redis.default.stream.config:
+      auto.offset.reset: earliest # default is "largest"
+    # redis.streams is not defined so clients pass topics
+    address: :8800 # public port
+  - redis.client.config:
+      metadata.broker.list: redis:6379
+    # test UI is off
+    address: :8802
+    endpoint.test: ""
+`)
+	if code := migrateConfig(filename); code != 0 {
+		t.Fatalf("exit code %d, expected 0", code)
+	}
+	expected := `schema.version: "2.0"
+endpoints:
+  # first entry
+  - address: :8800 # public port
+    connection:
+      address: redis:6379 # required
+    source:
+      start: "0"
+      group: g1
+  # test UI is off
+  - address: :8802
+    path.test: ""
+    connection:
+      address: redis:6379
+`
+	if migrated, _ := os.ReadFile(filename); string(migrated) != expected {
+		t.Errorf("migrated file\n%s\nexpected\n%s", migrated, expected)
+	}
+}
+
+// TestMigrateOnRead checks that 1.0 files keep their behavior when read
+func TestMigrateOnRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		endpoint ConfigEndpoint
+		warnings []string
+	}{
+		{
+			name: "keys are mapped",
+			content: `redis.to.websocket:
+  - redis.client.config:
+      metadata.broker.list: redis:6379
+      username: user
+      password: pa$s
+      db: 2
+    redis.streams: [s1, s2]
+    address: :8800
+    endpoint.websocket: ws
+    endpoint.test: ""
+    message.type: text
+    compression: true
+    on.close.key: closed
+    on.close.value: "yes"
+`,
+			endpoint: ConfigEndpoint{
+				Address:       ":8800",
+				PathWebSocket: "ws",
+				Connection:    ConfigConnection{Address: "redis:6379", Username: "user", Password: "pa$s", DB: 2},
+				Source:        ConfigSource{Streams: []string{"s1", "s2"}},
+				Delivery:      ConfigDelivery{MessageType: "text", Compression: true, OnCloseKey: "closed", OnCloseValue: "yes"},
+			},
+			warnings: []string{"1:1: warning: schema.version 1.0 is deprecated, run rws -migrate to convert the file to 2.0"},
+		},
+		{
+			name: "group and offset are not mapped",
+			content: `schema.version: "1.0"
+redis.to.websocket:
+  - redis.client.config:
+      metadata.broker.list: redis:6379
+      group.id: g1
+    redis.default.stream.config:
+      auto.offset.reset: latest
+    address: :8800
+`,
+			endpoint: ConfigEndpoint{
+				Address:    ":8800",
+				Connection: ConfigConnection{Address: "redis:6379"},
+			},
+			warnings: []string{
+				"1:17: warning: schema.version 1.0 is deprecated, run rws -migrate to convert the file to 2.0",
+				"5:7: warning: group.id is ignored by schema 1.0, rws -migrate converts it to source.group",
+				"7:7: warning: auto.offset.reset is ignored by schema 1.0, rws -migrate converts it to source.start",
+			},
+		},
+		{
+			name: "unknown offset is not an error",
+			content: `schema.version: "1.0"
+redis.to.websocket:
+  - redis.client.config:
+      metadata.broker.list: redis:6379
+    redis.default.stream.config:
+      auto.offset.reset: sometimes
+    address: :8800
+    include.headers: true
+`,
+			endpoint: ConfigEndpoint{
+				Address:    ":8800",
+				Connection: ConfigConnection{Address: "redis:6379"},
+			},
+			warnings: []string{
+				"1:17: warning: schema.version 1.0 is deprecated, run rws -migrate to convert the file to 2.0",
+				"6:7: warning: auto.offset.reset is ignored by schema 1.0, rws -migrate converts it to source.start",
+				`8:5: warning: unknown key "include.headers" in redis.to.websocket is ignored`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src, err := parseConfig(writeTestConfig(t, test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if issues := src.errors(); len(issues) > 0 {
+				t.Fatalf("errors %v", issues)
+			}
+			if len(src.config.Endpoints) != 1 {
+				t.Fatalf("%d endpoints, expected 1", len(src.config.Endpoints))
+			}
+			endpoint := src.config.Endpoints[0]
+			if got, expected := formatEndpoint(endpoint), formatEndpoint(test.endpoint); got != expected {
+				t.Errorf("endpoint\n%s\nexpected\n%s", got, expected)
+			}
+			warnings := make([]string, 0, len(src.issues))
+			for _, issue := range src.issues {
+				warnings = append(warnings, strings.TrimPrefix(issue.Format("FILE"), "FILE:"))
+			}
+			if got, expected := strings.Join(warnings, "\n"), strings.Join(test.warnings, "\n"); got != expected {
+				t.Errorf("warnings\n%s\nexpected\n%s", got, expected)
+			}
+		})
+	}
+}
+
+// formatEndpoint returns endpoint as YAML for comparison
+func formatEndpoint(endpoint ConfigEndpoint) string {
+	text, _ := yaml.Marshal(endpoint)
+	return string(text)
+}
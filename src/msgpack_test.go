@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestAppendMsgpack(t *testing.T) {
+	sixteen := make([]interface{}, 16)
+	for i := range sixteen {
+		sixteen[i] = i
+	}
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{name: "nil", value: nil, expected: "c0"},
+		{name: "true", value: true, expected: "c3"},
+		{name: "false", value: false, expected: "c2"},
+		{name: "empty string", value: "", expected: "a0"},
+		{name: "fixstr", value: "abc", expected: "a3616263"},
+		{name: "longest fixstr", value: strings.Repeat("x", 31), expected: "bf" + strings.Repeat("78", 31)},
+		{name: "str8", value: strings.Repeat("x", 32), expected: "d920" + strings.Repeat("78", 32)},
+		{name: "str16", value: strings.Repeat("x", 256), expected: "da0100" + strings.Repeat("78", 256)},
+		{name: "str32", value: strings.Repeat("x", 65536), expected: "db00010000" + strings.Repeat("78", 65536)},
+		{name: "utf-8 length in bytes", value: "é", expected: "a2c3a9"},
+		{name: "zero", value: 0, expected: "00"},
+		{name: "positive fixint", value: int64(127), expected: "7f"},
+		{name: "int64", value: 128, expected: "d30000000000000080"},
+		{name: "negative fixint", value: -1, expected: "ff"},
+		{name: "smallest negative fixint", value: -32, expected: "e0"},
+		{name: "negative int64", value: -33, expected: "d3ffffffffffffffdf"},
+		{name: "integral float", value: 42.0, expected: "2a"},
+		{name: "float", value: 1.5, expected: "cb3ff8000000000000"},
+		{name: "float beyond int precision", value: float64(1 << 53), expected: "cb4340000000000000"},
+		{name: "fixarray", value: []interface{}{1, "a", nil}, expected: "9301a161c0"},
+		{name: "array16", value: sixteen, expected: "dc0010000102030405060708090a0b0c0d0e0f"},
+		{name: "map with sorted keys", value: map[string]interface{}{"b": 1, "a": 2}, expected: "82a16102a16201"},
+		{name: "nested", value: map[string]interface{}{"x": []interface{}{true}}, expected: "81a17891c3"},
+		{name: "other types as text", value: uint8(7), expected: "a137"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if encoded := hex.EncodeToString(appendMsgpack(nil, test.value)); encoded != test.expected {
+				t.Errorf("encoded %s, expected %s", encoded, test.expected)
+			}
+		})
+	}
+}
+
+func TestMsgpackElement(t *testing.T) {
+	tests := []struct {
+		name        string
+		message     redis.XMessage
+		messageType string
+		expected    string
+	}{
+		{
+			name:        "text values",
+			message:     redis.XMessage{ID: "1-0", Values: map[string]interface{}{"k": "v"}},
+			messageType: "text",
+			// {"ID": "1-0", "Values": {"k": "v"}}
+			expected: "82a24944a3312d30a656616c75657381a16ba176",
+		},
+		{
+			name:        "json values are unpacked",
+			message:     redis.XMessage{ID: "1-0", Values: map[string]interface{}{"k": `{"n":1}`}},
+			messageType: "json",
+			// {"ID": "1-0", "Values": {"k": {"n": 1}}}
+			expected: "82a24944a3312d30a656616c75657381a16b81a16e01",
+		},
+		{
+			name:        "json looking values of text type",
+			message:     redis.XMessage{ID: "1-0", Values: map[string]interface{}{"k": `{"n":1}`}},
+			messageType: "text",
+			// {"ID": "1-0", "Values": {"k": "{\"n\":1}"}}
+			expected: "82a24944a3312d30a656616c75657381a16ba77b226e223a317d",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			element, err := msgpackElement(test.message, test.messageType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoded := hex.EncodeToString(element); encoded != test.expected {
+				t.Errorf("encoded %s, expected %s", encoded, test.expected)
+			}
+		})
+	}
+	if _, err := msgpackElement(redis.XMessage{ID: "1-0", Values: map[string]interface{}{"k": "{broken"}}, "json"); err == nil {
+		t.Error("no error for invalid JSON value")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultPresenceTTL time a session stays present without heartbeat
+const defaultPresenceTTL = 30 * time.Second
+
+// minPresenceTTL shortest delivery.presence.ttl, heartbeats every third of it
+const minPresenceTTL = time.Second
+
+// presence registers a session under delivery.presence.key: a sorted set of
+// connection IDs scored by expiry in unix milliseconds, and a hash of the
+// metadata of every session at key:ID expiring with it
+type presence struct {
+	key    string
+	ttl    time.Duration
+	client *redis.Client
+	sess   *session
+}
+
+// newPresence returns presence of sess, nil without delivery.presence.key
+func newPresence(delivery ConfigDelivery, client *redis.Client, sess *session) *presence {
+	if delivery.PresenceKey == "" {
+		return nil
+	}
+	ttl := delivery.PresenceTTL
+	if ttl <= 0 {
+		ttl = defaultPresenceTTL
+	}
+	return &presence{key: delivery.PresenceKey, ttl: ttl, client: client, sess: sess}
+}
+
+// interval period of heartbeats, a few of them fit into ttl
+func (present *presence) interval() time.Duration {
+	return present.ttl / 3
+}
+
+// heartbeat registers the session or extends its expiry, sessions of the key
+// which expired, like the ones of a crashed server, are dropped
+func (present *presence) heartbeat(ctx context.Context) error {
+	info := present.sess.info()
+	streams, _ := json.Marshal(info.Streams)
+	sans, _ := json.Marshal(info.SANs)
+	now := time.Now()
+	expiry := now.Add(present.ttl)
+	_, err := present.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, present.key, "-inf", "("+strconv.FormatInt(now.UnixMilli(), 10))
+		pipe.ZAdd(ctx, present.key, redis.Z{Score: float64(expiry.UnixMilli()), Member: info.ID})
+		pipe.PExpire(ctx, present.key, present.ttl)
+		pipe.HSet(ctx, present.key+":"+info.ID,
+			"id", info.ID,
+			"endpoint", info.Endpoint,
+			"streams", string(streams),
+			"user", info.User,
+			"sans", string(sans),
+			"remote", info.Remote,
+			"connected", info.ConnectedSince.UTC().Format(time.RFC3339),
+			"messages_sent", info.MessagesSent,
+		)
+		pipe.PExpire(ctx, present.key+":"+info.ID, present.ttl)
+		return nil
+	})
+	return err
+}
+
+// leave removes the session
+func (present *presence) leave(ctx context.Context) error {
+	_, err := present.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, present.key, present.sess.id)
+		pipe.Del(ctx, present.key+":"+present.sess.id)
+		return nil
+	})
+	return err
+}
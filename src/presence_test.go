@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestNewPresence(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery ConfigDelivery
+		ttl      time.Duration
+		interval time.Duration
+	}{
+		{name: "without key"},
+		{name: "default ttl", delivery: ConfigDelivery{PresenceKey: "rws.presence"}, ttl: 30 * time.Second, interval: 10 * time.Second},
+		{name: "configured ttl", delivery: ConfigDelivery{PresenceKey: "rws.presence", PresenceTTL: 3 * time.Second}, ttl: 3 * time.Second, interval: time.Second},
+		{name: "minimum ttl", delivery: ConfigDelivery{PresenceKey: "rws.presence", PresenceTTL: minPresenceTTL}, ttl: time.Second, interval: time.Second / 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			present := newPresence(test.delivery, nil, nil)
+			if test.ttl == 0 {
+				if present != nil {
+					t.Errorf("presence %+v, expected none", present)
+				}
+				return
+			}
+			if present == nil || present.ttl != test.ttl || present.interval() != test.interval {
+				t.Fatalf("presence %+v, expected ttl %s", present, test.ttl)
+			}
+		})
+	}
+}
+
+// presenceCommands returns commands sent by fake with millisecond timestamps
+// between from and to replaced by NOW, or by EXPIRY when ttl later
+func presenceCommands(fake *fakeRedis, from time.Time, to time.Time, ttl time.Duration) []string {
+	commands := fake.sent()
+	for i, command := range commands {
+		words := strings.Split(command, " ")
+		for j, word := range words {
+			ms, err := strconv.ParseFloat(strings.TrimPrefix(word, "("), 64)
+			if err != nil {
+				continue
+			}
+			switch at := time.UnixMilli(int64(ms)); {
+			case !at.Before(from.Truncate(time.Millisecond)) && !at.After(to):
+				words[j] = strings.TrimSuffix(word, strings.TrimPrefix(word, "(")) + "NOW"
+			case !at.Before(from.Add(ttl).Truncate(time.Millisecond)) && !at.After(to.Add(ttl)):
+				words[j] = "EXPIRY"
+			}
+		}
+		commands[i] = strings.Join(words, " ")
+	}
+	return commands
+}
+
+func TestPresence(t *testing.T) {
+	client, fake := newFakeRedis(func(cmd redis.Cmder) error { return nil })
+	defer client.Close()
+	sess := testSession(t, "conn-1", "rws.local:8800/ws")
+	present := newPresence(ConfigDelivery{PresenceKey: "rws.presence", PresenceTTL: 3 * time.Second}, client, sess)
+	connected := sess.info().ConnectedSince.UTC().Format(time.RFC3339)
+	heartbeat := func(sent int) []string {
+		return []string{
+			"multi",
+			// sessions expired before now are dropped
+			"zremrangebyscore rws.presence -inf (NOW",
+			"zadd rws.presence EXPIRY conn-1",
+			"pexpire rws.presence 3000",
+			`hset rws.presence:conn-1 id conn-1 endpoint rws.local:8800/ws streams ["s1"] user  sans null remote 192.0.2.1:1234 connected ` + connected + " messages_sent " + strconv.Itoa(sent),
+			"pexpire rws.presence:conn-1 3000",
+			"exec",
+		}
+	}
+
+	// join
+	from := time.Now()
+	if err := present.heartbeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if commands, expected := presenceCommands(fake, from, time.Now(), present.ttl), heartbeat(0); !slices.Equal(commands, expected) {
+		t.Errorf("join commands\n%s\nexpected\n%s", strings.Join(commands, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// refresh extends the expiry with current metadata
+	sess.delivered("s1", "2-0", 2)
+	fake.commands = nil
+	from = time.Now()
+	if err := present.heartbeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if commands, expected := presenceCommands(fake, from, time.Now(), present.ttl), heartbeat(2); !slices.Equal(commands, expected) {
+		t.Errorf("refresh commands\n%s\nexpected\n%s", strings.Join(commands, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// leave
+	fake.commands = nil
+	if err := present.leave(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"multi", "zrem rws.presence conn-1", "del rws.presence:conn-1", "exec"}
+	if commands := fake.sent(); !slices.Equal(commands, expected) {
+		t.Errorf("leave commands %q, expected %q", commands, expected)
+	}
+}
+
+func TestPresenceError(t *testing.T) {
+	client, _ := newFakeRedis(func(cmd redis.Cmder) error {
+		if cmd.Name() == "zadd" {
+			return fmt.Errorf("OOM command not allowed")
+		}
+		return nil
+	})
+	defer client.Close()
+	present := newPresence(ConfigDelivery{PresenceKey: "rws.presence"}, client, testSession(t, "conn-1", "rws.local:8800/ws"))
+	if err := present.heartbeat(context.Background()); err == nil || err.Error() != "OOM command not allowed" {
+		t.Errorf("error %v, expected the failing command's", err)
+	}
+}
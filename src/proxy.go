@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// trustedUnix entry of trusted.proxies trusting requests over unix domain sockets
+const trustedUnix = "unix"
+
+// proxySettings trusted reverse proxies and public base URL of the listeners
+type proxySettings struct {
+	trusted []netip.Prefix
+	unix    bool
+	baseURL *url.URL
+}
+
+// newProxySettings returns settings of trusted.proxies and public.base.url
+func newProxySettings(config *Config) (*proxySettings, error) {
+	proxy := &proxySettings{}
+	var err error
+	if proxy.trusted, proxy.unix, err = parseTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if proxy.baseURL, err = parseBaseURL(config.PublicBaseURL); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// parseTrustedProxies returns networks of trusted.proxies entries and whether
+// unix domain sockets are trusted
+func parseTrustedProxies(entries []string) ([]netip.Prefix, bool, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	unix := false
+	for _, entry := range entries {
+		if entry == trustedUnix {
+			unix = true
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, false, fmt.Errorf("invalid trusted.proxies entry [%s], expected an IP, a CIDR or unix", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, unix, nil
+}
+
+// parseBaseURL returns public.base.url without trailing slash, nil when unset
+func parseBaseURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	base, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public.base.url: %v", err)
+	}
+	switch base.Scheme {
+	case "http", "https", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("invalid public.base.url [%s], expected http, https, ws or wss scheme", raw)
+	}
+	if base.Host == "" || base.RawQuery != "" || base.Fragment != "" {
+		return nil, fmt.Errorf("invalid public.base.url [%s], expected scheme, host and an optional path", raw)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	return base, nil
+}
+
+// trusts reports whether the peer of r is a trusted proxy
+func (proxy *proxySettings) trusts(r *http.Request) bool {
+	if proxy == nil {
+		return false
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && local.Network() == "unix" {
+		return proxy.unix
+	}
+	addr, ok := parseHop(r.RemoteAddr)
+	return ok && proxy.trustsAddr(addr)
+}
+
+// trustsAddr reports whether addr belongs to trusted.proxies
+func (proxy *proxySettings) trustsAddr(addr netip.Addr) bool {
+	for _, prefix := range proxy.trusted {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress returns IP of the client of r, which came through a trusted
+// proxy: the forwarded addresses are walked from the nearest proxy back and
+// the first one which is not a trusted proxy is the client, empty without one
+func (proxy *proxySettings) clientAddress(r *http.Request) string {
+	hops := forwardedValues(r, "for")
+	if len(hops) == 0 {
+		hops = headerValues(r, "X-Forwarded-For")
+	}
+	at := proxy.clientHop(hops)
+	if at < 0 {
+		return ""
+	}
+	addr, _ := parseHop(hops[at])
+	return addr.String()
+}
+
+// clientHop returns index of the client in hops, the nearest proxy last: the
+// first address walking back which is not a trusted proxy, the farthest one
+// when all are trusted, -1 when the nearest address is missing or malformed
+func (proxy *proxySettings) clientHop(hops []string) int {
+	at := -1
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		at = i
+		if !proxy.trustsAddr(addr) {
+			break
+		}
+	}
+	return at
+}
+
+// websocketURL returns URL clients reach the websocket path of r's listener
+// at: public.base.url when set, otherwise the scheme and host the client used,
+// taken from the headers when r came through a trusted proxy
+func (proxy *proxySettings) websocketURL(r *http.Request, proxied bool, path string) string {
+	if proxy != nil && proxy.baseURL != nil {
+		scheme := proxy.baseURL.Scheme
+		switch scheme {
+		case "http":
+			scheme = "ws"
+		case "https":
+			scheme = "wss"
+		}
+		return scheme + "://" + proxy.baseURL.Host + proxy.baseURL.Path + path
+	}
+	secure, host := r.TLS != nil, r.Host
+	if proxied {
+		proto, forwardedHost := proxy.forwardedOrigin(r)
+		if proto != "" {
+			secure = strings.EqualFold(proto, "https") || strings.EqualFold(proto, "wss")
+		}
+		if forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+	if secure {
+		return "wss://" + host + path
+	}
+	return "ws://" + host + path
+}
+
+// forwardedOrigin returns scheme and host the client of r used, as recorded by
+// the trusted proxy it connected to, the one at the client's hop, so values
+// the client sent itself further left are ignored
+func (proxy *proxySettings) forwardedOrigin(r *http.Request) (string, string) {
+	if elements := forwardedElements(r); len(elements) > 0 {
+		hops := make([]string, len(elements))
+		for i, element := range elements {
+			hops[i] = element["for"]
+		}
+		at := proxy.clientHop(hops)
+		if at < 0 {
+			at = len(elements) - 1
+		}
+		return elements[at]["proto"], elements[at]["host"]
+	}
+	// proxies append to X-Forwarded-Proto and -Host like to X-Forwarded-For or
+	// set them once, so the lists are lined up from the nearest proxy
+	hops := headerValues(r, "X-Forwarded-For")
+	back := 0
+	if at := proxy.clientHop(hops); at >= 0 {
+		back = len(hops) - 1 - at
+	}
+	return hopValue(headerValues(r, "X-Forwarded-Proto"), back), hopValue(headerValues(r, "X-Forwarded-Host"), back)
+}
+
+// forwardedElements returns parameters of the elements of the Forwarded
+// headers of r (RFC 7239) by lower case name, the nearest proxy's last
+func forwardedElements(r *http.Request) []map[string]string {
+	elements := make([]map[string]string, 0)
+	for _, header := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			parameters := make(map[string]string)
+			for _, pair := range strings.Split(element, ";") {
+				name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found {
+					parameters[strings.ToLower(name)] = strings.Trim(value, `"`)
+				}
+			}
+			elements = append(elements, parameters)
+		}
+	}
+	return elements
+}
+
+// forwardedValues returns values of parameter in the elements of the
+// Forwarded headers of r (RFC 7239), in order
+func forwardedValues(r *http.Request, parameter string) []string {
+	values := make([]string, 0)
+	for _, element := range forwardedElements(r) {
+		if value, exists := element[parameter]; exists {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// headerValues returns the comma-separated values of header in r, in order
+func headerValues(r *http.Request, header string) []string {
+	values := make([]string, 0)
+	for _, line := range r.Header.Values(header) {
+		for _, value := range strings.Split(line, ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+	return values
+}
+
+// hopValue returns the value back hops from the nearest proxy's one, the
+// first value when the list is shorter, empty without values
+func hopValue(values []string, back int) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[max(len(values)-1-back, 0)]
+}
+
+// parseHop returns IP of a forwarded address or a remote address, with or
+// without port, IPv6 ones optionally in brackets
+func parseHop(hop string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testProxy returns proxy settings of trusted.proxies and public.base.url
+func testProxy(t *testing.T, trusted []string, baseURL string) *proxySettings {
+	t.Helper()
+	proxy, err := newProxySettings(&Config{TrustedProxies: trusted, PublicBaseURL: baseURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+// testRequest returns request from remote with headers, over a unix socket when unix is set
+func testRequest(remote string, unix bool, headers http.Header) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://rws.local:8800/echo", nil)
+	r.RemoteAddr = remote
+	for name, values := range headers {
+		r.Header[name] = values
+	}
+	if unix {
+		local := &net.UnixAddr{Name: "/run/rws.sock", Net: "unix"}
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+	}
+	return r
+}
+
+func TestClientAddress(t *testing.T) {
+	const peer = "203.0.113.7:5000"
+	tests := []struct {
+		name     string
+		trusted  []string
+		remote   string
+		unix     bool
+		headers  http.Header
+		expected string
+	}{
+		{
+			name:     "no trusted proxies",
+			remote:   peer,
+			headers:  http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			expected: peer,
+		},
+		{
+			name:     "untrusted peer spoofs X-Forwarded-For",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   peer,
+			headers:  http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			expected: peer,
+		},
+		{
+			name:     "untrusted peer spoofs Forwarded",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   peer,
+			headers:  http.Header{"Forwarded": {"for=198.51.100.1"}},
+			expected: peer,
+		},
+		{
+			name:     "trusted peer without headers",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			expected: "10.0.0.1:5000",
+		},
+		{
+			name:     "trusted peer",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "trusted peer given as IP",
+			trusted:  []string{"10.0.0.1"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "multi-hop chain of trusted proxies",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"X-Forwarded-For": {"198.51.100.1, 10.0.0.3, 10.0.0.2"}},
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "multi-hop chain with client spoofed entries",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"X-Forwarded-For": {"192.0.2.66, 198.51.100.1, 10.0.0.2"}},
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "multi-hop chain over header lines",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"X-Forwarded-For": {"192.0.2.66, 198.51.100.1", "10.0.0.2"}},
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "untrusted hop ends the chain",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"X-Forwarded-For": {"198.51.100.1, 192.0.2.66, 10.0.0.2"}},
+			expected: "192.0.2.66",
+		},
+		{
+			name:     "chain of trusted proxies only",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			expected: "10.0.0.3",
+		},
+		{
+			name:    "Forwarded wins over X-Forwarded-For",
+			trusted: []string{"10.0.0.0/8"},
+			remote:  "10.0.0.1:5000",
+			headers: http.Header{
+				"Forwarded":       {"for=198.51.100.2;proto=https"},
+				"X-Forwarded-For": {"198.51.100.3"},
+			},
+			expected: "198.51.100.2",
+		},
+		{
+			name:     "Forwarded multi-hop chain",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"Forwarded": {"for=192.0.2.66, for=198.51.100.1;proto=https", "for=10.0.0.2"}},
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "Forwarded quoted IPv6 with port",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"Forwarded": {`for="[2001:db8::1]:4711"`}},
+			expected: "2001:db8::1",
+		},
+		{
+			name:     "Forwarded trusted quoted IPv6 loopback",
+			trusted:  []string{"10.0.0.0/8", "::1"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"Forwarded": {`for=198.51.100.9, for="[::1]:4711"`}},
+			expected: "198.51.100.9",
+		},
+		{
+			name:     "Forwarded unknown",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"Forwarded": {"for=unknown"}},
+			expected: "10.0.0.1:5000",
+		},
+		{
+			name:     "Forwarded unknown hides hops before it",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"Forwarded": {"for=198.51.100.1, for=unknown"}},
+			expected: "10.0.0.1:5000",
+		},
+		{
+			name:     "Forwarded obfuscated identifier",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "10.0.0.1:5000",
+			headers:  http.Header{"Forwarded": {"for=_hidden, for=198.51.100.1"}},
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "IPv6 peer",
+			trusted:  []string{"fd00::/8"},
+			remote:   "[fd00::1]:5000",
+			headers:  http.Header{"X-Forwarded-For": {"2001:db8::7"}},
+			expected: "2001:db8::7",
+		},
+		{
+			name:     "IPv4-mapped peer",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   "[::ffff:10.0.0.1]:5000",
+			headers:  http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "unix socket trusted",
+			trusted:  []string{"unix"},
+			remote:   "@",
+			unix:     true,
+			headers:  http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "unix socket not trusted",
+			trusted:  []string{"0.0.0.0/0"},
+			remote:   "@",
+			unix:     true,
+			headers:  http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			expected: "@",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			admin := http.NewServeMux()
+			remote := ""
+			admin.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) { remote = r.RemoteAddr })
+			rws := &RWS{Proxy: testProxy(t, test.trusted, ""), Admin: admin}
+			rws.ServeHTTP(httptest.NewRecorder(), testRequest(test.remote, test.unix, test.headers))
+			if remote != test.expected {
+				t.Errorf("remote address %q, expected %q", remote, test.expected)
+			}
+		})
+	}
+}
+
+func TestWebsocketURL(t *testing.T) {
+	const peer, proxyPeer = "203.0.113.7:5000", "10.0.0.1:5000"
+	tests := []struct {
+		name     string
+		trusted  []string
+		baseURL  string
+		remote   string
+		secure   bool
+		headers  http.Header
+		expected string
+	}{
+		{
+			name:     "host of the request",
+			remote:   peer,
+			expected: "ws://rws.local:8800/ws",
+		},
+		{
+			name:     "tls",
+			remote:   peer,
+			secure:   true,
+			expected: "wss://rws.local:8800/ws",
+		},
+		{
+			name:    "untrusted peer spoofs X-Forwarded headers",
+			trusted: []string{"10.0.0.0/8"},
+			remote:  peer,
+			headers: http.Header{
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.example"},
+			},
+			expected: "ws://rws.local:8800/ws",
+		},
+		{
+			name:     "untrusted peer spoofs Forwarded",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   peer,
+			headers:  http.Header{"Forwarded": {"proto=https;host=evil.example"}},
+			expected: "ws://rws.local:8800/ws",
+		},
+		{
+			name:    "trusted X-Forwarded headers",
+			trusted: []string{"10.0.0.0/8"},
+			remote:  proxyPeer,
+			headers: http.Header{
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"rws.example"},
+			},
+			expected: "wss://rws.example/ws",
+		},
+		{
+			name:    "edge proxy of a multi-hop chain",
+			trusted: []string{"10.0.0.0/8"},
+			remote:  proxyPeer,
+			headers: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1, 10.0.0.2"},
+				"X-Forwarded-Proto": {"https, http"},
+				"X-Forwarded-Host":  {"rws.example, internal.example"},
+			},
+			expected: "wss://rws.example/ws",
+		},
+		{
+			name:    "edge proxy sets the headers once",
+			trusted: []string{"10.0.0.0/8"},
+			remote:  proxyPeer,
+			headers: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1, 10.0.0.2"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"rws.example"},
+			},
+			expected: "wss://rws.example/ws",
+		},
+		{
+			name:    "client spoofs leftmost X-Forwarded headers",
+			trusted: []string{"10.0.0.0/8"},
+			remote:  proxyPeer,
+			headers: http.Header{
+				"X-Forwarded-For":   {"192.0.2.66, 198.51.100.1"},
+				"X-Forwarded-Proto": {"http, https"},
+				"X-Forwarded-Host":  {"evil.example, rws.example"},
+			},
+			expected: "wss://rws.example/ws",
+		},
+		{
+			name:    "nearest proxy's value without X-Forwarded-For",
+			trusted: []string{"10.0.0.0/8"},
+			remote:  proxyPeer,
+			headers: http.Header{
+				"X-Forwarded-Proto": {"http, https"},
+				"X-Forwarded-Host":  {"evil.example, rws.example"},
+			},
+			expected: "wss://rws.example/ws",
+		},
+		{
+			name:    "client spoofs leftmost Forwarded element",
+			trusted: []string{"10.0.0.0/8"},
+			remote:  proxyPeer,
+			headers: http.Header{
+				"Forwarded": {`for=192.0.2.66;proto=http;host=evil.example`, `for=198.51.100.1;proto=https;host=rws.example, for=10.0.0.2;proto=http;host=internal.example`},
+			},
+			expected: "wss://rws.example/ws",
+		},
+		{
+			name:     "client spoofs Forwarded without for",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   proxyPeer,
+			headers:  http.Header{"Forwarded": {"proto=http;host=evil.example, for=198.51.100.1;proto=https;host=rws.example"}},
+			expected: "wss://rws.example/ws",
+		},
+		{
+			name:    "trusted Forwarded wins over X-Forwarded headers",
+			trusted: []string{"10.0.0.0/8"},
+			remote:  proxyPeer,
+			headers: http.Header{
+				"Forwarded":         {`for=198.51.100.1;proto=https;host="rws.example:8443"`},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"other.example"},
+			},
+			expected: "wss://rws.example:8443/ws",
+		},
+		{
+			name:     "trusted proxy terminates tls",
+			trusted:  []string{"10.0.0.0/8"},
+			remote:   proxyPeer,
+			secure:   true,
+			headers:  http.Header{"X-Forwarded-Proto": {"http"}},
+			expected: "ws://rws.local:8800/ws",
+		},
+		{
+			name:     "public.base.url",
+			baseURL:  "https://rws.example/prefix/",
+			remote:   peer,
+			expected: "wss://rws.example/prefix/ws",
+		},
+		{
+			name:    "public.base.url wins over trusted headers",
+			trusted: []string{"10.0.0.0/8"},
+			baseURL: "http://rws.example:8080",
+			remote:  proxyPeer,
+			secure:  true,
+			headers: http.Header{
+				"Forwarded":        {"proto=https;host=other.example"},
+				"X-Forwarded-Host": {"another.example"},
+			},
+			expected: "ws://rws.example:8080/ws",
+		},
+		{
+			name:     "public.base.url with websocket scheme",
+			baseURL:  "wss://rws.example",
+			remote:   peer,
+			expected: "wss://rws.example/ws",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := testProxy(t, test.trusted, test.baseURL)
+			r := testRequest(test.remote, false, test.headers)
+			if test.secure {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if wsURL := proxy.websocketURL(r, proxy.trusts(r), "/ws"); wsURL != test.expected {
+				t.Errorf("websocket URL %q, expected %q", wsURL, test.expected)
+			}
+		})
+	}
+}
+
+func TestNewProxySettingsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		baseURL string
+	}{
+		{name: "hostname in trusted.proxies", trusted: []string{"proxy.internal"}},
+		{name: "bad CIDR in trusted.proxies", trusted: []string{"10.0.0.0/33"}},
+		{name: "base URL scheme", baseURL: "ftp://rws.example"},
+		{name: "base URL without host", baseURL: "https:///ws"},
+		{name: "base URL with query", baseURL: "https://rws.example/?a=1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newProxySettings(&Config{TrustedProxies: test.trusted, PublicBaseURL: test.baseURL}); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
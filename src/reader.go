@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errInterrupted returned by a blocking read interrupted by a client command
+var errInterrupted = errors.New("read interrupted")
+
+// streamReader reads entries of a websocket's streams from redis and applies
+// commands of the client's control protocol between reads, with source.group
+// streams are read as consumer of the group
+type streamReader struct {
+	sess     *session
+	source   ConfigSource
+	delivery ConfigDelivery
+	consumer string
+	// sentinelWhen compiled delivery.sentinel.when, nil without it
+	sentinelWhen *sentinelPredicate
+	client       *redis.Client
+	blocking     *blockingReader
+	logger       *slog.Logger
+
+	// access streams the client may read, nil without source.access
+	access *streamAccess
+
+	patterns []string
+	excluded map[string]bool
+	cursor   *streamCursor
+	paused   bool
+
+	// positions of a resume token, used once when their stream is added
+	resumed map[string]string
+	issuer  *resumeIssuer
+
+	replaying *replaySettings
+
+	// delivered entries waiting for the client's ack by stream
+	muUnacked sync.Mutex
+	unacked   map[string]map[string]bool
+
+	chStream  chan streamBatch
+	chReply   chan controlMessage
+	chCommand chan controlRequest
+	chError   chan error
+}
+
+// streamBatch entries of a stream handed to the websocket, replayed ones stay in redis
+type streamBatch struct {
+	redis.XStream
+	replayed bool
+}
+
+func newStreamReader(sess *session, rwsConfig *RWSRedis, consumer string, client *redis.Client, options redis.Options, logger *slog.Logger) *streamReader {
+	return &streamReader{
+		sess:         sess,
+		source:       rwsConfig.Source,
+		delivery:     rwsConfig.Delivery,
+		sentinelWhen: rwsConfig.sentinelWhen,
+		consumer:     consumer,
+		client:       client,
+		blocking:     &blockingReader{options: options},
+		logger:       logger,
+		patterns:     append([]string{}, sess.streams...),
+		excluded:     make(map[string]bool),
+		cursor:       newStreamCursor(),
+		unacked:      make(map[string]map[string]bool),
+		chStream:     make(chan streamBatch),
+		chReply:      make(chan controlMessage),
+		chCommand:    make(chan controlRequest, 1),
+		chError:      make(chan error),
+	}
+}
+
+// command hands request of the client over to run, interrupting a blocked
+// read, which is safe as the request is queued before the interrupt
+func (reader *streamReader) command(ctx context.Context, request controlRequest) {
+	select {
+	case reader.chCommand <- request:
+		reader.blocking.interrupt()
+	case <-ctx.Done():
+	}
+}
+
+// reply sends message to the client, returns false once ctx is done
+func (reader *streamReader) reply(ctx context.Context, message controlMessage) bool {
+	select {
+	case reader.chReply <- message:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// fail reports err, after which run stops
+func (reader *streamReader) fail(ctx context.Context, err error) {
+	select {
+	case reader.chError <- err:
+	case <-ctx.Done():
+	}
+}
+
+// run reads streams until ctx is done or reading fails
+func (reader *streamReader) run(ctx context.Context) {
+	if len(reader.patterns) == 0 {
+		reader.fail(ctx, errors.New("no streams for listening"))
+		return
+	}
+
+	discovery := reader.source.DiscoveryInterval
+	found, err := reader.discover(ctx, reader.patterns, reader.source.Start)
+	if err != nil {
+		reader.fail(ctx, err)
+		return
+	}
+	reader.logger.Debug("Discovered streams", "found", found)
+	if len(found) == 0 && discovery == 0 {
+		reader.fail(ctx, fmt.Errorf("the streams %v not found in redis", reader.patterns))
+		return
+	}
+	if reader.issuer != nil {
+		token, _ := reader.issuer.next(true)
+		if !reader.reply(ctx, token) {
+			return
+		}
+	}
+	if reader.replaying != nil && !reader.replay(ctx) {
+		return
+	}
+
+	claim := reader.ackTimeout()
+	nextDiscovery := time.Now().Add(discovery)
+	nextClaim := time.Now().Add(claim)
+	// wake returns when the next discovery or claim is due, zero when none is
+	wake := func() time.Time {
+		switch {
+		case discovery > 0 && claim > 0 && nextClaim.Before(nextDiscovery):
+			return nextClaim
+		case discovery > 0:
+			return nextDiscovery
+		case claim > 0:
+			return nextClaim
+		}
+		return time.Time{}
+	}
+	for {
+		// Commands of the client go first
+		select {
+		case request := <-reader.chCommand:
+			if !reader.reply(ctx, reader.handle(ctx, request)) {
+				return
+			}
+			continue
+		default:
+		}
+
+		if discovery > 0 && !time.Now().Before(nextDiscovery) {
+			// streams created after the websocket opened are read from their first entry
+			added, err := reader.discover(ctx, reader.patterns, "0")
+			if err != nil {
+				reader.fail(ctx, err)
+				return
+			}
+			if len(added) > 0 {
+				reader.logger.Info("Discovered new streams", "added", added)
+				if !reader.reply(ctx, controlMessage{Event: "streams.added", Streams: added}) {
+					return
+				}
+			}
+			nextDiscovery = time.Now().Add(discovery)
+		}
+
+		if claim > 0 && !time.Now().Before(nextClaim) {
+			// entries not acked within ack timeout, by this or any other consumer, are delivered again
+			// a sentinel may remove its stream from the cursor
+			for _, stream := range slices.Clone(reader.cursor.names) {
+				messages, err := reader.claim(ctx, stream, claim)
+				if err != nil {
+					reader.fail(ctx, err)
+					return
+				}
+				if len(messages) == 0 {
+					continue
+				}
+				reader.logger.Info("Redelivering entries not acked in time", "stream", stream, "count", len(messages))
+				if !reader.forward(ctx, streamBatch{XStream: redis.XStream{Stream: stream, Messages: messages}}) {
+					return
+				}
+			}
+			nextClaim = time.Now().Add(claim)
+		}
+
+		// Paused or without streams there is nothing to read until a command or the next discovery
+		if reader.paused || len(reader.cursor.names) == 0 {
+			var chWake <-chan time.Time
+			if next := wake(); !next.IsZero() {
+				chWake = time.After(time.Until(next))
+			}
+			select {
+			case request := <-reader.chCommand:
+				if !reader.reply(ctx, reader.handle(ctx, request)) {
+					return
+				}
+			case <-chWake:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		// With discovery or claims the read is blocked until the next one only
+		block := reader.source.ReadBlock
+		if next := wake(); !next.IsZero() && (block == 0 || time.Until(next) < block) {
+			block = max(time.Until(next), time.Millisecond)
+		}
+		xStreams, err := reader.blocking.read(ctx, func(ctx context.Context, client *redis.Client) ([]redis.XStream, error) {
+			if reader.source.Group == "" {
+				return client.XRead(ctx, &redis.XReadArgs{
+					Streams: reader.cursor.args(),
+					Count:   reader.readCount(),
+					Block:   block,
+				}).Result()
+			}
+			return client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    reader.source.Group,
+				Consumer: reader.consumer,
+				Streams:  reader.cursor.args(),
+				Count:    reader.readCount(),
+				Block:    block,
+			}).Result()
+		})
+
+		if errors.Is(err, errInterrupted) || errors.Is(err, redis.Nil) && block > 0 {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				reader.logger.Error("Can't read streams", "error", err)
+			}
+			reader.fail(ctx, err)
+			return
+		}
+		for _, xStream := range xStreams {
+			if len(xStream.Messages) == 0 {
+				// pending entries of the consumer are all read, continue with new ones
+				reader.cursor.set(xStream.Stream, ">")
+				continue
+			}
+			if reader.cursor.ids[xStream.Stream] != ">" {
+				reader.cursor.set(xStream.Stream, Last(xStream.Messages).ID)
+			}
+			if !reader.forward(ctx, streamBatch{XStream: xStream}) {
+				return
+			}
+		}
+	}
+}
+
+// discover finds streams matching patterns and starts reading the ones which
+// are not read yet from start, returns the added streams
+func (reader *streamReader) discover(ctx context.Context, patterns []string, start string) ([]string, error) {
+	added := make([]string, 0)
+	for _, pattern := range patterns {
+		found, err := discoverStreams(ctx, reader.client, []string{pattern})
+		if err != nil {
+			if ctx.Err() == nil {
+				reader.logger.Error("Can't scan streams", "pattern", pattern, "error", err)
+			}
+			return nil, err
+		}
+		for _, stream := range found {
+			if reader.cursor.has(stream) || reader.excluded[stream] || !reader.access.allows(stream) {
+				continue
+			}
+			id, err := reader.startRead(ctx, stream, start)
+			if err != nil {
+				return nil, err
+			}
+			reader.cursor.add(stream, id, pattern)
+			reader.sess.setPosition(stream, id)
+			added = append(added, stream)
+		}
+	}
+	return added, nil
+}
+
+// blockingReader runs blocking XREADs on a client of its own, so a read can be
+// interrupted by closing the client without affecting other commands
+type blockingReader struct {
+	options redis.Options
+
+	mu          sync.Mutex
+	client      *redis.Client
+	cancel      context.CancelFunc
+	interrupted bool
+	closed      bool
+}
+
+// read runs blocking command, returns errInterrupted when interrupt was called during or before it
+func (blocking *blockingReader) read(ctx context.Context, command func(ctx context.Context, client *redis.Client) ([]redis.XStream, error)) ([]redis.XStream, error) {
+	blocking.mu.Lock()
+	if blocking.closed {
+		blocking.mu.Unlock()
+		return nil, redis.ErrClosed
+	}
+	if blocking.interrupted {
+		blocking.interrupted = false
+		blocking.mu.Unlock()
+		return nil, errInterrupted
+	}
+	if blocking.client == nil {
+		blocking.client = redis.NewClient(&blocking.options)
+		blocking.client.AddHook(metricsHook{})
+	}
+	client := blocking.client
+	readCtx, cancel := context.WithCancel(ctx)
+	blocking.cancel = cancel
+	blocking.mu.Unlock()
+
+	xStreams, err := command(readCtx, client)
+
+	blocking.mu.Lock()
+	interrupted := blocking.interrupted || readCtx.Err() != nil && ctx.Err() == nil
+	blocking.interrupted = false
+	blocking.cancel = nil
+	blocking.mu.Unlock()
+	cancel()
+	if interrupted {
+		return nil, errInterrupted
+	}
+	return xStreams, err
+}
+
+// interrupt aborts the read in progress or the next one
+func (blocking *blockingReader) interrupt() {
+	blocking.mu.Lock()
+	defer blocking.mu.Unlock()
+	blocking.interrupted = true
+	if blocking.cancel != nil {
+		// go-redis does not abort a blocked command on cancel, closing its connection does
+		blocking.cancel()
+		blocking.cancel = nil
+		blocking.client.Close()
+		blocking.client = nil
+	}
+}
+
+// close releases the client and aborts the read in progress
+func (blocking *blockingReader) close() {
+	blocking.mu.Lock()
+	defer blocking.mu.Unlock()
+	blocking.closed = true
+	if blocking.client != nil {
+		blocking.client.Close()
+		blocking.client = nil
+	}
+}
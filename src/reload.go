@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// listeners running RWS by address
+type listeners struct {
+	mu     sync.Mutex
+	rwsMap map[string]*RWS
+}
+
+func newListeners() *listeners {
+	return &listeners{rwsMap: make(map[string]*RWS)}
+}
+
+// start binds rws and serves it in the background, with exit set a failing
+// listener stops the process, the caller holds running.mu
+func (running *listeners) start(rws *RWS, exit bool) {
+	listener, err := rws.Listen()
+	if err != nil {
+		if exit {
+			fatal("Listener failed", "address", rws.Address, "error", err)
+		}
+		slog.Error("Listener failed", "address", rws.Address, "error", err)
+		return
+	}
+	running.rwsMap[rws.Address] = rws
+	if listener == nil {
+		return
+	}
+	go func() {
+		err := rws.Serve(listener)
+		if err == nil {
+			return
+		}
+		if exit {
+			fatal("Listener failed", "address", rws.Address, "error", err)
+		}
+		slog.Error("Listener failed", "address", rws.Address, "error", err)
+		running.mu.Lock()
+		if running.rwsMap[rws.Address] == rws {
+			delete(running.rwsMap, rws.Address)
+		}
+		running.mu.Unlock()
+	}()
+}
+
+// apply makes running listeners match config: new addresses are started,
+// missing ones are drained and stopped, the others get new endpoints and
+// settings for new websockets while open websockets on unchanged endpoints
+// continue uninterrupted
+func (running *listeners) apply(config *Config, configFile string, exit bool) {
+	list := config.RWSList(configFile)
+	if config.AdminAddress == "" {
+		admin := config.adminHandler(running)
+		for _, rws := range list {
+			rws.Admin = admin
+		}
+	}
+
+	next := make(map[string]*RWS)
+	for _, rws := range list {
+		next[rws.Address] = rws
+	}
+	running.mu.Lock()
+	stopped := make([]*RWS, 0)
+	for address, rws := range running.rwsMap {
+		if _, exists := next[address]; !exists {
+			slog.Info("Reload: stop listener", "address", address)
+			delete(running.rwsMap, address)
+			stopped = append(stopped, rws)
+		}
+	}
+	for address, rws := range next {
+		if current, exists := running.rwsMap[address]; exists {
+			current.update(rws)
+		} else {
+			if len(running.rwsMap) > 0 || len(stopped) > 0 {
+				slog.Info("Reload: start listener", "address", address)
+			}
+			running.start(rws, exit)
+		}
+	}
+	running.mu.Unlock()
+	go shutdown(stopped, shutdownClose)
+}
+
+// reload re-reads the config file and applies it to running listeners,
+// returns the new config, nil when the file is invalid and everything is
+// left as it is
+func (running *listeners) reload(configFile string) *Config {
+	config, err := ReadConfig(configFile)
+	if err != nil {
+		slog.Error("Reload failed, keeping current configuration", "file", configFile, "error", err)
+		return nil
+	}
+	running.apply(config, configFile, false)
+	slog.Info("Reload done", "file", configFile)
+	return config
+}
+
+// list returns running RWS as slice
+func (running *listeners) list() []*RWS {
+	running.mu.Lock()
+	defer running.mu.Unlock()
+	list := make([]*RWS, 0, len(running.rwsMap))
+	for _, rws := range running.rwsMap {
+		list = append(list, rws)
+	}
+	return list
+}
+
+// watchConfig polls the config file and sends SIGHUP to chSignal when it
+// changes, until chStop is closed
+func watchConfig(configFile string, interval time.Duration, chSignal chan<- os.Signal, chStop <-chan struct{}) {
+	modified := func() time.Time {
+		if info, err := os.Stat(configFile); err == nil {
+			return info.ModTime()
+		}
+		return time.Time{}
+	}
+	last := modified()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-chStop:
+			return
+		case <-ticker.C:
+		}
+		if current := modified(); !current.Equal(last) {
+			last = current
+			select {
+			case chSignal <- syscall.SIGHUP:
+			case <-chStop:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// reloadConfig returns a config of endpoints, each "address path", reading
+// an unreachable redis which is never contacted
+func reloadConfig(endpoints ...string) string {
+	var config strings.Builder
+	config.WriteString("schema.version: \"2.0\"\nshutdown.timeout: 1s\nendpoints:\n")
+	for _, endpoint := range endpoints {
+		address, path, _ := strings.Cut(endpoint, " ")
+		config.WriteString("  - address: " + address + "\n    path.websocket: " + path + "\n    path.test: test-" + path + "\n    connection:\n      address: redis.invalid:6379\n")
+	}
+	return config.String()
+}
+
+// applyFile writes content to filename and applies it to running like a reload does
+func applyFile(t *testing.T, running *listeners, filename string, content string) *Config {
+	t.Helper()
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return running.reload(filename)
+}
+
+// addresses returns sorted addresses of the running listeners
+func addresses(running *listeners) []string {
+	list := make([]string, 0)
+	for _, rws := range running.list() {
+		list = append(list, rws.Address)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func TestListenersApply(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := unixPrefix+filepath.Join(dir, "a.sock"), unixPrefix+filepath.Join(dir, "b.sock"), unixPrefix+filepath.Join(dir, "c.sock")
+	filename := filepath.Join(dir, "config.yaml")
+	running := newListeners()
+	defer func() { shutdown(running.list(), shutdownClose) }()
+
+	if applyFile(t, running, filename, reloadConfig(a+" orders", a+" audit", b+" orders")) == nil {
+		t.Fatal("first config rejected")
+	}
+	if list := addresses(running); !slices.Equal(list, []string{a, b}) {
+		t.Fatalf("listeners %v, expected %v", list, []string{a, b})
+	}
+	first := running.rwsMap[a]
+	stopped := running.rwsMap[b]
+	_, webSockets, _ := first.routes()
+	orders, audit := webSockets["/orders"], webSockets["/audit"]
+	if !first.acquireSession() {
+		t.Fatal("session refused")
+	}
+
+	if applyFile(t, running, filename, reloadConfig(a+" orders", c+" orders")) == nil {
+		t.Fatal("second config rejected")
+	}
+	if list := addresses(running); !slices.Equal(list, []string{a, c}) {
+		t.Errorf("listeners %v, expected %v", list, []string{a, c})
+	}
+	// the kept listener is updated in place, its open session goes on
+	if running.rwsMap[a] != first {
+		t.Error("kept listener replaced")
+	}
+	first.sessions.Done()
+	for deadline := time.Now().Add(time.Second); !first.Bound() && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !first.Bound() || !first.acquireSession() {
+		t.Error("kept listener stopped accepting websockets")
+	} else {
+		first.sessions.Done()
+	}
+	_, webSockets, _ = first.routes()
+	if kept := webSockets["/orders"]; kept == nil || kept == orders || kept.chRemoved != orders.chRemoved {
+		t.Error("kept endpoint does not share chRemoved of the previous version")
+	}
+	select {
+	case <-orders.chRemoved:
+		t.Error("kept endpoint closed")
+	default:
+	}
+	select {
+	case <-audit.chRemoved:
+	default:
+		t.Error("removed endpoint not closed")
+	}
+	if _, exists := webSockets["/audit"]; exists {
+		t.Error("removed endpoint still served")
+	}
+	// the removed listener is drained, the added one accepts connections
+	select {
+	case <-stopped.chDone:
+	case <-time.After(time.Second):
+		t.Error("removed listener not drained")
+	}
+	conn, err := net.Dial("unix", strings.TrimPrefix(c, unixPrefix))
+	if err != nil {
+		t.Errorf("added listener not listening: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// an invalid file leaves everything as it is
+	if applyFile(t, running, filename, "schema.version: \"2.0\"\nendpoints: []\n") != nil {
+		t.Error("invalid config applied")
+	}
+	if list := addresses(running); !slices.Equal(list, []string{a, c}) {
+		t.Errorf("listeners %v after invalid config, expected %v", list, []string{a, c})
+	}
+	if _, webSockets, _ = first.routes(); webSockets["/orders"] == nil {
+		t.Error("endpoint dropped by invalid config")
+	}
+}
+
+func TestRWSUpdate(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeCertificate(t, dir, "main", "rws.example.com")
+	withTLS := func() *listenerTLS {
+		settings, err := newListenerTLS(ConfigListener{TLSCertFile: pair.CertFile, TLSKeyFile: pair.KeyFile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return settings
+	}
+	tests := []struct {
+		name       string
+		current    *listenerTLS
+		next       *listenerTLS
+		keepsPlain bool
+	}{
+		{name: "plain stays plain", keepsPlain: true},
+		{name: "plain to tls needs a restart", next: withTLS(), keepsPlain: true},
+		{name: "tls to plain needs a restart", current: withTLS()},
+		{name: "tls settings are replaced", current: withTLS(), next: withTLS()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			current := &RWS{Address: ":8443", TLS: test.current, WebSockets: map[string]*RWSRedis{"/ws": {chRemoved: make(chan struct{})}}}
+			next := &RWS{Address: ":8443", TLS: test.next, WebSockets: map[string]*RWSRedis{"/ws": {}}}
+			current.update(next)
+			switch {
+			case test.keepsPlain && current.TLS != nil:
+				t.Error("plain listener switched to tls")
+			case test.current != nil && test.next == nil && current.TLS != test.current:
+				t.Error("tls listener switched to plain")
+			case test.current != nil && test.next != nil && current.TLS != test.next:
+				t.Error("tls settings not replaced")
+			}
+		})
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(filename, []byte(reloadConfig(":8800 ws")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	chSignal := make(chan os.Signal, 1)
+	chStop := make(chan struct{})
+	defer close(chStop)
+	go watchConfig(filename, 5*time.Millisecond, chSignal, chStop)
+
+	select {
+	case <-chSignal:
+		t.Fatal("reload without a change")
+	case <-time.After(30 * time.Millisecond):
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case signal := <-chSignal:
+		if signal != syscall.SIGHUP {
+			t.Errorf("signal %v, expected %v", signal, syscall.SIGHUP)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reload after the file changed")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// replayPage entries read by one XRANGE of a replay
+const replayPage = 100
+
+// errReplayFinished reported by the stream reader once a replay without live tailing is done
+var errReplayFinished = errors.New("replay finished")
+
+// replaySettings query parameters of replay mode
+type replaySettings struct {
+	from  string
+	to    string
+	speed float64 // 0 replays as fast as possible
+	live  bool
+}
+
+// parseReplay returns replay settings of the query, nil without replay.from and replay.to
+func parseReplay(query url.Values) (*replaySettings, error) {
+	if !query.Has("replay.from") && !query.Has("replay.to") {
+		return nil, nil
+	}
+	replay := &replaySettings{speed: 1}
+	var err error
+	if replay.from, err = replayBound(query.Get("replay.from"), "-"); err != nil {
+		return nil, fmt.Errorf("invalid replay.from: %v", err)
+	}
+	if replay.to, err = replayBound(query.Get("replay.to"), "+"); err != nil {
+		return nil, fmt.Errorf("invalid replay.to: %v", err)
+	}
+	if speed := query.Get("replay.speed"); speed == "max" {
+		replay.speed = 0
+	} else if speed != "" {
+		if replay.speed, err = strconv.ParseFloat(strings.TrimSuffix(speed, "x"), 64); err != nil || replay.speed <= 0 {
+			return nil, fmt.Errorf("invalid replay.speed [%s], expected a positive factor like 10x or max", query.Get("replay.speed"))
+		}
+	}
+	switch then := query.Get("replay.then"); then {
+	case "", "close":
+	case "live":
+		replay.live = true
+	default:
+		return nil, fmt.Errorf("invalid replay.then [%s], expected close or live", then)
+	}
+	return replay, nil
+}
+
+// replayBound returns XRANGE bound of an entry ID, a millisecond timestamp or an RFC 3339 time
+func replayBound(value string, defaultValue string) (string, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	if value == "-" || value == "+" || rexStreamID.MatchString(value) {
+		return value, nil
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("[%s] is neither an entry ID nor an RFC 3339 time", value)
+	}
+	return strconv.FormatInt(at.UnixMilli(), 10), nil
+}
+
+// entryTime returns time embedded in an entry ID
+func entryTime(id string) (time.Time, bool) {
+	ms, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// lessID reports whether entry ID a is before b
+func lessID(a string, b string) bool {
+	aMS, aSeq, _ := strings.Cut(a, "-")
+	bMS, bSeq, _ := strings.Cut(b, "-")
+	if aMS != bMS {
+		return len(aMS) < len(bMS) || len(aMS) == len(bMS) && aMS < bMS
+	}
+	return len(aSeq) < len(bSeq) || len(aSeq) == len(bSeq) && aSeq < bSeq
+}
+
+// replayCursor pages of XRANGE of a replayed stream
+type replayCursor struct {
+	stream   string
+	messages []redis.XMessage
+	start    string
+	done     bool
+}
+
+// replay delivers entries of the read streams between replay.from and
+// replay.to in order of their IDs, paced by the times embedded in them,
+// entries stay in redis, returns false when run has to stop
+func (reader *streamReader) replay(ctx context.Context) bool {
+	cursors := make([]*replayCursor, len(reader.cursor.names))
+	for i, stream := range reader.cursor.names {
+		cursors[i] = &replayCursor{stream: stream, start: reader.replaying.from}
+		// live delivery after the replay starts with entries added from now
+		// on, entries already in the stream past replay.to are left alone
+		if reader.replaying.live && reader.source.Group == "" {
+			id, err := startID(ctx, reader.client, stream, "$")
+			if err != nil {
+				if ctx.Err() == nil {
+					reader.logger.Error("Can't read last entry of stream", "stream", stream, "error", err)
+				}
+				reader.fail(ctx, err)
+				return false
+			}
+			reader.cursor.set(stream, id)
+		}
+	}
+	var origin, wallOrigin time.Time
+	for {
+		// Commands of the client are applied between entries, pause holds the replay
+		paused := false
+		for {
+			select {
+			case request := <-reader.chCommand:
+				if !reader.reply(ctx, reader.handle(ctx, request)) {
+					return false
+				}
+				paused = paused || reader.paused
+				continue
+			default:
+			}
+			if !reader.paused {
+				break
+			}
+			select {
+			case request := <-reader.chCommand:
+				if !reader.reply(ctx, reader.handle(ctx, request)) {
+					return false
+				}
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if paused {
+			// timing starts over after a pause
+			origin = time.Time{}
+		}
+
+		var next *replayCursor
+		for _, cursor := range cursors {
+			if !reader.cursor.has(cursor.stream) {
+				continue
+			}
+			if len(cursor.messages) == 0 && !cursor.done {
+				messages, err := reader.client.XRangeN(ctx, cursor.stream, cursor.start, reader.replaying.to, replayPage).Result()
+				if err != nil {
+					if ctx.Err() == nil {
+						reader.logger.Error("Can't replay stream", "stream", cursor.stream, "error", err)
+					}
+					reader.fail(ctx, err)
+					return false
+				}
+				cursor.messages = messages
+				cursor.done = len(messages) < replayPage
+				if len(messages) > 0 {
+					cursor.start = "(" + Last(messages).ID
+				}
+			}
+			if len(cursor.messages) > 0 && (next == nil || lessID(cursor.messages[0].ID, next.messages[0].ID)) {
+				next = cursor
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		message := next.messages[0]
+		next.messages = next.messages[1:]
+		if at, ok := entryTime(message.ID); ok && reader.replaying.speed > 0 {
+			if origin.IsZero() {
+				origin, wallOrigin = at, time.Now()
+			}
+			wait := time.Until(wallOrigin.Add(time.Duration(float64(at.Sub(origin)) / reader.replaying.speed)))
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return false
+				}
+			}
+		}
+		select {
+		case reader.chStream <- streamBatch{XStream: redis.XStream{Stream: next.stream, Messages: []redis.XMessage{message}}, replayed: true}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	reader.logger.Info("Replay finished")
+	if !reader.replaying.live {
+		reader.fail(ctx, errReplayFinished)
+		return false
+	}
+	return reader.reply(ctx, controlMessage{Event: "replay.finished"})
+}
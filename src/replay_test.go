@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// replayRedis answers XRANGE with entries of s1 between its bounds and
+// XREVRANGE with the last entry, which came after replay.to
+func replayRedis(t *testing.T) (*redis.Client, *fakeRedis) {
+	t.Helper()
+	entries := []redis.XMessage{{ID: "10-0"}, {ID: "20-0"}, {ID: "30-0"}, {ID: "50-0"}}
+	client, fake := newFakeRedis(func(cmd redis.Cmder) error {
+		messagesCmd, ok := cmd.(*redis.XMessageSliceCmd)
+		if !ok {
+			return fmt.Errorf("unexpected command %v", cmd.Args())
+		}
+		switch cmd.Name() {
+		case "xrevrange":
+			messagesCmd.SetVal(entries[len(entries)-1:])
+		case "xrange":
+			start, end := fmt.Sprint(cmd.Args()[2]), fmt.Sprint(cmd.Args()[3])
+			messagesCmd.SetVal(slices.DeleteFunc(slices.Clone(entries), func(message redis.XMessage) bool {
+				return start != "-" && (start[0] == '(' && !lessID(start[1:], message.ID) || start[0] != '(' && lessID(message.ID, start)) ||
+					end != "+" && lessID(end, message.ID)
+			}))
+		}
+		return nil
+	})
+	t.Cleanup(func() { client.Close() })
+	return client, fake
+}
+
+func TestReplayThenLive(t *testing.T) {
+	tests := []struct {
+		name     string
+		replay   replaySettings
+		source   ConfigSource
+		replayed []string
+		// cursor of s1 once the replay is done, "" when the websocket closes
+		live string
+	}{
+		{name: "live starts at the last entry", replay: replaySettings{from: "-", to: "20-0", live: true}, replayed: []string{"10-0", "20-0"}, live: "50-0"},
+		{name: "whole stream", replay: replaySettings{from: "-", to: "+", live: true}, replayed: []string{"10-0", "20-0", "30-0", "50-0"}, live: "50-0"},
+		{name: "group keeps its position", replay: replaySettings{from: "15-0", to: "30-0", live: true}, source: ConfigSource{Group: "g1"}, replayed: []string{"20-0", "30-0"}, live: "0"},
+		{name: "close", replay: replaySettings{from: "-", to: "20-0"}, replayed: []string{"10-0", "20-0"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, _ := replayRedis(t)
+			sess := testSession(t, "replay-"+t.Name(), "rws.local:8800/ws")
+			reader := newStreamReader(sess, &RWSRedis{Source: test.source}, sess.id, client, redis.Options{}, discardLogger)
+			reader.cursor.add("s1", "0", "s1")
+			reader.replaying = &test.replay
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			chDone := make(chan bool, 1)
+			go func() { chDone <- reader.replay(ctx) }()
+			replayed := make([]string, 0)
+			for done := false; !done; {
+				select {
+				case batch := <-reader.chStream:
+					if !batch.replayed {
+						t.Errorf("entry %s not marked as replayed", batch.Messages[0].ID)
+					}
+					replayed = append(replayed, batch.Messages[0].ID)
+				case message := <-reader.chReply:
+					if message.Event != "replay.finished" {
+						t.Errorf("reply %+v", message)
+					}
+				case err := <-reader.chError:
+					if err != errReplayFinished {
+						t.Errorf("error %v", err)
+					}
+				case live := <-chDone:
+					if live != (test.live != "") {
+						t.Errorf("replay returned %v", live)
+					}
+					done = true
+				case <-ctx.Done():
+					t.Fatal("replay did not finish")
+				}
+			}
+			if !slices.Equal(replayed, test.replayed) {
+				t.Errorf("replayed %v, expected %v", replayed, test.replayed)
+			}
+			if test.live != "" && reader.cursor.ids["s1"] != test.live {
+				t.Errorf("live delivery starts after %s, expected %s", reader.cursor.ids["s1"], test.live)
+			}
+		})
+	}
+}
+
+func TestLessID(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{a: "1-0", b: "2-0", less: true},
+		{a: "2-0", b: "1-0", less: false},
+		{a: "1-0", b: "1-0", less: false},
+		{a: "1-1", b: "1-2", less: true},
+		{a: "1-2", b: "1-10", less: true},
+		{a: "1-10", b: "1-2", less: false},
+		{a: "9-5", b: "10-0", less: true},
+		{a: "10-0", b: "9-5", less: false},
+		{a: "1700000000000-0", b: "1700000000001-0", less: true},
+		{a: "5", b: "5-0", less: true},
+		{a: "5-0", b: "5", less: false},
+		{a: "0", b: "1-0", less: true},
+	}
+	for _, test := range tests {
+		if less := lessID(test.a, test.b); less != test.less {
+			t.Errorf("lessID(%q, %q) = %v, expected %v", test.a, test.b, less, test.less)
+		}
+	}
+}
+
+func TestParseReplay(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		replay *replaySettings
+		err    string
+	}{
+		{name: "no replay", query: "topics=s1"},
+		{name: "defaults", query: "replay.from=", replay: &replaySettings{from: "-", to: "+", speed: 1}},
+		{name: "entry ids", query: "replay.from=1-0&replay.to=1700000000000-5", replay: &replaySettings{from: "1-0", to: "1700000000000-5", speed: 1}},
+		{name: "millisecond timestamps", query: "replay.from=1000&replay.to=2000", replay: &replaySettings{from: "1000", to: "2000", speed: 1}},
+		{name: "rfc 3339 times", query: "replay.from=2023-11-14T22:13:20Z&replay.to=2023-11-14T22:13:21%2B01:00", replay: &replaySettings{from: "1700000000000", to: "1699996401000", speed: 1}},
+		{name: "open bounds", query: "replay.from=-&replay.to=%2B", replay: &replaySettings{from: "-", to: "+", speed: 1}},
+		{name: "speed", query: "replay.to=5&replay.speed=10x", replay: &replaySettings{from: "-", to: "5", speed: 10}},
+		{name: "fractional speed", query: "replay.to=5&replay.speed=0.5", replay: &replaySettings{from: "-", to: "5", speed: 0.5}},
+		{name: "max speed", query: "replay.to=5&replay.speed=max", replay: &replaySettings{from: "-", to: "5"}},
+		{name: "then live", query: "replay.to=5&replay.then=live", replay: &replaySettings{from: "-", to: "5", speed: 1, live: true}},
+		{name: "then close", query: "replay.to=5&replay.then=close", replay: &replaySettings{from: "-", to: "5", speed: 1}},
+		{name: "malformed from", query: "replay.from=yesterday", err: "invalid replay.from: [yesterday] is neither an entry ID nor an RFC 3339 time"},
+		{name: "malformed id", query: "replay.from=1-", err: "invalid replay.from: [1-] is neither"},
+		{name: "date without time", query: "replay.to=2023-11-14", err: "invalid replay.to: [2023-11-14] is neither"},
+		{name: "zero speed", query: "replay.to=5&replay.speed=0x", err: "invalid replay.speed [0x]"},
+		{name: "negative speed", query: "replay.to=5&replay.speed=-2", err: "invalid replay.speed [-2]"},
+		{name: "speed not a number", query: "replay.to=5&replay.speed=fast", err: "invalid replay.speed [fast]"},
+		{name: "unknown then", query: "replay.to=5&replay.then=loop", err: "invalid replay.then [loop], expected close or live"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replay, err := parseReplay(query)
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Errorf("error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%+v", replay) != fmt.Sprintf("%+v", test.replay) {
+				t.Errorf("replay %+v, expected %+v", replay, test.replay)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+const (
+	// inheritedEnv addresses of listening sockets handed over by the process
+	// restarting rws, one per line, in order of their file descriptors from 3
+	inheritedEnv = "RWS_INHERITED_LISTENERS"
+	// readyEnv file descriptor the new process reports readiness on
+	readyEnv = "RWS_READY_FD"
+	// restartTimeout how long to wait for the new process to bind its listeners
+	restartTimeout = 30 * time.Second
+)
+
+// restartClose close frame of websockets open when the server restarts, 1012
+// (Service Restart) asks clients to reconnect
+var restartClose = sessionClose{code: ws.StatusCode(1012), reason: "server restart"}
+
+// restart starts a new process of the running executable with the same
+// arguments and hands the listening sockets of list and the admin listener
+// bound to adminAddress over to it, returns pid of the new process once it is
+// ready, the old one keeps serving when it fails
+func restart(list []*RWS, adminAddress string, admin net.Listener) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	listeners := make([]net.Listener, 0, len(list)+1)
+	addresses := make([]string, 0, len(list)+1)
+	for _, rws := range list {
+		if listener := rws.boundListener(); listener != nil {
+			listeners = append(listeners, listener)
+			addresses = append(addresses, rws.Address)
+		}
+	}
+	if admin != nil {
+		listeners = append(listeners, admin)
+		addresses = append(addresses, adminAddress)
+	}
+
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i, listener := range listeners {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("can't hand over listener %s of type %T", addresses[i], listener)
+		}
+		file, err := filer.File()
+		if err != nil {
+			return 0, fmt.Errorf("can't hand over listener %s: %v", addresses[i], err)
+		}
+		files = append(files, file)
+	}
+	chReady, ready, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer chReady.Close()
+	files = append(files, ready)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), handoffEnv(addresses)...)
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	// the new process holds the write end now, EOF means it exited
+	ready.Close()
+	files = files[:len(files)-1]
+	go cmd.Wait()
+
+	chResult := make(chan error, 1)
+	go func() {
+		message, err := io.ReadAll(chReady)
+		if err == nil && string(message) != "ready" {
+			err = errors.New("new process exited before it was ready")
+		}
+		chResult <- err
+	}()
+	select {
+	case err = <-chResult:
+	case <-time.After(restartTimeout):
+		err = fmt.Errorf("new process not ready within %v", restartTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return 0, err
+	}
+
+	// unix sockets belong to the new process now, closing them here must not remove them
+	for _, listener := range listeners {
+		if unix, ok := listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process.Pid, nil
+}
+
+// handoffEnv returns environment of the new process for listeners bound to
+// addresses passed as files from fd 3 on, followed by the readiness pipe
+func handoffEnv(addresses []string) []string {
+	return []string{
+		inheritedEnv + "=" + strings.Join(addresses, "\n"),
+		readyEnv + "=" + strconv.Itoa(listenFDsStart+len(addresses)),
+	}
+}
+
+// inheritedListeners returns sockets handed over by the process restarting rws
+func inheritedListeners() []activatedSocket {
+	inherited := os.Getenv(inheritedEnv)
+	if inherited == "" {
+		return nil
+	}
+	os.Unsetenv(inheritedEnv)
+	addresses := strings.Split(inherited, "\n")
+	sockets := make([]activatedSocket, 0, len(addresses))
+	for i, address := range addresses {
+		file := os.NewFile(uintptr(listenFDsStart+i), address)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			slog.Warn("Can't use inherited socket", "address", address, "error", err)
+			continue
+		}
+		sockets = append(sockets, activatedSocket{address: address, listener: listener})
+	}
+	return sockets
+}
+
+// reportReady tells the process restarting rws that the listeners are bound
+func reportReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(readyEnv)
+	file := os.NewFile(uintptr(fd), "ready")
+	defer file.Close()
+	if _, err := file.WriteString("ready"); err != nil {
+		slog.Warn("Can't report readiness to the old process", "error", err)
+	}
+}
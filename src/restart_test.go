@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// inheritedHelperEnv set for the test binary started by TestInheritedListeners
+const inheritedHelperEnv = "RWS_TEST_INHERITED_HELPER"
+
+func TestHandoffEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		env       []string
+	}{
+		{
+			name:      "listeners",
+			addresses: []string{":8800", "unix:/run/rws.sock", "127.0.0.1:9100"},
+			env:       []string{inheritedEnv + "=:8800\nunix:/run/rws.sock\n127.0.0.1:9100", readyEnv + "=6"},
+		},
+		{
+			name: "no listener",
+			env:  []string{inheritedEnv + "=", readyEnv + "=3"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if env := handoffEnv(test.addresses); !slices.Equal(env, test.env) {
+				t.Errorf("env %q, expected %q", env, test.env)
+			}
+		})
+	}
+}
+
+// fileOf returns a duplicate file of listener
+func fileOf(t *testing.T, listener net.Listener) *os.File {
+	t.Helper()
+	file, err := listener.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func TestInheritedListeners(t *testing.T) {
+	if os.Getenv(inheritedHelperEnv) != "" {
+		// the new process started below
+		for _, socket := range inheritedListeners() {
+			fmt.Printf("socket %s %s\n", socket.address, socket.listener.Addr())
+		}
+		fmt.Printf("env %q\n", os.Getenv(inheritedEnv))
+		reportReady()
+		return
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	path := filepath.Join(t.TempDir(), "rws.sock")
+	unix, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+	notSocket, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notSocket.Close()
+	chReady, ready, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chReady.Close()
+
+	addresses := []string{tcp.Addr().String(), "unix:/dev/null", unixPrefix + path}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInheritedListeners$")
+	cmd.ExtraFiles = []*os.File{fileOf(t, tcp), notSocket, fileOf(t, unix), ready}
+	cmd.Env = append(append(os.Environ(), inheritedHelperEnv+"=1"), handoffEnv(addresses)...)
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, io.Discard
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// the new process holds the write end now, EOF means it exited
+	ready.Close()
+	message, err := io.ReadAll(chReady)
+	if err != nil || string(message) != "ready" {
+		t.Errorf("readiness %q %v, expected ready", message, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, 0)
+	for _, line := range strings.Split(output.String(), "\n") {
+		if strings.HasPrefix(line, "socket ") || strings.HasPrefix(line, "env ") {
+			lines = append(lines, line)
+		}
+	}
+	// the file which is no socket is skipped, the others keep their address
+	expected := []string{
+		"socket " + tcp.Addr().String() + " " + tcp.Addr().String(),
+		"socket " + unixPrefix + path + " " + path,
+		`env ""`,
+	}
+	if !slices.Equal(lines, expected) {
+		t.Errorf("new process got\n%s\nexpected\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+}
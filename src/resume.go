@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaults and limits of resume tokens
+const (
+	defaultResumeInterval = 10 * time.Second
+	defaultResumeTTL      = 24 * time.Hour
+	minResumeSecretLength = 16
+)
+
+// resumeSettings signing key and timing of resume tokens, disabled without key
+type resumeSettings struct {
+	key      []byte
+	interval time.Duration
+	ttl      time.Duration
+}
+
+// resumeState content of a resume token
+type resumeState struct {
+	Endpoint  string            `json:"e"`
+	Positions map[string]string `json:"p"`
+	Issued    int64             `json:"t"`
+}
+
+// resumeSettings returns settings of resume tokens of config
+func (config *Config) resumeSettings() resumeSettings {
+	settings := resumeSettings{
+		key:      []byte(config.ResumeSecret),
+		interval: config.ResumeInterval,
+		ttl:      config.ResumeTTL,
+	}
+	if settings.interval <= 0 {
+		settings.interval = defaultResumeInterval
+	}
+	if settings.ttl <= 0 {
+		settings.ttl = defaultResumeTTL
+	}
+	return settings
+}
+
+// enabled reports whether resume tokens are handed out and accepted
+func (settings resumeSettings) enabled() bool {
+	return len(settings.key) > 0
+}
+
+// sign returns token of positions delivered by endpoint
+func (settings resumeSettings) sign(endpoint string, positions map[string]string, now time.Time) string {
+	payload, _ := json.Marshal(resumeState{Endpoint: endpoint, Positions: positions, Issued: now.Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(settings.mac(encoded))
+}
+
+// verify returns positions of a token signed for endpoint and not older than ttl
+func (settings resumeSettings) verify(token string, endpoint string, now time.Time) (map[string]string, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, errors.New("malformed token")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, settings.mac(encoded)) {
+		return nil, errors.New("bad signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	var state resumeState
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return nil, errors.New("malformed token")
+	}
+	if state.Endpoint != endpoint {
+		return nil, fmt.Errorf("token of endpoint %s", state.Endpoint)
+	}
+	if issued := time.Unix(state.Issued, 0); now.Sub(issued) > settings.ttl {
+		return nil, fmt.Errorf("token expired at %s", issued.Add(settings.ttl).Format(time.RFC3339))
+	}
+	return state.Positions, nil
+}
+
+func (settings resumeSettings) mac(encoded string) []byte {
+	mac := hmac.New(sha256.New, settings.key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// resumeIssuer hands out resume tokens of a session when its positions changed
+type resumeIssuer struct {
+	settings resumeSettings
+	sess     *session
+
+	mu     sync.Mutex
+	issued map[string]string
+}
+
+// next returns token message of the current positions, false when they are
+// the ones of the last token and force is not set
+func (issuer *resumeIssuer) next(force bool) (controlMessage, bool) {
+	positions := issuer.sess.info().Positions
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	if !force && maps.Equal(positions, issuer.issued) {
+		return controlMessage{}, false
+	}
+	issuer.issued = positions
+	token := issuer.settings.sign(issuer.sess.endpoint, positions, time.Now())
+	return controlMessage{Event: "resume", Token: token}, true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeTokenRoundTrip(t *testing.T) {
+	settings := (&Config{ResumeSecret: "0123456789abcdef", ResumeTTL: time.Hour}).resumeSettings()
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name      string
+		positions map[string]string
+		verified  time.Time
+	}{
+		{name: "one stream", positions: map[string]string{"s1": "1700000000000-0"}, verified: now},
+		{name: "several streams", positions: map[string]string{"s1": "1-0", "orders:eu": "1700000000000-12", "s3": "0"}, verified: now.Add(time.Minute)},
+		{name: "no positions", positions: map[string]string{}, verified: now},
+		{name: "at ttl", positions: map[string]string{"s1": "1-0"}, verified: now.Add(time.Hour)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := settings.sign("rws.local:8800/ws", test.positions, now)
+			positions, err := settings.verify(token, "rws.local:8800/ws", test.verified)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(positions, test.positions) {
+				t.Errorf("positions %v, expected %v", positions, test.positions)
+			}
+		})
+	}
+}
+
+func TestResumeTokenRejected(t *testing.T) {
+	settings := (&Config{ResumeSecret: "0123456789abcdef", ResumeTTL: time.Hour}).resumeSettings()
+	other := (&Config{ResumeSecret: "fedcba9876543210"}).resumeSettings()
+	defaults := settingsWithoutTTL()
+	now := time.Unix(1700000000, 0)
+	const endpoint = "rws.local:8800/ws"
+	token := settings.sign(endpoint, map[string]string{"s1": "5-0"}, now)
+	encoded, signature, _ := strings.Cut(token, ".")
+
+	// tampered payload keeps the signature of the original one
+	forged := strings.Replace(mustDecode(t, encoded), `"5-0"`, `"0"`, 1)
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(forged)) + "." + signature
+	// a flipped bit of the signature
+	flipped := []byte(mustDecode(t, signature))
+	flipped[0] ^= 1
+
+	tests := []struct {
+		name     string
+		verifier *resumeSettings
+		token    string
+		endpoint string
+		verified time.Time
+		err      string
+	}{
+		{name: "tampered positions", token: tampered, endpoint: endpoint, verified: now, err: "bad signature"},
+		{name: "tampered signature", token: encoded + "." + base64.RawURLEncoding.EncodeToString(flipped), endpoint: endpoint, verified: now, err: "bad signature"},
+		{name: "signed with another secret", token: other.sign(endpoint, map[string]string{"s1": "5-0"}, now), endpoint: endpoint, verified: now, err: "bad signature"},
+		{name: "signature not base64", token: encoded + ".!!", endpoint: endpoint, verified: now, err: "bad signature"},
+		{name: "no signature", token: encoded, endpoint: endpoint, verified: now, err: "malformed token"},
+		{name: "empty", token: "", endpoint: endpoint, verified: now, err: "malformed token"},
+		{name: "other endpoint", token: token, endpoint: "rws.local:8800/other", verified: now, err: "token of endpoint " + endpoint},
+		{name: "expired", token: token, endpoint: endpoint, verified: now.Add(time.Hour + time.Second), err: "token expired at"},
+		{name: "expired with default ttl", verifier: &defaults, token: defaults.sign(endpoint, nil, now), endpoint: endpoint, verified: now.Add(defaultResumeTTL + time.Second), err: "token expired at"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := settings
+			if test.verifier != nil {
+				verifier = *test.verifier
+			}
+			positions, err := verifier.verify(test.token, test.endpoint, test.verified)
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("error %v, expected %q", err, test.err)
+			}
+			if positions != nil {
+				t.Errorf("positions %v of a rejected token", positions)
+			}
+		})
+	}
+}
+
+func TestResumeSettings(t *testing.T) {
+	if (&Config{}).resumeSettings().enabled() {
+		t.Error("enabled without resume.secret")
+	}
+	settings := settingsWithoutTTL()
+	if !settings.enabled() || settings.interval != defaultResumeInterval || settings.ttl != defaultResumeTTL {
+		t.Errorf("settings %+v, expected defaults", settings)
+	}
+}
+
+// settingsWithoutTTL returns resume settings with a secret and default timing
+func settingsWithoutTTL() resumeSettings {
+	return (&Config{ResumeSecret: "0123456789abcdef"}).resumeSettings()
+}
+
+// mustDecode decodes unpadded URL base64
+func mustDecode(t *testing.T, encoded string) string {
+	t.Helper()
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
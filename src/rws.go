@@ -2,40 +2,70 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsflate"
-	"github.com/gobwas/ws/wsutil"
 	"github.com/redis/go-redis/v9"
 )
 
 // RWS Redis to websocket config
 type RWS struct {
-	Address     string
-	TLSCertFile string
-	TLSKeyFile  string
-	SourceFile  string
-	WebSockets  map[string]*RWSRedis
-	TestUIs     map[string]*string
+	Address string
+	// TLS settings of the listener, nil serves plain HTTP
+	TLS *listenerTLS
+	// SocketMode and SocketGroup of a unix domain socket, applied when it is created
+	SocketMode  os.FileMode
+	SocketGroup string
+	// Proxy trusted reverse proxies and public base URL, nil without them
+	Proxy           *proxySettings
+	SourceFile      string
+	ShutdownTimeout time.Duration
+	WebSockets      map[string]*RWSRedis
+	TestUIs         map[string]*string
+	Admin           *http.ServeMux
+
+	mu       sync.Mutex
+	server   *http.Server
+	listener net.Listener
+	tlsErr   error
+	bound    bool
+	closing  bool
+	// draining close frame sent to open websockets once chDone is closed,
+	// drainCtx bounds how long they may take
+	draining sessionClose
+	drainCtx context.Context
+	chDone   chan struct{}
+	sessions sync.WaitGroup
 }
 
 // RWSRedis Redis config
 type RWSRedis struct {
-	RedisClientConfig        map[string]interface{}
-	RedisDefaultStreamConfig map[string]interface{}
-	RedisStreams             []string
-	MessageType              string
-	Compression              bool
-	OnCloseKey               string
-	OnCloseValue             string
+	Connection ConfigConnection
+	Source     ConfigSource
+	Delivery   ConfigDelivery
+
+	resume resumeSettings
+	// lifecycle hooks of delivery.on.open and delivery.on.close
+	onOpen  []*hook
+	onClose []*hook
+	// sentinelWhen compiled delivery.sentinel.when, nil without it
+	sentinelWhen *sentinelPredicate
+
+	// chRemoved closed when the endpoint is dropped by a config reload,
+	// shared by every version of the endpoint kept across reloads
+	chRemoved chan struct{}
 }
 
 type TemplateInfo struct {
@@ -68,12 +98,202 @@ var mimeTypes = map[string]string{
 // 	return val
 // }
 
-// Start start websocket and start consuming from Redis stream(s)
-func (rws *RWS) Start() error {
-	if rws.TLSCertFile != "" {
-		return http.ListenAndServeTLS(rws.Address, rws.TLSCertFile, rws.TLSKeyFile, rws)
+// Listen binds the address of rws, nil once shutdown started
+func (rws *RWS) Listen() (net.Listener, error) {
+	rws.mu.Lock()
+	closing, tlsErr := rws.closing, rws.tlsErr
+	rws.mu.Unlock()
+	if closing {
+		return nil, nil
 	}
-	return http.ListenAndServe(rws.Address, rws)
+	if tlsErr != nil {
+		return nil, tlsErr
+	}
+	return listen(rws.Address, rws.SocketMode, rws.SocketGroup)
+}
+
+// Serve accepts websockets on listener until shutdown
+func (rws *RWS) Serve(listener net.Listener) error {
+	rws.mu.Lock()
+	if rws.closing {
+		rws.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	rws.server = &http.Server{Addr: rws.Address, Handler: rws}
+	if rws.TLS != nil {
+		// settings are looked up per handshake, so a reload replaces them
+		rws.server.TLSConfig = &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return rws.currentTLS().config(), nil
+			},
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return rws.currentTLS().certificate(hello)
+			},
+		}
+	}
+	server := rws.server
+	rws.bound = true
+	rws.listener = listener
+	rws.mu.Unlock()
+	defer func() {
+		rws.mu.Lock()
+		rws.bound = false
+		rws.listener = nil
+		rws.mu.Unlock()
+	}()
+
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// shutdownClose close frame of websockets open when the server shuts down
+var shutdownClose = sessionClose{code: ws.StatusGoingAway, reason: "server shutdown"}
+
+// Drain stops accepting new websockets, asks the open ones to close with
+// closing and waits for them to drain or for ctx to expire
+func (rws *RWS) Drain(ctx context.Context, closing sessionClose) error {
+	rws.mu.Lock()
+	if !rws.closing {
+		rws.closing = true
+		rws.draining = closing
+		rws.drainCtx = ctx
+		close(rws.chDone)
+	}
+	server := rws.server
+	rws.mu.Unlock()
+
+	var err error
+	if server != nil {
+		err = server.Shutdown(ctx)
+	}
+
+	chDrained := make(chan struct{})
+	go func() {
+		rws.sessions.Wait()
+		close(chDrained)
+	}()
+	select {
+	case <-chDrained:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// routes returns current test UI, websocket and admin endpoints, a reload replaces
+// the maps instead of changing them so the result is safe to read unlocked
+func (rws *RWS) routes() (map[string]*string, map[string]*RWSRedis, *http.ServeMux) {
+	rws.mu.Lock()
+	defer rws.mu.Unlock()
+	return rws.TestUIs, rws.WebSockets, rws.Admin
+}
+
+// update applies endpoints of a freshly read RWS with the same address,
+// websockets of removed endpoints are closed, all others keep running
+func (rws *RWS) update(next *RWS) {
+	rws.mu.Lock()
+	removed := make([]string, 0)
+	for path, rwsConfig := range rws.WebSockets {
+		if nextConfig, exists := next.WebSockets[path]; exists {
+			nextConfig.chRemoved = rwsConfig.chRemoved
+		} else {
+			removed = append(removed, path)
+			close(rwsConfig.chRemoved)
+		}
+	}
+	rws.WebSockets = next.WebSockets
+	rws.TestUIs = next.TestUIs
+	rws.Admin = next.Admin
+	rws.SourceFile = next.SourceFile
+	rws.ShutdownTimeout = next.ShutdownTimeout
+	rws.Proxy = next.Proxy
+	// certificates and settings of a TLS listener are replaced, switching between TLS and plain HTTP needs a restart
+	tlsChanged := (rws.TLS == nil) != (next.TLS == nil)
+	if rws.TLS != nil && next.TLS != nil {
+		rws.TLS = next.TLS
+	}
+	rws.mu.Unlock()
+
+	if len(removed) > 0 {
+		slog.Info("Reload: removed endpoints", "address", rws.Address, "paths", removed)
+	}
+	if tlsChanged {
+		slog.Warn("Reload: tls settings changed, restart rws to apply them", "address", rws.Address)
+	}
+}
+
+// boundListener returns the listening socket, nil when not bound
+func (rws *RWS) boundListener() net.Listener {
+	rws.mu.Lock()
+	defer rws.mu.Unlock()
+	return rws.listener
+}
+
+// drainClose returns close frame of open websockets once shutdown started
+func (rws *RWS) drainClose() sessionClose {
+	rws.mu.Lock()
+	defer rws.mu.Unlock()
+	return rws.draining
+}
+
+// cleanupContext returns ctx for the cleanup of a closed websocket, during a
+// drain it is cancelled as well once the drain's context is done
+func (rws *RWS) cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	rws.mu.Lock()
+	drainCtx := rws.drainCtx
+	rws.mu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	if drainCtx == nil {
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(drainCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// currentProxy returns trusted proxies and public base URL of the listener
+func (rws *RWS) currentProxy() *proxySettings {
+	rws.mu.Lock()
+	defer rws.mu.Unlock()
+	return rws.Proxy
+}
+
+// currentTLS returns TLS settings of the listener
+func (rws *RWS) currentTLS() *listenerTLS {
+	rws.mu.Lock()
+	defer rws.mu.Unlock()
+	return rws.TLS
+}
+
+// Bound reports whether the listener is bound and accepting websockets
+func (rws *RWS) Bound() bool {
+	rws.mu.Lock()
+	defer rws.mu.Unlock()
+	return rws.bound && !rws.closing
+}
+
+// acquireSession registers a new websocket session, returns false once shutdown started
+func (rws *RWS) acquireSession() bool {
+	rws.mu.Lock()
+	defer rws.mu.Unlock()
+	if rws.closing {
+		return false
+	}
+	rws.sessions.Add(1)
+	return true
 }
 
 // config["debug"] = "protocol"
@@ -90,9 +310,12 @@ func (rws *RWS) Start() error {
 // }
 // config["default.stream.config"] = defStream
 
-func redisOptionsFromRwsConfiguration(redisClientConfig map[string]interface{}, query url.Values) redis.Options {
+func redisOptionsFromRwsConfiguration(connection ConfigConnection, query url.Values) redis.Options {
 	return redis.Options{
-		Addr: fmt.Sprint(redisClientConfig["metadata.broker.list"]),
+		Addr:     connection.Address,
+		Username: connection.Username,
+		Password: connection.Password,
+		DB:       connection.DB,
 	}
 }
 
@@ -117,6 +340,21 @@ func onCloseKeyAndValue(query url.Values, defaultOnCloseKey string, defaultOnClo
 }
 
 func (rws *RWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	testUIs, webSockets, admin := rws.routes()
+	proxy := rws.currentProxy()
+	proxied := proxy.trusts(r)
+	if proxied {
+		// behind a trusted proxy the client is known from its headers
+		if client := proxy.clientAddress(r); client != "" {
+			r.RemoteAddr = client
+		}
+	}
+	if admin != nil {
+		if handler, pattern := admin.Handler(r); pattern != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+	}
 	submatch := rexStatic.FindStringSubmatch(r.URL.Path)
 	if len(submatch) > 0 {
 		// serve static files
@@ -124,7 +362,7 @@ func (rws *RWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if testUIPath == "" {
 			testUIPath = "/"
 		}
-		if _, exists := rws.TestUIs[testUIPath]; exists {
+		if _, exists := testUIs[testUIPath]; exists {
 			if payload, err := FSByte(localStatic, submatch[2]); err == nil {
 				var mime = "application/octet-stream"
 				if m, ok := mimeTypes[submatch[3]]; ok {
@@ -136,214 +374,18 @@ func (rws *RWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
-	} else if wsPath, exists := rws.TestUIs[r.URL.Path]; exists {
+	} else if wsPath, exists := testUIs[r.URL.Path]; exists {
 		html, err := FSString(localStatic, "/static/test.html")
 		if err == nil {
-			wsURL := "ws://" + r.Host + *wsPath
-			if rws.TLSCertFile != "" {
-				wsURL = "wss://" + r.Host + *wsPath
-			}
+			wsURL := proxy.websocketURL(r, proxied, *wsPath)
 			if testTemplate == nil || localStatic {
 				testTemplate = template.Must(template.New("").Parse(html))
 			}
 			testTemplate.Execute(w, TemplateInfo{strings.TrimRight(r.URL.Path, "/"), wsURL})
 		}
 		return
-	} else if rwsConfig, exists := rws.WebSockets[r.URL.Path]; exists {
-
-		upGrader := ws.HTTPUpgrader{}
-		if rwsConfig.Compression {
-			e := wsflate.Extension{
-				// We are using default parameters here since we use
-				// wsflate.{Compress,Decompress}Frame helpers below in the code.
-				// This assumes that we use standard compress/flate package as flate
-				// implementation.
-				Parameters: wsflate.DefaultParameters,
-			}
-			upGrader = ws.HTTPUpgrader{
-				Negotiate: e.Negotiate,
-			}
-		}
-		wsConnection, _, _, err := upGrader.Upgrade(r, w)
-
-		if err != nil {
-			log.Printf("Websocket http upgrade failed: %v\n", err)
-			return
-		}
-
-		// Read redis params from query string
-		query := r.URL.Query()
-		options := redisOptionsFromRwsConfiguration(rwsConfig.RedisClientConfig, query)
-
-		streams := redisStreams(query, rwsConfig.RedisStreams)
-		if len(streams) == 0 {
-			log.Printf("No stream(s), please setup 'default.stream.config' section in configuration (%s) or pass topic(s) as query parameter.", rws.SourceFile)
-			return
-		}
-
-		// Read close socket event details from query string
-		onCloseKey, onCloseValue := onCloseKeyAndValue(query, rwsConfig.OnCloseKey, rwsConfig.OnCloseValue)
-
-		// Instantiate client
-		client := redis.NewClient(&options)
-		defer client.Close()
-
-		// Context
-		ctx := context.Background()
-
-		// Make sure to read client message and react on close/error
-		chClose := make(chan bool)
-
-		go func() {
-			defer wsConnection.Close()
-
-			for {
-				_, _, err := wsutil.ReadClientData(wsConnection)
-				if err != nil {
-					// handle error
-					chClose <- true
-					if !strings.HasPrefix(err.Error(), "websocket: close") {
-						log.Printf("WebSocket read error: %v\n", err)
-					}
-					return
-				}
-			}
-		}()
-
-		// Subscribe client to the stream messages
-		chStream := make(chan redis.XStream)
-
-		// Subscribe client to the errors
-		chError := make(chan error)
-
-		go func() {
-			defer client.Close()
-
-			if len(streams) == 0 {
-				chError <- errors.New("no streams for listening")
-				return
-			}
-
-			// Filter for existing streams
-			streamsRequest := make([]string, 0)
-			for _, stream := range streams {
-				existedStreams, _, err := client.Scan(ctx, 0, stream, -1).Result()
-				if err != nil {
-					fmt.Printf("Can't read streams %v: %v\n", streams, err)
-					chError <- err
-					return
-				}
-				if len(existedStreams) == 0 {
-					// Fallback to exists query
-					streamKeyExists, err := client.Exists(ctx, stream).Result()
-					if err != nil {
-						fmt.Printf("Can't request exist key %v: %v\n", streams, err)
-						chError <- err
-						return
-					}
-					if streamKeyExists != 0 {
-						existedStreams = []string{stream}
-					}
-				}
-
-				fmt.Printf("Success scan the stream: %v\nExisted streams: %v\n", stream, existedStreams)
-				streamsRequest = append(streamsRequest, existedStreams...)
-			}
-
-			if len(streamsRequest) == 0 {
-				errorDescription := fmt.Sprintf("The streams: %v not found in redis\n", streams)
-				chError <- errors.New(errorDescription)
-				return
-			}
-
-			idsOffset := len(streamsRequest)
-			readStreamsRequest := make([]string, idsOffset*2)
-			for i := 0; i < idsOffset; i++ {
-				readStreamsRequest[i] = streamsRequest[i]
-				readStreamsRequest[i+idsOffset] = "0" // For blocking request we could use '$' argument see redis documentation
-			}
-
-			for {
-				xStreams, err := client.XRead(ctx, &redis.XReadArgs{
-					Streams: readStreamsRequest,
-					Block:   0,
-				}).Result()
-
-				if err != nil {
-					fmt.Printf("Can't read streams %v: %v\n", streams, err)
-					chError <- err
-					return
-				}
-				for i, xStream := range xStreams {
-					lastMessage := Last(xStream.Messages)
-					readStreamsRequest[i+idsOffset] = lastMessage.ID
-					// Detect close channel message
-					noun, verb := lastMessage.Values["CLOSE"]
-					if verb && noun == "CHANNEL" {
-						chError <- errors.New("Close channel by command CLOSE: CHANNEL")
-						return
-					}
-					// Send response from redis to channel
-					chStream <- xStream
-				}
-			}
-		}()
-
-		log.Printf("Websocket opened %s\n", r.Host)
-		running := true
-		// Keep reading and sending messages
-		for running {
-			select {
-			// Exit if websocket read fails
-			case <-chClose:
-				running = false
-			case ev := <-chError:
-				switch e := ev.(type) {
-				case redis.Error:
-					if e.Error() == "redis: nil" {
-						log.Printf("%% Error: %v perhaps stream(s) %v didn't exists\n", e, streams)
-					} else {
-						log.Printf("%% Error: %v\n", e)
-					}
-					err = wsConnection.Close()
-					if err != nil {
-						log.Printf("Error while closing WebSocket: %v\n", e)
-					}
-					running = false
-				default:
-					log.Printf("Error type: %v", ev)
-					err = wsConnection.Close()
-					if err != nil {
-						log.Printf("Error while closing WebSocket: %v\n", e)
-					}
-					running = false
-				}
-			case stream := <-chStream:
-				values, jsonErrors := JSONBytesMake(stream.Messages, rwsConfig.MessageType)
-				if jsonErrors == nil {
-					// log.Printf("WRITE MESSAGE: %v (%v)\n", values, jsonErrors)
-					err = wsutil.WriteServerMessage(wsConnection, ws.OpBinary, values)
-				} else {
-					err = wsutil.WriteServerMessage(wsConnection, ws.OpBinary, []byte(jsonErrors.Error()))
-				}
-
-				if err != nil {
-					// handle error
-					chClose <- true
-					log.Printf("WebSocket write error: %v (%v)\n", err, stream)
-					running = false
-				} else {
-					for _, xMessage := range stream.Messages {
-						// TODO: call single command with multiply message ids
-						client.XDel(ctx, stream.Stream, xMessage.ID)
-					}
-				}
-			}
-		}
-		if onCloseKey != "" {
-			client.Set(ctx, onCloseKey, onCloseValue, 0)
-		}
-		log.Printf("Websocket closed %s\n", r.Host)
+	} else if rwsConfig, exists := webSockets[r.URL.Path]; exists {
+		rws.serveWebSocket(w, r, rwsConfig)
 		return
 	}
 	w.WriteHeader(404)
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/gobwas/ws"
+	"github.com/redis/go-redis/v9"
+)
+
+// scopes of delivery.sentinel.scope
+const (
+	sentinelSocket = "socket"
+	sentinelStream = "stream"
+	sentinelNone   = "none"
+)
+
+// defaults of the close sentinel, CLOSE: CHANNEL closes the websocket
+const (
+	defaultSentinelField  = "CLOSE"
+	defaultSentinelValue  = "CHANNEL"
+	defaultSentinelReason = "stream closed"
+)
+
+// sentinelDefaults fills in the close sentinel settings left out
+func (delivery *ConfigDelivery) sentinelDefaults() {
+	if delivery.SentinelField == "" && delivery.SentinelWhen == "" {
+		delivery.SentinelField = defaultSentinelField
+		delivery.SentinelValue = defaultSentinelValue
+	}
+	if delivery.SentinelScope == "" {
+		delivery.SentinelScope = sentinelSocket
+	}
+	if delivery.SentinelCode == 0 {
+		delivery.SentinelCode = int(ws.StatusNormalClosure)
+	}
+	if delivery.SentinelReason == "" {
+		delivery.SentinelReason = defaultSentinelReason
+	}
+}
+
+// sentinelData values available to the delivery.sentinel.when predicate
+type sentinelData struct {
+	Stream string
+	ID     string
+	Values map[string]string
+}
+
+// sentinelPredicate compiled delivery.sentinel.when
+type sentinelPredicate struct {
+	tmpl *template.Template
+}
+
+// compileSentinel parses delivery.sentinel.when and checks it against sample
+// data, nil when it is not set
+func compileSentinel(when string) (*sentinelPredicate, error) {
+	if when == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("sentinel.when").Option("missingkey=zero").Parse(when)
+	if err != nil {
+		return nil, err
+	}
+	// unknown fields only show up on execution
+	if err := tmpl.Execute(io.Discard, sentinelData{}); err != nil {
+		return nil, err
+	}
+	return &sentinelPredicate{tmpl: tmpl}, nil
+}
+
+// match reports whether the predicate renders "true" for data
+func (predicate *sentinelPredicate) match(data sentinelData) (bool, error) {
+	var result strings.Builder
+	if err := predicate.tmpl.Execute(&result, data); err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(result.String()) == "true", nil
+}
+
+// sentinel returns index of the first entry of messages closing stream, -1 without one
+func (reader *streamReader) sentinel(stream string, messages []redis.XMessage) int {
+	if reader.delivery.SentinelScope == sentinelNone {
+		return -1
+	}
+	for i, xMessage := range messages {
+		if reader.isSentinel(stream, xMessage) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isSentinel reports whether the entry matches delivery.sentinel.when, when
+// set, or delivery.sentinel.field and delivery.sentinel.value
+func (reader *streamReader) isSentinel(stream string, xMessage redis.XMessage) bool {
+	if reader.sentinelWhen == nil {
+		value, exists := xMessage.Values[reader.delivery.SentinelField]
+		return exists && (reader.delivery.SentinelValue == "" || fmt.Sprint(value) == reader.delivery.SentinelValue)
+	}
+	data := sentinelData{Stream: stream, ID: xMessage.ID, Values: make(map[string]string, len(xMessage.Values))}
+	for field, value := range xMessage.Values {
+		data.Values[field] = fmt.Sprint(value)
+	}
+	matched, err := reader.sentinelWhen.match(data)
+	if err != nil {
+		reader.logger.Warn("Can't evaluate delivery.sentinel.when", "stream", stream, "id", xMessage.ID, "error", err)
+	}
+	return matched
+}
+
+// forward hands batch over to the websocket up to a sentinel, entries after
+// it and, unless delivered, the sentinel itself stay in redis, returns false
+// when run has to stop
+func (reader *streamReader) forward(ctx context.Context, batch streamBatch) bool {
+	at := reader.sentinel(batch.Stream, batch.Messages)
+	if at >= 0 {
+		end := at
+		if reader.delivery.SentinelDeliver {
+			end++
+		}
+		batch.Messages = batch.Messages[:end]
+	}
+	if len(batch.Messages) > 0 {
+		select {
+		case reader.chStream <- batch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	if at < 0 {
+		return true
+	}
+
+	closing := sessionClose{code: ws.StatusCode(reader.delivery.SentinelCode), reason: reader.delivery.SentinelReason}
+	reader.logger.Info("Close sentinel read", "stream", batch.Stream, "scope", reader.delivery.SentinelScope)
+	if reader.delivery.SentinelScope == sentinelStream {
+		reader.cursor.remove(batch.Stream)
+		reader.excluded[batch.Stream] = true
+		reader.sess.forget(batch.Stream)
+		if !reader.reply(ctx, controlMessage{Event: "stream.closed", Streams: []string{batch.Stream}, Reason: closing.reason}) {
+			return false
+		}
+		// the websocket stays open while streams are left or may still be discovered
+		if len(reader.cursor.names) > 0 || reader.source.DiscoveryInterval > 0 {
+			return true
+		}
+	}
+	reader.fail(ctx, closing)
+	return false
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/redis/go-redis/v9"
+)
+
+// sentinelReader returns reader of streams s1 and s2 with delivery, its
+// channels are buffered so forward doesn't wait for a websocket
+func sentinelReader(t *testing.T, delivery ConfigDelivery, discovery bool) *streamReader {
+	t.Helper()
+	delivery.sentinelDefaults()
+	sentinelWhen, err := compileSentinel(delivery.SentinelWhen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rwsConfig := &RWSRedis{Delivery: delivery, sentinelWhen: sentinelWhen}
+	if discovery {
+		rwsConfig.Source.DiscoveryInterval = 1
+	}
+	reader := newStreamReader(testSession(t, "sentinel-"+t.Name(), "rws.local:8800/ws"), rwsConfig, "c1", nil, redis.Options{}, discardLogger)
+	reader.cursor.add("s1", "0", "s1")
+	reader.cursor.add("s2", "0", "s2")
+	reader.chStream = make(chan streamBatch, 1)
+	reader.chReply = make(chan controlMessage, 1)
+	reader.chError = make(chan error, 1)
+	return reader
+}
+
+// entries returns entries of IDs 1-0, 2-0, ... with values
+func entries(values ...map[string]interface{}) []redis.XMessage {
+	messages := make([]redis.XMessage, len(values))
+	for i, value := range values {
+		messages[i] = redis.XMessage{ID: fmt.Sprintf("%d-0", i+1), Values: value}
+	}
+	return messages
+}
+
+func TestSentinelDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery ConfigDelivery
+		expected ConfigDelivery
+	}{
+		{
+			name:     "all defaults",
+			expected: ConfigDelivery{SentinelField: "CLOSE", SentinelValue: "CHANNEL", SentinelScope: "socket", SentinelCode: 1000, SentinelReason: "stream closed"},
+		},
+		{
+			name:     "field without value",
+			delivery: ConfigDelivery{SentinelField: "END"},
+			expected: ConfigDelivery{SentinelField: "END", SentinelScope: "socket", SentinelCode: 1000, SentinelReason: "stream closed"},
+		},
+		{
+			name:     "predicate replaces the field",
+			delivery: ConfigDelivery{SentinelWhen: "true", SentinelScope: "stream", SentinelCode: 4000, SentinelReason: "done"},
+			expected: ConfigDelivery{SentinelWhen: "true", SentinelScope: "stream", SentinelCode: 4000, SentinelReason: "done"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.delivery.sentinelDefaults()
+			if !reflect.DeepEqual(test.delivery, test.expected) {
+				t.Errorf("delivery %+v, expected %+v", test.delivery, test.expected)
+			}
+		})
+	}
+}
+
+func TestCompileSentinel(t *testing.T) {
+	tests := []struct {
+		name  string
+		when  string
+		isNil bool
+		error bool
+	}{
+		{name: "not set", when: "", isNil: true},
+		{name: "predicate", when: `{{eq .Values.type "end"}}`},
+		{name: "parse error", when: `{{eq .Values.type "end"`, isNil: true, error: true},
+		{name: "unknown field", when: `{{.Entry}}`, isNil: true, error: true},
+		{name: "wrong arguments", when: `{{eq}}`, isNil: true, error: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			predicate, err := compileSentinel(test.when)
+			if (err != nil) != test.error {
+				t.Errorf("error %v, expected error %v", err, test.error)
+			}
+			if (predicate == nil) != test.isNil {
+				t.Errorf("predicate %v, expected nil %v", predicate, test.isNil)
+			}
+		})
+	}
+}
+
+func TestIsSentinel(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery ConfigDelivery
+		values   map[string]interface{}
+		expected bool
+	}{
+		{name: "default field and value", values: map[string]interface{}{"CLOSE": "CHANNEL"}, expected: true},
+		{name: "default field other value", values: map[string]interface{}{"CLOSE": "later"}},
+		{name: "no sentinel field", values: map[string]interface{}{"order": "42"}},
+		{name: "field with any value", delivery: ConfigDelivery{SentinelField: "END"}, values: map[string]interface{}{"END": "1"}, expected: true},
+		{name: "field with the value", delivery: ConfigDelivery{SentinelField: "END", SentinelValue: "yes"}, values: map[string]interface{}{"END": "yes"}, expected: true},
+		{name: "predicate true", delivery: ConfigDelivery{SentinelWhen: `{{eq .Values.type "end"}}`}, values: map[string]interface{}{"type": "end"}, expected: true},
+		{name: "predicate false", delivery: ConfigDelivery{SentinelWhen: `{{eq .Values.type "end"}}`}, values: map[string]interface{}{"type": "order"}},
+		{name: "predicate ignores the default field", delivery: ConfigDelivery{SentinelWhen: `{{eq .Stream "s2"}}`}, values: map[string]interface{}{"CLOSE": "CHANNEL"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := sentinelReader(t, test.delivery, false)
+			if matched := reader.isSentinel("s1", redis.XMessage{ID: "1-0", Values: test.values}); matched != test.expected {
+				t.Errorf("sentinel %v, expected %v", matched, test.expected)
+			}
+		})
+	}
+}
+
+func TestForwardSentinel(t *testing.T) {
+	order := map[string]interface{}{"order": "42"}
+	closing := map[string]interface{}{"CLOSE": "CHANNEL"}
+	tests := []struct {
+		name      string
+		delivery  ConfigDelivery
+		messages  []redis.XMessage
+		forwarded []string
+		goOn      bool
+		reply     string
+		closed    error
+		streams   []string
+	}{
+		{
+			name:      "no sentinel",
+			messages:  entries(order, order),
+			forwarded: []string{"1-0", "2-0"},
+			goOn:      true,
+			streams:   []string{"s1", "s2"},
+		},
+		{
+			name:      "socket scope truncates and closes",
+			messages:  entries(order, closing, order),
+			forwarded: []string{"1-0"},
+			closed:    sessionClose{code: ws.StatusNormalClosure, reason: "stream closed"},
+			streams:   []string{"s1", "s2"},
+		},
+		{
+			name:      "socket scope closes with the code",
+			delivery:  ConfigDelivery{SentinelCode: 4001, SentinelReason: "shift over", SentinelDeliver: true},
+			messages:  entries(order, closing, order),
+			forwarded: []string{"1-0", "2-0"},
+			closed:    sessionClose{code: 4001, reason: "shift over"},
+			streams:   []string{"s1", "s2"},
+		},
+		{
+			name:     "sentinel first",
+			messages: entries(closing, order),
+			closed:   sessionClose{code: ws.StatusNormalClosure, reason: "stream closed"},
+			streams:  []string{"s1", "s2"},
+		},
+		{
+			name:      "stream scope stops the stream only",
+			delivery:  ConfigDelivery{SentinelScope: "stream"},
+			messages:  entries(order, closing, order),
+			forwarded: []string{"1-0"},
+			goOn:      true,
+			reply:     "stream.closed [s1] stream closed",
+			streams:   []string{"s2"},
+		},
+		{
+			name:      "none scope forwards the entry",
+			delivery:  ConfigDelivery{SentinelScope: "none"},
+			messages:  entries(order, closing, order),
+			forwarded: []string{"1-0", "2-0", "3-0"},
+			goOn:      true,
+			streams:   []string{"s1", "s2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := sentinelReader(t, test.delivery, false)
+			goOn := reader.forward(context.Background(), streamBatch{XStream: redis.XStream{Stream: "s1", Messages: test.messages}})
+			if goOn != test.goOn {
+				t.Errorf("forward %v, expected %v", goOn, test.goOn)
+			}
+			forwarded := make([]string, 0)
+			select {
+			case batch := <-reader.chStream:
+				for _, message := range batch.Messages {
+					forwarded = append(forwarded, message.ID)
+				}
+			default:
+			}
+			if !slices.Equal(forwarded, test.forwarded) && len(forwarded)+len(test.forwarded) > 0 {
+				t.Errorf("forwarded %v, expected %v", forwarded, test.forwarded)
+			}
+			reply := ""
+			select {
+			case message := <-reader.chReply:
+				reply = fmt.Sprintf("%s %v %s", message.Event, message.Streams, message.Reason)
+			default:
+			}
+			if reply != test.reply {
+				t.Errorf("reply %q, expected %q", reply, test.reply)
+			}
+			var closed error
+			select {
+			case closed = <-reader.chError:
+			default:
+			}
+			if closed != test.closed {
+				t.Errorf("closed %v, expected %v", closed, test.closed)
+			}
+			if !slices.Equal(reader.cursor.names, test.streams) {
+				t.Errorf("streams %v, expected %v", reader.cursor.names, test.streams)
+			}
+		})
+	}
+}
+
+func TestForwardSentinelLastStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		discovery bool
+		goOn      bool
+	}{
+		{name: "last stream closes the socket"},
+		{name: "discovery keeps the socket open", discovery: true, goOn: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := sentinelReader(t, ConfigDelivery{SentinelScope: "stream"}, test.discovery)
+			reader.cursor.remove("s2")
+			batch := streamBatch{XStream: redis.XStream{Stream: "s1", Messages: entries(map[string]interface{}{"CLOSE": "CHANNEL"})}}
+			if goOn := reader.forward(context.Background(), batch); goOn != test.goOn {
+				t.Errorf("forward %v, expected %v", goOn, test.goOn)
+			}
+			if message := <-reader.chReply; message.Event != "stream.closed" {
+				t.Errorf("reply %+v, expected stream.closed", message)
+			}
+			if !reader.excluded["s1"] {
+				t.Error("closed stream may be discovered again")
+			}
+			select {
+			case closed := <-reader.chError:
+				if test.goOn {
+					t.Errorf("closed %v, expected the socket to stay open", closed)
+				}
+			default:
+				if !test.goOn {
+					t.Error("socket without streams stays open")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/redis/go-redis/v9"
+)
+
+// closeHandshakeTimeout how long to wait for the client to answer our close frame
+const closeHandshakeTimeout = time.Second
+
+// serveWebSocket upgrades the request and streams redis entries to the client
+// until the client goes away, redis fails or the server shuts down
+func (rws *RWS) serveWebSocket(w http.ResponseWriter, r *http.Request, rwsConfig *RWSRedis) {
+	if !rws.acquireSession() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer rws.sessions.Done()
+
+	endpoint := rws.Address + r.URL.Path
+	id := newConnectionID()
+	logger := slog.With("conn", id, "remote", r.RemoteAddr, "endpoint", endpoint)
+	if user := requestIdentity(r); user != "" {
+		logger = logger.With("user", user, "sans", requestSANs(r))
+	}
+	// Subprotocols pick the wire format, a client asking only for unknown ones is turned away
+	offered := rwsConfig.Delivery.Subprotocols
+	if len(offered) == 0 {
+		offered = defaultSubprotocols
+	}
+	if requested := requestedSubprotocols(r); len(requested) > 0 && !slices.ContainsFunc(requested, func(protocol string) bool {
+		return slices.Contains(offered, protocol)
+	}) {
+		metricUpgradeFailures.add(1, endpoint)
+		logger.Warn("Websocket http upgrade failed", "error", "unsupported subprotocols", "requested", requested)
+		http.Error(w, "unsupported subprotocols, expected one of "+strings.Join(offered, ", "), http.StatusBadRequest)
+		return
+	}
+	// A client certificate limits the streams to its entries of source.access
+	access := newStreamAccess(rwsConfig.Source.Access, requestIdentity(r), requestSANs(r))
+	if err := access.check(redisStreams(r.URL.Query(), rwsConfig.Source.Streams)); err != nil {
+		metricUpgradeFailures.add(1, endpoint)
+		logger.Warn("Websocket http upgrade failed", "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	upGrader := ws.HTTPUpgrader{
+		Protocol: func(protocol string) bool {
+			return slices.Contains(offered, protocol)
+		},
+	}
+	var extension *wsflate.Extension
+	if rwsConfig.Delivery.Compression {
+		extension = compressionExtension(rwsConfig.Delivery)
+		upGrader.Negotiate = negotiateCompression(extension)
+	}
+	wsConnection, _, handshake, err := upGrader.Upgrade(r, w)
+
+	if err != nil {
+		metricUpgradeFailures.add(1, endpoint)
+		logger.Warn("Websocket http upgrade failed", "error", err)
+		return
+	}
+	defer wsConnection.Close()
+	format, exists := entryFormats[handshake.Protocol]
+	if !exists {
+		format = entryFormats[protocolJSON]
+	}
+	if handshake.Protocol != "" {
+		logger = logger.With("subprotocol", handshake.Protocol)
+	}
+	writer := &messageWriter{conn: wsConnection, endpoint: endpoint, compressor: newDeflater(rwsConfig.Delivery, extension)}
+	metricUpgrades.add(1, endpoint)
+	metricConnections.add(1, endpoint)
+	defer metricConnections.add(-1, endpoint)
+
+	// Read redis params from query string
+	query := r.URL.Query()
+	options := redisOptionsFromRwsConfiguration(rwsConfig.Connection, query)
+
+	streams := redisStreams(query, rwsConfig.Source.Streams)
+	if len(streams) == 0 {
+		logger.Warn("No stream(s), please setup 'source.streams' in configuration or pass topic(s) as query parameter", "file", rws.SourceFile)
+		return
+	}
+	logger = logger.With("streams", streams)
+	sess := openSession(id, r, endpoint, streams, logger)
+	defer sess.close()
+
+	// Read close socket event details from query string
+	onCloseKey, onCloseValue := onCloseKeyAndValue(query, rwsConfig.Delivery.OnCloseKey, rwsConfig.Delivery.OnCloseValue)
+
+	// Instantiate client
+	client := redis.NewClient(&options)
+	client.AddHook(metricsHook{})
+	defer client.Close()
+
+	reader := newStreamReader(sess, rwsConfig, sessionConsumer(r, id), client, options, logger)
+	reader.access = access
+	defer reader.blocking.close()
+
+	if reader.replaying, err = parseReplay(query); err != nil {
+		logger.Warn("Invalid replay", "error", err)
+		writeControl(writer, controlMessage{Event: "error", Op: "replay", Error: err.Error()})
+		return
+	}
+
+	// Resume tokens carry positions across reconnects, a consumer group keeps them itself
+	var chResume <-chan time.Time
+	if rwsConfig.resume.enabled() && rwsConfig.Source.Group == "" {
+		reader.issuer = &resumeIssuer{settings: rwsConfig.resume, sess: sess}
+		if token := query.Get("resume"); token != "" {
+			if reader.resumed, err = rwsConfig.resume.verify(token, endpoint, time.Now()); err != nil {
+				logger.Warn("Invalid resume token", "error", err)
+				if err = writeControl(writer, controlMessage{Event: "error", Op: "resume", Error: "invalid resume token: " + err.Error()}); err != nil {
+					return
+				}
+			}
+		}
+		ticker := time.NewTicker(rwsConfig.resume.interval)
+		defer ticker.Stop()
+		chResume = ticker.C
+	}
+
+	// Context, cancelled when the websocket is done so the goroutines below never block forever
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Make sure to read client message and react on close/error
+	chClose := make(chan bool, 1)
+	// Close frame of the client, handed over before chClose is signalled
+	chClientClose := make(chan sessionClose, 1)
+
+	go func() {
+		defer wsConnection.Close()
+
+		for {
+			payload, op, err := readClientMessage(wsConnection, writer)
+			if err != nil {
+				// handle error
+				var clientClosed wsutil.ClosedError
+				if errors.As(err, &clientClosed) {
+					chClientClose <- sessionClose{code: clientClosed.Code, reason: clientClosed.Reason}
+				}
+				chClose <- true
+				if !errors.As(err, &clientClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !strings.HasPrefix(err.Error(), "websocket: close") {
+					logger.Warn("Websocket read error", "error", err)
+				}
+				return
+			}
+			// Text messages carry the control protocol
+			if op != ws.OpText {
+				continue
+			}
+			request, err := parseControl(payload)
+			if err != nil {
+				if !reader.reply(ctx, controlMessage{Event: "error", Error: err.Error()}) {
+					return
+				}
+				continue
+			}
+			// Acks don't need the stream reader, so a blocked read goes on
+			if request.Op == "ack" {
+				if !reader.reply(ctx, reader.ack(ctx, request)) {
+					return
+				}
+				continue
+			}
+			reader.command(ctx, request)
+		}
+	}()
+
+	runHooks(ctx, client, rwsConfig.onOpen, newHookData("open", sess), logger)
+	// Presence is kept up by heartbeats until the websocket closes
+	var chPresence <-chan time.Time
+	present := newPresence(rwsConfig.Delivery, client, sess)
+	if present != nil {
+		if err = present.heartbeat(ctx); err != nil {
+			logger.Warn("Can't register presence", "key", present.key, "error", err)
+		}
+		ticker := time.NewTicker(present.interval())
+		defer ticker.Stop()
+		chPresence = ticker.C
+	}
+	go reader.run(ctx)
+
+	// send writes entries to the websocket in frames of at most batch.max.bytes
+	send := func(stream streamBatch) bool {
+		frames, jsonErrors := encodeFrames(format, stream.Stream, stream.Messages, rwsConfig.Delivery.MessageType, rwsConfig.Delivery.BatchMaxBytes)
+		if jsonErrors != nil {
+			metricEncodingErrors.add(1, endpoint)
+			logger.Warn("Can't encode entries", "stream", stream.Stream, "error", jsonErrors)
+			frames = []frame{{payload: []byte(jsonErrors.Error()), messages: stream.Messages}}
+		}
+		label := streamLabel(stream.Stream)
+		for _, frame := range frames {
+			if err := writer.write(format.op, frame.payload); err != nil {
+				logger.Warn("Websocket write error", "stream", stream.Stream, "error", err)
+				return false
+			}
+			sent := 0
+			if jsonErrors == nil {
+				sent = len(frame.messages)
+				metricMessagesSent.add(float64(sent), label)
+			}
+			sess.delivered(stream.Stream, Last(frame.messages).ID, sent)
+			metricBytesSent.add(float64(len(frame.payload)), label)
+			if !stream.replayed {
+				now := time.Now()
+				for _, message := range frame.messages {
+					if age, ok := entryAge(message.ID, now); ok {
+						metricEntryAge.observe(age.Seconds(), label)
+					}
+				}
+			}
+			reader.delivered(ctx, streamBatch{XStream: redis.XStream{Stream: stream.Stream, Messages: frame.messages}, replayed: stream.replayed})
+		}
+		return true
+	}
+	// Entries held for batch.linger go out before anything else is written
+	buffer := &lingerBuffer{linger: rwsConfig.Delivery.BatchLinger}
+	flush := func() bool {
+		for _, stream := range buffer.take() {
+			if !send(stream) {
+				return false
+			}
+		}
+		return true
+	}
+
+	logger.Info("Websocket opened")
+	running := true
+	// closed why the websocket was closed, for on.close hooks
+	closed := sessionClose{code: ws.StatusAbnormalClosure, reason: "connection lost"}
+	// Keep reading and sending messages
+	for running {
+		select {
+		// Exit if websocket read fails
+		case <-chClose:
+			select {
+			case closed = <-chClientClose:
+			default:
+			}
+			running = false
+		// Server is shutting down: stop on a batch boundary, so everything
+		// written so far is already deleted and the rest stays in redis
+		case <-rws.chDone:
+			closed = rws.drainClose()
+			// a fresh resume token lets the client continue on the next process
+			if flush() && reader.issuer != nil {
+				if token, changed := reader.issuer.next(false); changed {
+					writeControl(writer, token)
+				}
+			}
+			closeWebSocket(logger, writer, closed.code, closed.reason, chClose)
+			running = false
+		// Endpoint was removed by a config reload
+		case <-rwsConfig.chRemoved:
+			closed = sessionClose{code: ws.StatusGoingAway, reason: "endpoint removed"}
+			flush()
+			closeWebSocket(logger, writer, closed.code, closed.reason, chClose)
+			running = false
+		// Closed through the sessions API
+		case closed = <-sess.chKill:
+			flush()
+			closeWebSocket(logger, writer, closed.code, closed.reason, chClose)
+			running = false
+		// Acks and errors of control requests, streams found by rediscovery
+		case message := <-reader.chReply:
+			if !flush() {
+				running = false
+			} else if err = writeControl(writer, message); err != nil {
+				logger.Warn("Websocket write error", "error", err)
+				running = false
+			}
+		// Hand out a new resume token when positions changed
+		case <-chResume:
+			if !flush() {
+				running = false
+			} else if token, changed := reader.issuer.next(false); changed {
+				if err = writeControl(writer, token); err != nil {
+					logger.Warn("Websocket write error", "error", err)
+					running = false
+				}
+			}
+		case <-chPresence:
+			if err = present.heartbeat(ctx); err != nil {
+				logger.Warn("Can't refresh presence", "key", present.key, "error", err)
+			}
+		case ev := <-reader.chError:
+			if errors.As(ev, &closed) {
+				flush()
+				closeWebSocket(logger, writer, closed.code, closed.reason, chClose)
+				running = false
+				continue
+			}
+			if errors.Is(ev, errReplayFinished) {
+				closed = sessionClose{code: ws.StatusNormalClosure, reason: "replay finished"}
+				flush()
+				closeWebSocket(logger, writer, closed.code, closed.reason, chClose)
+				running = false
+				continue
+			}
+			closed = sessionClose{code: ws.StatusInternalServerError, reason: "redis error"}
+			if errors.Is(ev, redis.Nil) {
+				logger.Warn("Redis error, perhaps stream(s) didn't exist", "error", ev)
+			} else {
+				logger.Warn("Redis error", "error", ev)
+			}
+			closeWebSocket(logger, writer, closed.code, closed.reason, chClose)
+			running = false
+		case stream := <-reader.chStream:
+			if buffer.linger > 0 {
+				buffer.add(stream)
+			} else {
+				running = send(stream)
+			}
+		// Entries held for batch.linger are due
+		case <-buffer.chFlush:
+			running = flush()
+		}
+	}
+	// a drain bounds the cleanup by its deadline, so a slow redis can't hold up shutdown
+	cleanupCtx, stopCleanup := rws.cleanupContext(ctx)
+	defer stopCleanup()
+	reader.release(cleanupCtx)
+	if onCloseKey != "" {
+		client.Set(cleanupCtx, onCloseKey, onCloseValue, 0)
+	}
+	if present != nil {
+		if err = present.leave(cleanupCtx); err != nil {
+			logger.Warn("Can't remove presence", "key", present.key, "error", err)
+		}
+	}
+	if len(rwsConfig.onClose) > 0 {
+		data := newHookData("close", sess)
+		data.Code, data.Reason, data.Positions = int(closed.code), closed.reason, sess.info().Positions
+		runHooks(cleanupCtx, client, rwsConfig.onClose, data, logger)
+	}
+	logger.Info("Websocket closed")
+}
+
+// startID resolves source.start for the stream, "$" is pinned to the current
+// last entry, so entries added between two reads of other streams are not skipped
+func startID(ctx context.Context, client *redis.Client, stream string, start string) (string, error) {
+	if start != "$" {
+		return start, nil
+	}
+	messages, err := client.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		return "0", nil
+	}
+	return messages[0].ID, nil
+}
+
+// sessionConsumer returns the consumer of the session in source.group: the
+// consumer query parameter, the subject of a verified client certificate or,
+// for anonymous clients, the connection ID, so a client reconnecting with the
+// same name or certificate reads its pending entries again at once
+func sessionConsumer(r *http.Request, id string) string {
+	if consumer := r.URL.Query().Get("consumer"); consumer != "" {
+		return consumer
+	}
+	if identity := requestIdentity(r); identity != "" {
+		return identity
+	}
+	return id
+}
+
+// closeWebSocket sends a close frame and gives the client a moment to answer it
+func closeWebSocket(logger *slog.Logger, writer *messageWriter, code ws.StatusCode, reason string, chClose <-chan bool) {
+	logger.Debug("Closing websocket", "code", code, "reason", reason)
+	body := ws.NewCloseFrameBody(code, reason)
+	writer.mu.Lock()
+	err := wsutil.WriteServerMessage(writer.conn, ws.OpClose, body)
+	writer.mu.Unlock()
+	if err != nil {
+		logger.Warn("Error while closing websocket", "error", err)
+		return
+	}
+	select {
+	case <-chClose:
+	case <-time.After(closeHandshakeTimeout):
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// defaultKillReason close reason sent when the sessions API request has none
+const defaultKillReason = "closed by admin"
+
+// session open websocket, listed and closed through the sessions API
+type session struct {
+	id        string
+	remote    string
+	endpoint  string
+	streams   []string
+	user      string
+	sans      []string
+	connected time.Time
+	logger    *slog.Logger
+
+	mu        sync.Mutex
+	positions map[string]string
+	sent      int64
+
+	chKill chan sessionClose
+}
+
+// sessionClose close frame requested for a session
+type sessionClose struct {
+	code   ws.StatusCode
+	reason string
+}
+
+// Error makes a close frame requested by the stream reader an error of it
+func (closing sessionClose) Error() string {
+	return fmt.Sprintf("close %d: %s", closing.code, closing.reason)
+}
+
+// sessionInfo JSON view of a session
+type sessionInfo struct {
+	ID             string            `json:"id"`
+	Remote         string            `json:"remote"`
+	Endpoint       string            `json:"endpoint"`
+	Streams        []string          `json:"streams"`
+	User           string            `json:"user,omitempty"`
+	SANs           []string          `json:"sans,omitempty"`
+	Positions      map[string]string `json:"positions"`
+	MessagesSent   int64             `json:"messages_sent"`
+	ConnectedSince time.Time         `json:"connected_since"`
+}
+
+// liveSessions open websockets of every listener by ID
+var liveSessions = struct {
+	mu   sync.Mutex
+	byID map[string]*session
+}{byID: make(map[string]*session)}
+
+// openSession registers a websocket in liveSessions
+func openSession(id string, r *http.Request, endpoint string, streams []string, logger *slog.Logger) *session {
+	sess := &session{
+		id:        id,
+		remote:    r.RemoteAddr,
+		endpoint:  endpoint,
+		streams:   streams,
+		user:      requestIdentity(r),
+		sans:      requestSANs(r),
+		connected: time.Now(),
+		logger:    logger,
+		positions: make(map[string]string),
+		chKill:    make(chan sessionClose, 1),
+	}
+	liveSessions.mu.Lock()
+	liveSessions.byID[id] = sess
+	liveSessions.mu.Unlock()
+	return sess
+}
+
+// close removes the session from liveSessions
+func (sess *session) close() {
+	liveSessions.mu.Lock()
+	delete(liveSessions.byID, sess.id)
+	liveSessions.mu.Unlock()
+}
+
+// setPosition records ID of the last entry delivered (or skipped) from stream
+func (sess *session) setPosition(stream string, id string) {
+	sess.mu.Lock()
+	sess.positions[stream] = id
+	sess.mu.Unlock()
+}
+
+// forget drops position of a stream no longer read
+func (sess *session) forget(stream string) {
+	sess.mu.Lock()
+	delete(sess.positions, stream)
+	sess.mu.Unlock()
+}
+
+// setStreams records streams and patterns subscribed by the client
+func (sess *session) setStreams(streams []string) {
+	sess.mu.Lock()
+	sess.streams = append([]string{}, streams...)
+	sess.mu.Unlock()
+}
+
+// delivered records entries written to the websocket
+func (sess *session) delivered(stream string, id string, count int) {
+	sess.mu.Lock()
+	sess.positions[stream] = id
+	sess.sent += int64(count)
+	sess.mu.Unlock()
+}
+
+// info returns JSON view of the session
+func (sess *session) info() sessionInfo {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	positions := make(map[string]string, len(sess.positions))
+	for stream, id := range sess.positions {
+		positions[stream] = id
+	}
+	return sessionInfo{
+		ID:             sess.id,
+		Remote:         sess.remote,
+		Endpoint:       sess.endpoint,
+		Streams:        sess.streams,
+		User:           sess.user,
+		SANs:           sess.sans,
+		Positions:      positions,
+		MessagesSent:   sess.sent,
+		ConnectedSince: sess.connected,
+	}
+}
+
+// kill asks the session to close with code and reason, the first request wins
+func (sess *session) kill(code ws.StatusCode, reason string) {
+	select {
+	case sess.chKill <- sessionClose{code: code, reason: reason}:
+	default:
+	}
+}
+
+// findSessions returns open sessions, filtered by ID and endpoint when not empty
+func findSessions(id string, endpoint string) []*session {
+	liveSessions.mu.Lock()
+	defer liveSessions.mu.Unlock()
+	list := make([]*session, 0)
+	for _, sess := range liveSessions.byID {
+		if (id == "" || sess.id == id) && (endpoint == "" || sess.endpoint == endpoint) {
+			list = append(list, sess)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].connected.Before(list[j].connected) })
+	return list
+}
+
+// sessionsHandler serves the sessions API under path for requests bearing token:
+// GET path lists sessions (?endpoint= filters them), GET path/ID shows one,
+// DELETE path/ID closes one and DELETE path?endpoint= closes every session of
+// the endpoint, ?code= and ?reason= set the close frame
+func sessionsHandler(path string, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rws"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, path), "/")
+		endpoint := r.URL.Query().Get("endpoint")
+		switch r.Method {
+		case http.MethodGet:
+			list := findSessions(id, endpoint)
+			if id != "" {
+				if len(list) == 0 {
+					writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+					return
+				}
+				writeJSON(w, http.StatusOK, list[0].info())
+				return
+			}
+			infos := make([]sessionInfo, len(list))
+			for i, sess := range list {
+				infos[i] = sess.info()
+			}
+			writeJSON(w, http.StatusOK, infos)
+		case http.MethodDelete:
+			if id == "" && endpoint == "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "session ID or endpoint required"})
+				return
+			}
+			code, reason, err := killRequest(r)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			list := findSessions(id, endpoint)
+			if id != "" && len(list) == 0 {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+				return
+			}
+			for _, sess := range list {
+				sess.logger.Info("Closing websocket by admin request", "code", code, "reason", reason)
+				sess.kill(code, reason)
+			}
+			writeJSON(w, http.StatusOK, map[string]int{"closed": len(list)})
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		}
+	})
+}
+
+// authorized checks bearer token of the request
+func authorized(r *http.Request, token string) bool {
+	bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
+
+// killRequest returns close code and reason of a DELETE request, code is 1000
+// by default and must be one a server may send
+func killRequest(r *http.Request) (ws.StatusCode, string, error) {
+	query := r.URL.Query()
+	code := int(ws.StatusNormalClosure)
+	if value := query.Get("code"); value != "" {
+		var err error
+		if code, err = strconv.Atoi(value); err != nil || !validCloseCode(code) {
+			return 0, "", fmt.Errorf("invalid close code [%s], expected 1000-1003, 1007-1014 or 3000-4999", value)
+		}
+	}
+	reason := query.Get("reason")
+	if reason == "" {
+		reason = defaultKillReason
+	}
+	// control frame payload is limited to 125 bytes, 2 of them hold the code
+	if len(reason) > 123 {
+		return 0, "", fmt.Errorf("close reason is longer than 123 bytes")
+	}
+	return ws.StatusCode(code), reason, nil
+}
+
+// validCloseCode reports whether code may be sent in a close frame
+func validCloseCode(code int) bool {
+	return code >= 1000 && code <= 1003 || code >= 1007 && code <= 1014 || code >= 3000 && code <= 4999
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+// discardLogger logger of websockets under test
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testSession registers an open session of endpoint, closed with the test
+func testSession(t *testing.T, id string, endpoint string) *session {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "http://rws.local:8800/ws", nil)
+	sess := openSession(id, r, endpoint, []string{"s1"}, discardLogger)
+	t.Cleanup(sess.close)
+	return sess
+}
+
+// sessionsRequest sends method path to the sessions API with token
+func sessionsRequest(t *testing.T, method string, path string, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, "http://rws.local:9100"+path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	sessionsHandler("/sessions", "secret-token").ServeHTTP(w, r)
+	return w
+}
+
+func TestSessionsList(t *testing.T) {
+	first := testSession(t, "sess-1", "rws.local:8800/ws")
+	first.delivered("s1", "5-0", 3)
+	testSession(t, "sess-2", "rws.local:8800/other")
+
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		code  int
+		ids   []string
+	}{
+		{name: "all", path: "/sessions", token: "secret-token", code: http.StatusOK, ids: []string{"sess-1", "sess-2"}},
+		{name: "by endpoint", path: "/sessions?endpoint=rws.local:8800/other", token: "secret-token", code: http.StatusOK, ids: []string{"sess-2"}},
+		{name: "unknown endpoint", path: "/sessions?endpoint=rws.local:8800/none", token: "secret-token", code: http.StatusOK, ids: []string{}},
+		{name: "no token", path: "/sessions", code: http.StatusUnauthorized},
+		{name: "wrong token", path: "/sessions", token: "other-token", code: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := sessionsRequest(t, http.MethodGet, test.path, test.token)
+			if w.Code != test.code {
+				t.Fatalf("status %d, expected %d: %s", w.Code, test.code, w.Body)
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+			var infos []sessionInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0, len(infos))
+			for _, info := range infos {
+				// other tests may have sessions open
+				if strings.HasPrefix(info.ID, "sess-") {
+					ids = append(ids, info.ID)
+				}
+			}
+			if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+				t.Errorf("sessions %v, expected %v", ids, test.ids)
+			}
+		})
+	}
+}
+
+func TestSessionsGet(t *testing.T) {
+	sess := testSession(t, "sess-get", "rws.local:8800/ws")
+	sess.delivered("s1", "5-0", 3)
+
+	w := sessionsRequest(t, http.MethodGet, "/sessions/sess-get", "secret-token")
+	var info sessionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, error %v: %s", w.Code, err, w.Body)
+	}
+	if info.Positions["s1"] != "5-0" || info.MessagesSent != 3 || info.Endpoint != "rws.local:8800/ws" {
+		t.Errorf("session %+v", info)
+	}
+
+	w = sessionsRequest(t, http.MethodGet, "/sessions/unknown", "secret-token")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown session answered %d, expected %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestSessionsKill(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		code   int
+		closed sessionClose
+		killed []string
+	}{
+		{name: "default close frame", path: "/sessions/kill-1", code: http.StatusOK, closed: sessionClose{code: ws.StatusNormalClosure, reason: defaultKillReason}, killed: []string{"kill-1"}},
+		{name: "code and reason", path: "/sessions/kill-1?code=4001&reason=bye", code: http.StatusOK, closed: sessionClose{code: 4001, reason: "bye"}, killed: []string{"kill-1"}},
+		{name: "by endpoint", path: "/sessions?endpoint=rws.local:8800/ws", code: http.StatusOK, closed: sessionClose{code: ws.StatusNormalClosure, reason: defaultKillReason}, killed: []string{"kill-1", "kill-2"}},
+		{name: "unknown session", path: "/sessions/unknown", code: http.StatusNotFound},
+		{name: "no session or endpoint", path: "/sessions", code: http.StatusBadRequest},
+		{name: "reserved code", path: "/sessions/kill-1?code=1005", code: http.StatusBadRequest},
+		{name: "code not a number", path: "/sessions/kill-1?code=going", code: http.StatusBadRequest},
+		{name: "reason too long", path: "/sessions/kill-1?reason=" + strings.Repeat("x", 124), code: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sessions := map[string]*session{
+				"kill-1": testSession(t, "kill-1", "rws.local:8800/ws"),
+				"kill-2": testSession(t, "kill-2", "rws.local:8800/ws"),
+				"kill-3": testSession(t, "kill-3", "rws.local:8800/other"),
+			}
+			w := sessionsRequest(t, http.MethodDelete, test.path, "secret-token")
+			if w.Code != test.code {
+				t.Fatalf("status %d, expected %d: %s", w.Code, test.code, w.Body)
+			}
+			for id, sess := range sessions {
+				select {
+				case closed := <-sess.chKill:
+					if !strings.Contains(strings.Join(test.killed, ","), id) {
+						t.Errorf("session %s closed", id)
+					} else if closed != test.closed {
+						t.Errorf("session %s closed with %v, expected %v", id, closed, test.closed)
+					}
+				default:
+					if strings.Contains(strings.Join(test.killed, ","), id) {
+						t.Errorf("session %s not closed", id)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSessionsMethodNotAllowed(t *testing.T) {
+	w := sessionsRequest(t, http.MethodPost, "/sessions", "secret-token")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, DELETE" {
+		t.Errorf("status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
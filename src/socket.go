@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// unixPrefix marks an address as path of a unix domain socket
+	unixPrefix = "unix:"
+	// systemdPrefix marks an address as socket passed by systemd, named by FileDescriptorName=
+	systemdPrefix = "systemd:"
+	// listenFDsStart first file descriptor passed by systemd socket activation
+	listenFDsStart = 3
+)
+
+// socketMode returns permissions of socket.mode, zero when unset
+func (listener ConfigListener) socketMode() (os.FileMode, error) {
+	if listener.SocketMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(listener.SocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid socket.mode [%s], expected octal permissions like 0660", listener.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listen returns listener of address: a socket passed by systemd, a unix
+// domain socket created with mode and group when set, or a TCP port
+func listen(address string, mode os.FileMode, group string) (net.Listener, error) {
+	if listener := activatedListener(address); listener != nil {
+		slog.Info("Using inherited socket", "address", address)
+		return listener, nil
+	}
+	if strings.HasPrefix(address, systemdPrefix) {
+		return nil, fmt.Errorf("no socket named %s passed by systemd", strings.TrimPrefix(address, systemdPrefix))
+	}
+	path, isUnix := strings.CutPrefix(address, unixPrefix)
+	if !isUnix {
+		return net.Listen("tcp", address)
+	}
+	// a socket left by a process which did not stop cleanly is replaced
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if group != "" {
+		found, err := user.LookupGroup(group)
+		if err == nil {
+			var gid int
+			if gid, err = strconv.Atoi(found.Gid); err == nil {
+				err = os.Chown(path, -1, gid)
+			}
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("can't set group of socket %s: %v", path, err)
+		}
+	}
+	return listener, nil
+}
+
+// activated sockets passed by systemd socket activation not used yet
+var activated struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners []activatedSocket
+}
+
+// activatedSocket socket passed by systemd with its FileDescriptorName=, or
+// handed over by the process restarting rws with its address
+type activatedSocket struct {
+	name     string
+	address  string
+	listener net.Listener
+}
+
+// activatedListener returns the socket passed by systemd or the restarting
+// process for address, which is either systemd:<name> or the address the
+// socket is bound to, nil without one, every socket is handed out once
+func activatedListener(address string) net.Listener {
+	activated.once.Do(func() {
+		activated.listeners = append(listenFDs(), inheritedListeners()...)
+	})
+	activated.mu.Lock()
+	defer activated.mu.Unlock()
+	for i, socket := range activated.listeners {
+		if address == socket.address || address == systemdPrefix+socket.name || sameAddress(address, socket.listener.Addr()) {
+			activated.listeners = append(activated.listeners[:i], activated.listeners[i+1:]...)
+			return socket.listener
+		}
+	}
+	return nil
+}
+
+// listenFDs returns sockets passed by systemd socket activation, see sd_listen_fds(3)
+func listenFDs() []activatedSocket {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// processes started by rws must not take the sockets for their own
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	sockets := make([]activatedSocket, 0, count)
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			slog.Warn("Socket passed by systemd is not a stream listener", "name", name, "error", err)
+			continue
+		}
+		sockets = append(sockets, activatedSocket{name: name, listener: listener})
+	}
+	return sockets
+}
+
+// sameAddress reports whether configured address is the one bound by a socket
+func sameAddress(address string, bound net.Addr) bool {
+	if path, isUnix := strings.CutPrefix(address, unixPrefix); isUnix {
+		return bound.Network() == "unix" && bound.String() == path
+	}
+	tcp, isTCP := bound.(*net.TCPAddr)
+	if !isTCP {
+		return false
+	}
+	resolved, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil || resolved.Port != tcp.Port {
+		return false
+	}
+	return resolved.IP == nil || resolved.IP.IsUnspecified() && tcp.IP.IsUnspecified() || resolved.IP.Equal(tcp.IP)
+}
+
+// notify sends state to the service manager, see sd_notify(3), without
+// NOTIFY_SOCKET rws is not run by systemd and nothing is sent
+func notify(state string) {
+	address := os.Getenv("NOTIFY_SOCKET")
+	if address == "" {
+		return
+	}
+	if strings.HasPrefix(address, "@") {
+		// abstract namespace
+		address = "\x00" + address[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: address, Net: "unixgram"})
+	if err == nil {
+		defer conn.Close()
+		_, err = conn.Write([]byte(state))
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Can't notify systemd", "state", state, "error", err)
+	}
+}
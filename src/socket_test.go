@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSocketMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected os.FileMode
+		err      bool
+	}{
+		{mode: "", expected: 0},
+		{mode: "0660", expected: 0o660},
+		{mode: "660", expected: 0o660},
+		{mode: "0777", expected: 0o777},
+		{mode: "1777", err: true},
+		{mode: "0668", err: true},
+		{mode: "rw-rw----", err: true},
+		{mode: "-1", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			mode, err := ConfigListener{SocketMode: test.mode}.socketMode()
+			if test.err {
+				expected := "invalid socket.mode [" + test.mode + "], expected octal permissions like 0660"
+				if err == nil || err.Error() != expected {
+					t.Errorf("error %v, expected %s", err, expected)
+				}
+				return
+			}
+			if err != nil || mode != test.expected {
+				t.Errorf("mode %v %v, expected %v", mode, err, test.expected)
+			}
+		})
+	}
+}
+
+func TestSameAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		bound    net.Addr
+		expected bool
+	}{
+		{name: "any interface", address: ":8800", bound: &net.TCPAddr{IP: net.IPv6unspecified, Port: 8800}, expected: true},
+		{name: "port of any ip", address: ":8800", bound: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8800}, expected: true},
+		{name: "unspecified ip", address: "0.0.0.0:8800", bound: &net.TCPAddr{IP: net.IPv6unspecified, Port: 8800}, expected: true},
+		{name: "same ip", address: "127.0.0.1:8800", bound: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8800}, expected: true},
+		{name: "other ip", address: "127.0.0.1:8800", bound: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8800}},
+		{name: "ip bound to any interface", address: "127.0.0.1:8800", bound: &net.TCPAddr{IP: net.IPv4zero, Port: 8800}},
+		{name: "other port", address: ":8800", bound: &net.TCPAddr{Port: 8801}},
+		{name: "unresolvable", address: "no-such-host.invalid:8800", bound: &net.TCPAddr{Port: 8800}},
+		{name: "unix", address: "unix:/run/rws.sock", bound: &net.UnixAddr{Name: "/run/rws.sock", Net: "unix"}, expected: true},
+		{name: "other unix path", address: "unix:/run/rws.sock", bound: &net.UnixAddr{Name: "/run/other.sock", Net: "unix"}},
+		{name: "unix bound to tcp", address: "unix:/run/rws.sock", bound: &net.TCPAddr{Port: 8800}},
+		{name: "tcp bound to unix", address: ":8800", bound: &net.UnixAddr{Name: ":8800", Net: "unix"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := sameAddress(test.address, test.bound); same != test.expected {
+				t.Errorf("same %v, expected %v", same, test.expected)
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rws.sock")
+	listener, err := listen(unixPrefix+path, 0o600, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode %v, expected socket with 0600", info.Mode())
+	}
+	if _, err := listen(unixPrefix+path, 0, ""); err == nil || err.Error() != "socket "+path+" is in use" {
+		t.Errorf("error %v listening on a socket in use", err)
+	}
+	// a socket left behind is replaced
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listen(unixPrefix+path, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gobwas/ws"
+	"github.com/redis/go-redis/v9"
+)
+
+// subprotocols negotiated through Sec-WebSocket-Protocol
+const (
+	protocolJSON     = "rws.json.v1"
+	protocolMsgpack  = "rws.msgpack.v1"
+	protocolEnvelope = "rws.envelope.v1"
+)
+
+// defaultSubprotocols subprotocols offered without delivery.subprotocols
+var defaultSubprotocols = []string{protocolJSON, protocolMsgpack, protocolEnvelope}
+
+// entryFormat wire format of the entries of a stream
+type entryFormat struct {
+	op ws.OpCode
+	// element returns an entry encoded as one element of a message
+	element func(message redis.XMessage, messageType string) ([]byte, error)
+	// join returns message of a stream holding elements
+	join func(stream string, elements [][]byte) []byte
+	// size returns size of a message of count elements of elementBytes in total
+	size func(stream string, count int, elementBytes int) int
+}
+
+// entryFormats formats by subprotocol, no subprotocol means rws.json.v1
+var entryFormats = map[string]entryFormat{
+	protocolJSON: {
+		op:      ws.OpBinary,
+		element: jsonElement,
+		join: func(_ string, elements [][]byte) []byte {
+			return joinJSON([]byte("["), elements, []byte("]"))
+		},
+		size: func(_ string, count int, elementBytes int) int {
+			return 2 + elementBytes + max(count-1, 0)
+		},
+	},
+	protocolMsgpack: {
+		op:      ws.OpBinary,
+		element: msgpackElement,
+		join: func(_ string, elements [][]byte) []byte {
+			return bytes.Join(append([][]byte{appendMsgpackHeader(nil, len(elements), 0x90, 0xdc)}, elements...), nil)
+		},
+		size: func(_ string, count int, elementBytes int) int {
+			return len(appendMsgpackHeader(nil, count, 0x90, 0xdc)) + elementBytes
+		},
+	},
+	protocolEnvelope: {
+		op:      ws.OpText,
+		element: jsonElement,
+		join: func(stream string, elements [][]byte) []byte {
+			return joinJSON(envelopePrefix(stream), elements, []byte("]}"))
+		},
+		size: func(stream string, count int, elementBytes int) int {
+			return len(envelopePrefix(stream)) + 2 + elementBytes + max(count-1, 0)
+		},
+	},
+}
+
+// jsonElement returns entry as element of a JSON array
+func jsonElement(message redis.XMessage, messageType string) ([]byte, error) {
+	encoded, err := JSONBytesMake([]redis.XMessage{message}, messageType)
+	if err != nil {
+		return nil, err
+	}
+	// the element without the brackets of its array
+	return encoded[1 : len(encoded)-1], nil
+}
+
+// msgpackElement returns entry as MessagePack map of ID and Values
+func msgpackElement(message redis.XMessage, messageType string) ([]byte, error) {
+	values := message.Values
+	if messageType == "json" {
+		var err error
+		if values, err = unescapeValues(values); err != nil {
+			return nil, err
+		}
+	}
+	return appendMsgpack(nil, map[string]interface{}{"ID": message.ID, "Values": values}), nil
+}
+
+func joinJSON(prefix []byte, elements [][]byte, suffix []byte) []byte {
+	payload := append([]byte{}, prefix...)
+	for i, element := range elements {
+		if i > 0 {
+			payload = append(payload, ',')
+		}
+		payload = append(payload, element...)
+	}
+	return append(payload, suffix...)
+}
+
+// envelopePrefix start of an envelope of entries up to the first one
+func envelopePrefix(stream string) []byte {
+	name, _ := json.Marshal(stream)
+	return []byte(`{"event":"entries","stream":` + string(name) + `,"entries":[`)
+}
+
+// requestedSubprotocols returns subprotocols requested by the client
+func requestedSubprotocols(r *http.Request) []string {
+	requested := make([]string, 0)
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				requested = append(requested, protocol)
+			}
+		}
+	}
+	return requested
+}
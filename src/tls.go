@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval how often certificate files are checked for changes
+const certCheckInterval = 5 * time.Second
+
+// tlsVersions values of tls.min.version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// clientAuthTypes values of tls.client.auth, a requested certificate is
+// verified when the client sends one
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// listener returns TLS settings of address: its entry of listeners or, without
+// one, the global tls.* settings
+func (config *Config) listener(address string) ConfigListener {
+	for _, listener := range config.Listeners {
+		if listener.Address == address {
+			return listener
+		}
+	}
+	listener := config.globalTLS()
+	listener.Address = address
+	return listener
+}
+
+// globalTLS returns the global tls.* settings
+func (config *Config) globalTLS() ConfigListener {
+	return ConfigListener{
+		TLSCertFile:     config.TLSCertFile,
+		TLSKeyFile:      config.TLSKeyFile,
+		TLSMinVersion:   config.TLSMinVersion,
+		TLSCiphers:      config.TLSCiphers,
+		TLSClientCAFile: config.TLSClientCAFile,
+		TLSClientAuth:   config.TLSClientAuth,
+	}
+}
+
+// certificates returns certificate pairs of the listener, tls.cert.file first
+func (listener ConfigListener) certificates() []ConfigCertificate {
+	pairs := make([]ConfigCertificate, 0, len(listener.TLSCertificates)+1)
+	if listener.TLSCertFile != "" {
+		pairs = append(pairs, ConfigCertificate{CertFile: listener.TLSCertFile, KeyFile: listener.TLSKeyFile})
+	}
+	return append(pairs, listener.TLSCertificates...)
+}
+
+// cipherSuites returns IDs of cipher suite names
+func cipherSuites(names []string) ([]uint16, error) {
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite [%s]", name)
+		}
+	}
+	return ids, nil
+}
+
+// clientAuth returns client certificate verification of the listener, CAs
+// are nil without tls.client.ca.file
+func (listener ConfigListener) clientAuth() (tls.ClientAuthType, *x509.CertPool, error) {
+	if listener.TLSClientCAFile == "" {
+		if listener.TLSClientAuth != "" {
+			return tls.NoClientCert, nil, errors.New("tls.client.auth needs tls.client.ca.file")
+		}
+		return tls.NoClientCert, nil, nil
+	}
+	auth := tls.RequireAndVerifyClientCert
+	if listener.TLSClientAuth != "" {
+		var exists bool
+		if auth, exists = clientAuthTypes[listener.TLSClientAuth]; !exists {
+			return tls.NoClientCert, nil, fmt.Errorf("invalid tls.client.auth [%s], expected request or require", listener.TLSClientAuth)
+		}
+	}
+	pem, err := os.ReadFile(listener.TLSClientCAFile)
+	if err != nil {
+		return tls.NoClientCert, nil, fmt.Errorf("can't read client CA file %s: %v", listener.TLSClientCAFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return tls.NoClientCert, nil, fmt.Errorf("no certificate in client CA file %s", listener.TLSClientCAFile)
+	}
+	return auth, pool, nil
+}
+
+// listenerTLS TLS settings of a listener, certificates are picked by SNI and
+// reloaded when their files change
+type listenerTLS struct {
+	minVersion uint16
+	ciphers    []uint16
+	pairs      []*certificatePair
+	clientAuth tls.ClientAuthType
+	clientCAs  *x509.CertPool
+	// tlsConfig is built once, a config per handshake would break session resumption
+	tlsConfig *tls.Config
+}
+
+// newListenerTLS loads certificates of listener, nil when it serves plain HTTP
+func newListenerTLS(listener ConfigListener) (*listenerTLS, error) {
+	configs := listener.certificates()
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	settings := &listenerTLS{minVersion: tls.VersionTLS12}
+	if listener.TLSMinVersion != "" {
+		version, exists := tlsVersions[listener.TLSMinVersion]
+		if !exists {
+			return nil, fmt.Errorf("invalid tls.min.version [%s], expected 1.0, 1.1, 1.2 or 1.3", listener.TLSMinVersion)
+		}
+		settings.minVersion = version
+	}
+	var err error
+	if settings.ciphers, err = cipherSuites(listener.TLSCiphers); err != nil {
+		return nil, err
+	}
+	if settings.clientAuth, settings.clientCAs, err = listener.clientAuth(); err != nil {
+		return nil, err
+	}
+	for _, config := range configs {
+		pair := &certificatePair{certFile: config.CertFile, keyFile: config.KeyFile}
+		if err := pair.load(); err != nil {
+			return nil, err
+		}
+		settings.pairs = append(settings.pairs, pair)
+	}
+	// certificates are picked per handshake, a reloaded pair needs no new config
+	settings.tlsConfig = &tls.Config{
+		MinVersion:     settings.minVersion,
+		CipherSuites:   settings.ciphers,
+		GetCertificate: settings.certificate,
+		ClientAuth:     settings.clientAuth,
+		ClientCAs:      settings.clientCAs,
+	}
+	return settings, nil
+}
+
+// config returns tls.Config of the settings, the same one until a config
+// reload replaces the settings
+func (settings *listenerTLS) config() *tls.Config {
+	return settings.tlsConfig
+}
+
+// certificate returns the first certificate valid for the server name of
+// hello, the first one when none is
+func (settings *listenerTLS) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var first *tls.Certificate
+	for _, pair := range settings.pairs {
+		cert := pair.current()
+		if first == nil {
+			first = cert
+		}
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	if first == nil {
+		return nil, errors.New("no certificate")
+	}
+	return first, nil
+}
+
+// certificatePair certificate loaded from files, reloaded when they change
+type certificatePair struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+	checked  time.Time
+}
+
+// load reads the files of the pair
+func (pair *certificatePair) load() error {
+	modified := pair.modTime()
+	cert, err := tls.LoadX509KeyPair(pair.certFile, pair.keyFile)
+	if err != nil {
+		return fmt.Errorf("can't load certificate %s: %v", pair.certFile, err)
+	}
+	pair.cert, pair.modified, pair.checked = &cert, modified, time.Now()
+	return nil
+}
+
+// current returns the certificate, reloaded when its files changed, a pair
+// which fails to load keeps the certificate loaded before
+func (pair *certificatePair) current() *tls.Certificate {
+	pair.mu.Lock()
+	defer pair.mu.Unlock()
+	if time.Since(pair.checked) < certCheckInterval {
+		return pair.cert
+	}
+	pair.checked = time.Now()
+	if modified := pair.modTime(); modified.After(pair.modified) {
+		if err := pair.load(); err != nil {
+			// tried again once the files change again
+			pair.modified = modified
+			slog.Error("Certificate reload failed", "file", pair.certFile, "error", err)
+		} else {
+			slog.Info("Certificate reloaded", "file", pair.certFile)
+		}
+	}
+	return pair.cert
+}
+
+// modTime returns the latest modification time of the files
+func (pair *certificatePair) modTime() time.Time {
+	var modified time.Time
+	for _, file := range []string{pair.certFile, pair.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified
+}
+
+// requestIdentity returns user identity of the request, the subject of a
+// verified client certificate, empty when unknown
+func requestIdentity(r *http.Request) string {
+	if cert := verifiedCertificate(r); cert != nil {
+		return cert.Subject.String()
+	}
+	return ""
+}
+
+// requestSANs returns subject alternative names of a verified client
+// certificate of the request: DNS names, email addresses, IPs and URIs
+func requestSANs(r *http.Request) []string {
+	cert := verifiedCertificate(r)
+	if cert == nil {
+		return nil
+	}
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// verifiedCertificate returns the client certificate of the request verified
+// against tls.client.ca.file, nil without one
+func verifiedCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate of name for dnsNames to
+// dir and returns its certificate and key files
+func writeCertificate(t *testing.T, dir string, name string, dnsNames ...string) ConfigCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := ConfigCertificate{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	if err := os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// handshakeCertificate returns the common name of the certificate the
+// listener presents to a client asking for serverName
+func handshakeCertificate(t *testing.T, settings *listenerTLS, serverName string) string {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		tls.Server(serverConn, settings.config()).Handshake()
+	}()
+	client := tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return client.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestListenerCertificateBySNI(t *testing.T) {
+	dir := t.TempDir()
+	primary := writeCertificate(t, dir, "main", "rws.example.com")
+	listener := ConfigListener{
+		Address:     ":8443",
+		TLSCertFile: primary.CertFile,
+		TLSKeyFile:  primary.KeyFile,
+		TLSCertificates: []ConfigCertificate{
+			writeCertificate(t, dir, "api", "api.example.com"),
+			writeCertificate(t, dir, "wildcard", "*.example.org"),
+		},
+	}
+	settings, err := newListenerTLS(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{serverName: "rws.example.com", expected: "main"},
+		{serverName: "api.example.com", expected: "api"},
+		{serverName: "ws.example.org", expected: "wildcard"},
+		{serverName: "unknown.example.net", expected: "main"},
+		{serverName: "", expected: "main"},
+	}
+	for _, test := range tests {
+		t.Run(test.serverName, func(t *testing.T) {
+			if name := handshakeCertificate(t, settings, test.serverName); name != test.expected {
+				t.Errorf("certificate %s, expected %s", name, test.expected)
+			}
+		})
+	}
+}
+
+func TestNewListenerTLS(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeCertificate(t, dir, "main", "rws.example.com")
+	tests := []struct {
+		name     string
+		listener ConfigListener
+		plain    bool
+		err      string
+	}{
+		{name: "plain http", listener: ConfigListener{Address: ":8800"}, plain: true},
+		{name: "certificates only", listener: ConfigListener{TLSCertificates: []ConfigCertificate{pair}}},
+		{name: "invalid min version", listener: ConfigListener{TLSCertFile: pair.CertFile, TLSKeyFile: pair.KeyFile, TLSMinVersion: "1.4"}, err: "invalid tls.min.version [1.4], expected 1.0, 1.1, 1.2 or 1.3"},
+		{name: "unknown cipher", listener: ConfigListener{TLSCertFile: pair.CertFile, TLSKeyFile: pair.KeyFile, TLSCiphers: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, err: "unknown or insecure cipher suite [TLS_RSA_WITH_RC4_128_SHA]"},
+		{name: "missing key", listener: ConfigListener{TLSCertFile: pair.CertFile, TLSKeyFile: filepath.Join(dir, "missing.key")}, err: "can't load certificate " + pair.CertFile + ": open " + filepath.Join(dir, "missing.key") + ": no such file or directory"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := newListenerTLS(test.listener)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("error %v, expected %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (settings == nil) != test.plain {
+				t.Errorf("settings %v, expected plain %v", settings, test.plain)
+			}
+		})
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCertificate(t, dir, "ca")
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("no certificate here\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		listener ConfigListener
+		auth     tls.ClientAuthType
+		pool     bool
+		err      string
+	}{
+		{name: "off", listener: ConfigListener{}, auth: tls.NoClientCert},
+		{name: "require by default", listener: ConfigListener{TLSClientCAFile: ca.CertFile}, auth: tls.RequireAndVerifyClientCert, pool: true},
+		{name: "require", listener: ConfigListener{TLSClientCAFile: ca.CertFile, TLSClientAuth: "require"}, auth: tls.RequireAndVerifyClientCert, pool: true},
+		{name: "request", listener: ConfigListener{TLSClientCAFile: ca.CertFile, TLSClientAuth: "request"}, auth: tls.VerifyClientCertIfGiven, pool: true},
+		{name: "auth without ca", listener: ConfigListener{TLSClientAuth: "require"}, err: "tls.client.auth needs tls.client.ca.file"},
+		{name: "unknown mode", listener: ConfigListener{TLSClientCAFile: ca.CertFile, TLSClientAuth: "optional"}, err: "invalid tls.client.auth [optional], expected request or require"},
+		{name: "missing ca file", listener: ConfigListener{TLSClientCAFile: filepath.Join(dir, "missing.pem")}, err: "can't read client CA file " + filepath.Join(dir, "missing.pem") + ": open " + filepath.Join(dir, "missing.pem") + ": no such file or directory"},
+		{name: "no certificate in ca file", listener: ConfigListener{TLSClientCAFile: empty}, err: "no certificate in client CA file " + empty},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			auth, pool, err := test.listener.clientAuth()
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("error %v, expected %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if auth != test.auth || (pool != nil) != test.pool {
+				t.Errorf("auth %v with pool %v, expected %v with pool %v", auth, pool != nil, test.auth, test.pool)
+			}
+		})
+	}
+}
+
+func TestGlobalClientAuth(t *testing.T) {
+	config := &Config{
+		TLSClientCAFile: "/etc/rws/clients.pem",
+		TLSClientAuth:   "request",
+		Listeners:       []ConfigListener{{Address: ":8443", TLSClientAuth: "require"}},
+	}
+	if listener := config.listener(":9443"); listener.TLSClientCAFile != config.TLSClientCAFile || listener.TLSClientAuth != "request" {
+		t.Errorf("address without entry got %+v, expected the global tls.client.* keys", listener)
+	}
+	if listener := config.listener(":8443"); listener.TLSClientCAFile != "" || listener.TLSClientAuth != "require" {
+		t.Errorf("address with entry got %+v, expected its own keys", listener)
+	}
+}
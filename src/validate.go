@@ -0,0 +1,582 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigIssue problem found in config file, warnings don't prevent start
+type ConfigIssue struct {
+	Line    int
+	Column  int
+	Warning bool
+	Message string
+}
+
+// Format formats issue as "file:line:column: level: message"
+func (issue ConfigIssue) Format(filename string) string {
+	level := "error"
+	if issue.Warning {
+		level = "warning"
+	}
+	if issue.Line == 0 {
+		return fmt.Sprintf("%s: %s: %s", filename, level, issue.Message)
+	} else if issue.Column == 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", filename, issue.Line, level, issue.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", filename, issue.Line, issue.Column, level, issue.Message)
+}
+
+// ConfigError all errors of invalid config file
+type ConfigError struct {
+	Filename string
+	Issues   []ConfigIssue
+}
+
+func (e *ConfigError) Error() string {
+	lines := []string{fmt.Sprintf("Invalid config file %s:", e.Filename)}
+	for _, issue := range e.Issues {
+		lines = append(lines, issue.Format(e.Filename))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// configSource config file parsed and validated, yaml nodes are kept for line numbers
+type configSource struct {
+	filename string
+	content  []byte
+	root     yaml.Node
+	config   Config
+	issues   []ConfigIssue
+	secrets  []string
+}
+
+var rexYAMLLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+var rexSecretKey = regexp.MustCompile(`(?i)(password|passwd|secret|token)`)
+var rexStreamID = regexp.MustCompile(`^\d+(-\d+)?$`)
+
+// readConfigSource reads config file content
+func readConfigSource(filename string) (*configSource, error) {
+	fileContent, err := os.ReadFile(filename)
+	if err != nil {
+		absPath, _ := filepath.Abs(filename)
+		return nil, fmt.Errorf("Error while reading %v file: \n%v ", absPath, err)
+	}
+	return &configSource{filename: filename, content: fileContent}, nil
+}
+
+// parseConfig reads config file and collects every problem in it, error is
+// returned only when the file can't be read. Schema 1.0 is migrated to 2.0
+// before decoding, so validation only knows the current schema, keys which
+// would change how a 1.0 file behaves are left to -migrate.
+func parseConfig(filename string) (*configSource, error) {
+	src, err := readConfigSource(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(src.content, &src.root); err != nil {
+		src.yamlIssues(err)
+		return src, nil
+	}
+	if src.root.Kind == 0 {
+		src.errorf(nil, "config file is empty")
+		return src, nil
+	}
+	doc := src.root.Content[0]
+	switch version, versionNode := schemaVersion(doc); version {
+	case currentSchemaVersion:
+	case "1.0":
+		src.warnf(orNode(versionNode, doc), "schema.version 1.0 is deprecated, run rws -migrate to convert the file to %s", currentSchemaVersion)
+		src.warnPlaceholders(doc)
+		src.migrate(doc, false)
+	default:
+		src.errorf(versionNode, "unsupported schema.version %q, expected 1.0 or %s", version, currentSchemaVersion)
+		return src, nil
+	}
+	src.interpolate(&src.root, false)
+	if err := src.root.Decode(&src.config); err != nil {
+		src.yamlIssues(err)
+	}
+	src.checkKeys(src.root.Content[0], reflect.TypeOf(src.config), "")
+	src.validate()
+	for i := range src.issues {
+		src.issues[i].Message = src.redact(src.issues[i].Message)
+	}
+	sort.SliceStable(src.issues, func(i, j int) bool {
+		return src.issues[i].Line < src.issues[j].Line
+	})
+	return src, nil
+}
+
+// errors returns error issues only
+func (src *configSource) errors() []ConfigIssue {
+	result := make([]ConfigIssue, 0)
+	for _, issue := range src.issues {
+		if !issue.Warning {
+			result = append(result, issue)
+		}
+	}
+	return result
+}
+
+func (src *configSource) issue(node *yaml.Node, warning bool, format string, args ...interface{}) {
+	issue := ConfigIssue{Warning: warning, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		issue.Line, issue.Column = node.Line, node.Column
+	}
+	src.issues = append(src.issues, issue)
+}
+
+func (src *configSource) errorf(node *yaml.Node, format string, args ...interface{}) {
+	src.issue(node, false, format, args...)
+}
+
+func (src *configSource) warnf(node *yaml.Node, format string, args ...interface{}) {
+	src.issue(node, true, format, args...)
+}
+
+// yamlIssues converts yaml syntax and type errors into issues
+func (src *configSource) yamlIssues(err error) {
+	messages := []string{err.Error()}
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		messages = typeError.Errors
+	}
+	for _, message := range messages {
+		issue := ConfigIssue{Message: message}
+		if submatch := rexYAMLLine.FindStringSubmatch(message); len(submatch) > 0 {
+			issue.Line, _ = strconv.Atoi(submatch[1])
+			issue.Message = submatch[2]
+		}
+		src.issues = append(src.issues, issue)
+	}
+}
+
+// checkKeys warns about keys which don't match any field of t
+func (src *configSource) checkKeys(node *yaml.Node, t reflect.Type, key string) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		if t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode {
+			for _, item := range node.Content {
+				src.checkKeys(item, t.Elem(), key)
+			}
+			return
+		}
+		t = t.Elem()
+	}
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	var known map[string]reflect.Type
+	switch t.Kind() {
+	case reflect.Struct:
+		known = make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; tag != "" && tag != "-" {
+				known[tag] = t.Field(i).Type
+			}
+		}
+	default:
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		if fieldType, exists := known[keyNode.Value]; exists {
+			src.checkKeys(valueNode, fieldType, keyNode.Value)
+		} else if key == "" {
+			src.warnf(keyNode, "unknown key %q is ignored", keyNode.Value)
+		} else {
+			src.warnf(keyNode, "unknown key %q in %s is ignored", keyNode.Value, key)
+		}
+	}
+}
+
+// mappingValue returns value node of key in mapping node or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// nodePath returns the deepest node found by following keys from node
+func nodePath(node *yaml.Node, keys ...string) *yaml.Node {
+	for _, key := range keys {
+		value := mappingValue(node, key)
+		if value == nil {
+			break
+		}
+		node = value
+	}
+	return node
+}
+
+// orNode returns the first not nil node
+func orNode(nodes ...*yaml.Node) *yaml.Node {
+	for _, node := range nodes {
+		if node != nil {
+			return node
+		}
+	}
+	return nil
+}
+
+// validate checks values of the decoded config
+func (src *configSource) validate() {
+	config := &src.config
+	doc := src.root.Content[0]
+
+	src.validateTLS(doc, config.globalTLS(), "")
+	listenersNode := mappingValue(doc, "listeners")
+	listenerAddresses := make(map[string]bool)
+	for i, listener := range config.Listeners {
+		listenerNode := orNode(listenersNode, doc)
+		if listenersNode != nil && listenersNode.Kind == yaml.SequenceNode && i < len(listenersNode.Content) {
+			listenerNode = listenersNode.Content[i]
+		}
+		if listener.Address == "" {
+			src.errorf(listenerNode, "address of listeners must be defined")
+			continue
+		}
+		if listenerAddresses[listener.Address] {
+			src.errorf(listenerNode, "listener [%s] already defined", listener.Address)
+		}
+		listenerAddresses[listener.Address] = true
+		if !slices.ContainsFunc(config.Endpoints, func(endpoint ConfigEndpoint) bool { return endpoint.Address == listener.Address }) {
+			src.warnf(listenerNode, "listener [%s] has no endpoints and is ignored", listener.Address)
+		}
+		src.validateTLS(listenerNode, listener, "listeners ")
+		if _, err := listener.socketMode(); err != nil {
+			src.errorf(mappingValue(listenerNode, "socket.mode"), "%v, listener [%s]", err, listener.Address)
+		}
+		if !strings.HasPrefix(listener.Address, unixPrefix) && (listener.SocketMode != "" || listener.SocketGroup != "") {
+			src.warnf(orNode(mappingValue(listenerNode, "socket.mode"), mappingValue(listenerNode, "socket.group")), "socket.mode and socket.group apply to unix:/path addresses only, listener [%s]", listener.Address)
+		}
+	}
+	if _, _, err := parseTrustedProxies(config.TrustedProxies); err != nil {
+		src.errorf(mappingValue(doc, "trusted.proxies"), "%v", err)
+	}
+	if _, err := parseBaseURL(config.PublicBaseURL); err != nil {
+		src.errorf(mappingValue(doc, "public.base.url"), "%v", err)
+	}
+	if config.ShutdownTimeout < 0 {
+		src.errorf(mappingValue(doc, "shutdown.timeout"), "shutdown.timeout can't be negative")
+	}
+	if config.WatchInterval < 0 {
+		src.errorf(mappingValue(doc, "config.watch.interval"), "config.watch.interval can't be negative")
+	}
+	if _, exists := logLevels[strings.ToLower(config.LogLevel)]; config.LogLevel != "" && !exists {
+		src.errorf(mappingValue(doc, "log.level"), "invalid log.level [%s], expected debug, info, warn or error", config.LogLevel)
+	}
+	if format := strings.ToLower(config.LogFormat); format != "" && format != "text" && format != "json" {
+		src.errorf(mappingValue(doc, "log.format"), "invalid log.format [%s], expected text or json", config.LogFormat)
+	}
+
+	adminPaths := map[string]string{
+		"metrics.path":  config.MetricsPath,
+		"health.path":   config.HealthPath,
+		"ready.path":    config.ReadyPath,
+		"sessions.path": config.SessionsPath,
+	}
+	for key, path := range adminPaths {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			src.errorf(mappingValue(doc, key), "%s must start with /", key)
+		}
+		if path != "" && config.AdminAddress == "" && !config.AdminPublic {
+			src.warnf(mappingValue(doc, key), "%s is not served without admin.address, set admin.public to serve it on endpoint addresses", key)
+		}
+	}
+	if config.AdminPublic && config.AdminAddress != "" {
+		src.warnf(mappingValue(doc, "admin.public"), "admin.public is ignored with admin.address")
+	}
+	if config.LagInterval < 0 {
+		src.errorf(mappingValue(doc, "metrics.lag.interval"), "metrics.lag.interval can't be negative")
+	}
+	if config.StreamLimit < 0 {
+		src.errorf(mappingValue(doc, "metrics.stream.limit"), "metrics.stream.limit can't be negative")
+	}
+	if config.ReadyTimeout < 0 {
+		src.errorf(mappingValue(doc, "ready.timeout"), "ready.timeout can't be negative")
+	}
+	if config.ResumeSecret != "" && len(config.ResumeSecret) < minResumeSecretLength {
+		src.warnf(mappingValue(doc, "resume.secret"), "resume.secret is shorter than %d bytes", minResumeSecretLength)
+	}
+	if config.ResumeInterval < 0 {
+		src.errorf(mappingValue(doc, "resume.interval"), "resume.interval can't be negative")
+	}
+	if config.ResumeTTL < 0 {
+		src.errorf(mappingValue(doc, "resume.ttl"), "resume.ttl can't be negative")
+	}
+	if config.SessionsPath != "" && config.AdminToken == "" {
+		src.errorf(mappingValue(doc, "sessions.path"), "sessions.path requires admin.token")
+	}
+
+	itemsNode := mappingValue(doc, "endpoints")
+	if len(config.Endpoints) == 0 {
+		src.errorf(orNode(itemsNode, doc), "endpoints must define at least one entry")
+		return
+	}
+	testUIs := make(map[string]map[string]bool)
+	webSockets := make(map[string]map[string]bool)
+	for i, endpoint := range config.Endpoints {
+		itemNode := itemsNode
+		if itemsNode.Kind == yaml.SequenceNode && i < len(itemsNode.Content) {
+			itemNode = itemsNode.Content[i]
+		}
+		if endpoint.Address == "" {
+			src.errorf(itemNode, "address must be defined")
+		} else if endpoint.Address == unixPrefix || endpoint.Address == systemdPrefix {
+			src.errorf(mappingValue(itemNode, "address"), "address [%s] needs a socket path or name", endpoint.Address)
+		}
+		if endpoint.Connection.Address == "" {
+			src.errorf(nodePath(itemNode, "connection", "address"), "connection.address must be defined, address [%s]", endpoint.Address)
+		}
+		if endpoint.Connection.DB < 0 {
+			src.errorf(nodePath(itemNode, "connection", "db"), "connection.db can't be negative, address [%s]", endpoint.Address)
+		}
+		if start := endpoint.Source.Start; start != "" && start != "$" && !rexStreamID.MatchString(start) {
+			src.errorf(nodePath(itemNode, "source", "start"), "invalid source.start [%s], expected \"0\", \"$\" or an entry ID, address [%s]", start, endpoint.Address)
+		}
+		if endpoint.Source.DiscoveryInterval < 0 {
+			src.errorf(nodePath(itemNode, "source", "discovery.interval"), "source.discovery.interval can't be negative, address [%s]", endpoint.Address)
+		}
+		for _, protocol := range endpoint.Delivery.Subprotocols {
+			if _, exists := entryFormats[protocol]; !exists {
+				src.errorf(nodePath(itemNode, "delivery", "subprotocols"), "invalid delivery.subprotocols [%s], expected %s, address [%s]", protocol, strings.Join(defaultSubprotocols, ", "), endpoint.Address)
+			}
+		}
+		if level := endpoint.Delivery.CompressionLevel; level < 0 || level > 9 {
+			src.errorf(nodePath(itemNode, "delivery", "compression.level"), "invalid delivery.compression.level [%d], expected 1-9, address [%s]", level, endpoint.Address)
+		}
+		if endpoint.Delivery.CompressionMinSize < 0 {
+			src.errorf(nodePath(itemNode, "delivery", "compression.min.size"), "delivery.compression.min.size can't be negative, address [%s]", endpoint.Address)
+		}
+		if endpoint.Source.ReadCount < 0 {
+			src.errorf(nodePath(itemNode, "source", "read.count"), "source.read.count can't be negative, address [%s]", endpoint.Address)
+		}
+		accessNode := nodePath(itemNode, "source", "access")
+		for j, entry := range endpoint.Source.Access {
+			entryNode := accessNode
+			if accessNode.Kind == yaml.SequenceNode && j < len(accessNode.Content) {
+				entryNode = accessNode.Content[j]
+			}
+			if entry.Identity == "" {
+				src.errorf(entryNode, "identity of source.access is missing, address [%s]", endpoint.Address)
+			}
+			if len(entry.Streams) == 0 {
+				src.errorf(entryNode, "streams of source.access are missing, address [%s]", endpoint.Address)
+			}
+			for _, pattern := range entry.Streams {
+				if err := checkGlob(pattern); err != nil {
+					src.errorf(entryNode, "invalid source.access stream [%s], address [%s]", pattern, endpoint.Address)
+				}
+			}
+		}
+		if endpoint.Source.ReadBlock < 0 {
+			src.errorf(nodePath(itemNode, "source", "read.block"), "source.read.block can't be negative, address [%s]", endpoint.Address)
+		}
+		if endpoint.Delivery.BatchMaxBytes < 0 {
+			src.errorf(nodePath(itemNode, "delivery", "batch.max.bytes"), "delivery.batch.max.bytes can't be negative, address [%s]", endpoint.Address)
+		}
+		if endpoint.Delivery.BatchLinger < 0 {
+			src.errorf(nodePath(itemNode, "delivery", "batch.linger"), "delivery.batch.linger can't be negative, address [%s]", endpoint.Address)
+		}
+		if endpoint.Delivery.Ack && endpoint.Source.Group == "" {
+			src.errorf(nodePath(itemNode, "delivery", "ack"), "delivery.ack requires source.group, address [%s]", endpoint.Address)
+		}
+		if endpoint.Delivery.AckTimeout < 0 {
+			src.errorf(nodePath(itemNode, "delivery", "ack.timeout"), "delivery.ack.timeout can't be negative, address [%s]", endpoint.Address)
+		}
+		if endpoint.Delivery.SentinelValue != "" && endpoint.Delivery.SentinelField == "" {
+			src.errorf(nodePath(itemNode, "delivery", "sentinel.value"), "delivery.sentinel.value requires delivery.sentinel.field, address [%s]", endpoint.Address)
+		}
+		if endpoint.Delivery.SentinelWhen != "" && endpoint.Delivery.SentinelField != "" {
+			src.errorf(nodePath(itemNode, "delivery", "sentinel.when"), "delivery.sentinel.when can't be combined with delivery.sentinel.field, address [%s]", endpoint.Address)
+		} else if _, err := compileSentinel(endpoint.Delivery.SentinelWhen); err != nil {
+			src.errorf(nodePath(itemNode, "delivery", "sentinel.when"), "invalid delivery.sentinel.when: %v, address [%s]", err, endpoint.Address)
+		}
+		if scope := endpoint.Delivery.SentinelScope; scope != "" && scope != sentinelSocket && scope != sentinelStream && scope != sentinelNone {
+			src.errorf(nodePath(itemNode, "delivery", "sentinel.scope"), "invalid delivery.sentinel.scope [%s], expected socket, stream or none, address [%s]", scope, endpoint.Address)
+		}
+		if code := endpoint.Delivery.SentinelCode; code != 0 && !validCloseCode(code) {
+			src.errorf(nodePath(itemNode, "delivery", "sentinel.code"), "invalid delivery.sentinel.code [%d], expected 1000-1003, 1007-1014 or 3000-4999, address [%s]", code, endpoint.Address)
+		}
+		if len(endpoint.Delivery.SentinelReason) > 123 {
+			src.errorf(nodePath(itemNode, "delivery", "sentinel.reason"), "delivery.sentinel.reason is longer than 123 bytes, address [%s]", endpoint.Address)
+		}
+		if ttl := endpoint.Delivery.PresenceTTL; ttl != 0 && ttl < minPresenceTTL {
+			src.errorf(nodePath(itemNode, "delivery", "presence.ttl"), "delivery.presence.ttl [%s] is shorter than %s, address [%s]", ttl, minPresenceTTL, endpoint.Address)
+		}
+		for _, event := range []string{"on.open", "on.close"} {
+			hooks := endpoint.Delivery.OnOpen
+			if event == "on.close" {
+				hooks = endpoint.Delivery.OnClose
+			}
+			hooksNode := nodePath(itemNode, "delivery", event)
+			for j, hook := range hooks {
+				hookNode := hooksNode
+				if hooksNode.Kind == yaml.SequenceNode && j < len(hooksNode.Content) {
+					hookNode = hooksNode.Content[j]
+				}
+				if _, err := compileHook(hook); err != nil {
+					src.errorf(hookNode, "invalid delivery.%s hook: %v, address [%s]", event, err, endpoint.Address)
+				}
+			}
+		}
+		if messageType := endpoint.Delivery.MessageType; messageType != "" &&
+			messageType != "json" &&
+			messageType != "text" &&
+			messageType != "binary" {
+			src.errorf(nodePath(itemNode, "delivery", "message.type"), "invalid delivery.message.type [%s], expected json, text or binary, address [%s]", messageType, endpoint.Address)
+		}
+
+		testPath, wsPath := endpoint.paths()
+		pathNode := orNode(mappingValue(itemNode, "path.websocket"), mappingValue(itemNode, "path.test"), mappingValue(itemNode, "path.prefix"), itemNode)
+		if testPath == wsPath {
+			src.errorf(pathNode, "test path and websocket path can't be same [%s]", testPath)
+			continue
+		}
+		if testUIs[endpoint.Address] == nil {
+			testUIs[endpoint.Address] = make(map[string]bool)
+			webSockets[endpoint.Address] = make(map[string]bool)
+		}
+		if testUIs[endpoint.Address][testPath] {
+			src.errorf(pathNode, "test path [%s] already defined, address [%s]", testPath, endpoint.Address)
+		} else if webSockets[endpoint.Address][testPath] {
+			src.errorf(pathNode, "test path [%s] already defined as websocket path, address [%s]", testPath, endpoint.Address)
+		}
+		if webSockets[endpoint.Address][wsPath] {
+			src.errorf(pathNode, "websocket path [%s] already defined, address [%s]", wsPath, endpoint.Address)
+		} else if testUIs[endpoint.Address][wsPath] {
+			src.errorf(pathNode, "websocket path [%s] already defined as test path, address [%s]", wsPath, endpoint.Address)
+		}
+		for key, path := range adminPaths {
+			if config.AdminAddress == "" && path != "" && (path == testPath || path == wsPath) {
+				src.errorf(pathNode, "path [%s] is already used by %s, address [%s]", path, key, endpoint.Address)
+			}
+		}
+		testUIs[endpoint.Address][testPath] = true
+		webSockets[endpoint.Address][wsPath] = true
+	}
+}
+
+// redacted returns config file content with values of secret looking keys masked
+func (src *configSource) redacted() string {
+	lines := strings.Split(string(src.content), "\n")
+	var walk func(node *yaml.Node)
+	walk = func(node *yaml.Node) {
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				keyNode, valueNode := node.Content[i], node.Content[i+1]
+				if valueNode.Kind == yaml.ScalarNode && rexSecretKey.MatchString(keyNode.Value) {
+					maskLines(lines, valueNode)
+				}
+			}
+		}
+		for _, child := range node.Content {
+			walk(child)
+		}
+	}
+	walk(&src.root)
+	return src.redact(strings.Join(lines, "\n"))
+}
+
+// maskLines replaces scalar value in lines with asterisks
+func maskLines(lines []string, valueNode *yaml.Node) {
+	first := valueNode.Line - 1
+	if first < 0 || first >= len(lines) {
+		return
+	}
+	if column := valueNode.Column - 1; column <= len(lines[first]) {
+		lines[first] = lines[first][:column] + "******"
+	}
+	if valueNode.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		for i := first + 1; i < len(lines) && i <= first+strings.Count(valueNode.Value, "\n"); i++ {
+			lines[i] = ""
+		}
+	}
+}
+
+// checkConfig prints every issue of the config file and returns process exit code
+func checkConfig(filename string) int {
+	src, err := parseConfig(filename)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	for _, issue := range src.issues {
+		fmt.Println(issue.Format(filename))
+	}
+	if errorsCount := len(src.errors()); errorsCount > 0 {
+		fmt.Printf("Config file %s has %d error(s).\n", filename, errorsCount)
+		return 1
+	}
+	fmt.Printf("Config file %s is valid.\n", filename)
+	return 0
+}
+
+// validateTLS checks TLS settings of a listener or the global ones in node,
+// prefix names their keys in messages
+func (src *configSource) validateTLS(node *yaml.Node, listener ConfigListener, prefix string) {
+	if listener.TLSCertFile != "" && listener.TLSKeyFile == "" || listener.TLSCertFile == "" && listener.TLSKeyFile != "" {
+		src.errorf(orNode(mappingValue(node, "tls.cert.file"), mappingValue(node, "tls.key.file"), node), "both certificate and key file must be defined")
+	} else if listener.TLSCertFile != "" {
+		src.checkCertificate(mappingValue(node, "tls.cert.file"), ConfigCertificate{CertFile: listener.TLSCertFile, KeyFile: listener.TLSKeyFile})
+	}
+	certsNode := mappingValue(node, "tls.certificates")
+	for i, pair := range listener.TLSCertificates {
+		pairNode := orNode(certsNode, node)
+		if certsNode != nil && certsNode.Kind == yaml.SequenceNode && i < len(certsNode.Content) {
+			pairNode = certsNode.Content[i]
+		}
+		if pair.CertFile == "" || pair.KeyFile == "" {
+			src.errorf(pairNode, "both cert.file and key.file must be defined in %stls.certificates", prefix)
+			continue
+		}
+		src.checkCertificate(pairNode, pair)
+	}
+	if _, exists := tlsVersions[listener.TLSMinVersion]; listener.TLSMinVersion != "" && !exists {
+		src.errorf(mappingValue(node, "tls.min.version"), "invalid %stls.min.version [%s], expected 1.0, 1.1, 1.2 or 1.3", prefix, listener.TLSMinVersion)
+	}
+	if _, err := cipherSuites(listener.TLSCiphers); err != nil {
+		src.errorf(mappingValue(node, "tls.ciphers"), "invalid %stls.ciphers: %v", prefix, err)
+	}
+	if _, exists := clientAuthTypes[listener.TLSClientAuth]; listener.TLSClientAuth != "" && !exists {
+		src.errorf(mappingValue(node, "tls.client.auth"), "invalid %stls.client.auth [%s], expected request or require", prefix, listener.TLSClientAuth)
+	} else if listener.TLSClientAuth != "" && listener.TLSClientCAFile == "" {
+		src.errorf(mappingValue(node, "tls.client.auth"), "%stls.client.auth needs tls.client.ca.file", prefix)
+	} else if _, _, err := listener.clientAuth(); err != nil {
+		src.errorf(mappingValue(node, "tls.client.ca.file"), "invalid %stls.client.ca.file: %v", prefix, err)
+	}
+	if len(listener.certificates()) == 0 && (listener.TLSMinVersion != "" || len(listener.TLSCiphers) > 0 || listener.TLSClientCAFile != "") {
+		src.warnf(orNode(mappingValue(node, "tls.min.version"), mappingValue(node, "tls.ciphers"), mappingValue(node, "tls.client.ca.file")), "%stls settings without certificates are ignored", prefix)
+	}
+}
+
+// checkCertificate checks that files of pair exist and hold a certificate and its key
+func (src *configSource) checkCertificate(node *yaml.Node, pair ConfigCertificate) {
+	if _, err := os.Stat(pair.CertFile); err != nil {
+		src.errorf(node, "certificate file %s does not exist", pair.CertFile)
+		return
+	}
+	if _, err := os.Stat(pair.KeyFile); err != nil {
+		src.errorf(node, "key file %s does not exist", pair.KeyFile)
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile); err != nil {
+		src.errorf(node, "invalid certificate %s: %v", pair.CertFile, err)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes content to config.yaml in a temporary directory
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// captureStdout returns what run prints to stdout
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	chOutput := make(chan string)
+	go func() {
+		output, _ := io.ReadAll(reader)
+		chOutput <- string(output)
+	}()
+	run()
+	writer.Close()
+	return <-chOutput
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		code    int
+		lines   []string
+	}{
+		{
+			name: "valid",
+			content: `schema.version: "2.0"
+endpoints:
+  - address: :8800
+    connection:
+      address: redis:6379
+`,
+			code:  0,
+			lines: []string{"Config file FILE is valid."},
+		},
+		{
+			name: "unknown key",
+			content: `schema.version: "2.0"
+endpoints:
+  - address: :8800
+    connection:
+      address: redis:6379
+    bogus: 1
+`,
+			code:  0,
+			lines: []string{`FILE:6:5: warning: unknown key "bogus" in endpoints is ignored`, "Config file FILE is valid."},
+		},
+		{
+			name: "invalid value",
+			content: `schema.version: "2.0"
+endpoints:
+  - address: :8800
+    connection:
+      address: redis:6379
+    source:
+      start: later
+`,
+			code:  1,
+			lines: []string{`FILE:7:14: error: invalid source.start [later], expected "0", "$" or an entry ID, address [:8800]`, "Config file FILE has 1 error(s)."},
+		},
+		{
+			name: "invalid source.access",
+			content: `schema.version: "2.0"
+endpoints:
+  - address: :8800
+    connection:
+      address: redis:6379
+    source:
+      access:
+        - identity: CN=billing
+          streams: [orders.*]
+        - identity: CN=audit
+          streams: ["audit[", audit]
+        - streams: [invoices]
+`,
+			code: 1,
+			lines: []string{
+				"FILE:10:11: error: invalid source.access stream [audit[], address [:8800]",
+				"FILE:12:11: error: identity of source.access is missing, address [:8800]",
+				"Config file FILE has 2 error(s).",
+			},
+		},
+		{
+			name: "delivery errors name the address",
+			content: `schema.version: "2.0"
+endpoints:
+  - address: :8800
+    connection:
+      address: redis:6379
+    delivery:
+      message.type: xml
+      sentinel.scope: channel
+      sentinel.code: 1005
+`,
+			code: 1,
+			lines: []string{
+				"FILE:7:21: error: invalid delivery.message.type [xml], expected json, text or binary, address [:8800]",
+				"FILE:8:23: error: invalid delivery.sentinel.scope [channel], expected socket, stream or none, address [:8800]",
+				"FILE:9:22: error: invalid delivery.sentinel.code [1005], expected 1000-1003, 1007-1014 or 3000-4999, address [:8800]",
+				"Config file FILE has 3 error(s).",
+			},
+		},
+		{
+			name: "presence.ttl below the minimum",
+			content: `schema.version: "2.0"
+endpoints:
+  - address: :8800
+    connection:
+      address: redis:6379
+    delivery:
+      presence.key: rws.presence
+      presence.ttl: 2ns
+`,
+			code: 1,
+			lines: []string{
+				"FILE:8:21: error: delivery.presence.ttl [2ns] is shorter than 1s, address [:8800]",
+				"Config file FILE has 1 error(s).",
+			},
+		},
+		{
+			name: "admin paths need an admin listener or opt-in",
+			content: `schema.version: "2.0"
+metrics.path: /metrics
+endpoints:
+  - address: :8800
+    connection:
+      address: redis:6379
+`,
+			code: 0,
+			lines: []string{
+				"FILE:2:15: warning: metrics.path is not served without admin.address, set admin.public to serve it on endpoint addresses",
+				"Config file FILE is valid.",
+			},
+		},
+		{
+			name: "type error has line only",
+			content: `schema.version: "2.0"
+endpoints:
+  - address: :8800
+    connection:
+      db: many
+      address: redis:6379
+`,
+			code:  1,
+			lines: []string{"FILE:5: error: cannot unmarshal !!str `many` into int", "Config file FILE has 1 error(s)."},
+		},
+		{
+			name:    "unsupported version",
+			content: "schema.version: \"3.0\"\nendpoints: []\n",
+			code:    1,
+			lines:   []string{`FILE:1:17: error: unsupported schema.version "3.0", expected 1.0 or 2.0`, "Config file FILE has 1 error(s)."},
+		},
+		{
+			name:    "empty file has no position",
+			content: "",
+			code:    1,
+			lines:   []string{"FILE: error: config file is empty", "Config file FILE has 1 error(s)."},
+		},
+		{
+			name: "issues sorted by line",
+			content: `schema.version: "2.0"
+endpoints:
+  - address: :8800
+    connection:
+      address: redis:6379
+    source:
+      start: later
+  - address: :8801
+    junk: 1
+    connection:
+      address: redis:6379
+`,
+			code: 1,
+			lines: []string{
+				`FILE:7:14: error: invalid source.start [later], expected "0", "$" or an entry ID, address [:8800]`,
+				`FILE:9:5: warning: unknown key "junk" in endpoints is ignored`,
+				"Config file FILE has 1 error(s).",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := writeTestConfig(t, test.content)
+			code := 0
+			output := captureStdout(t, func() { code = checkConfig(filename) })
+			if code != test.code {
+				t.Errorf("exit code %d, expected %d", code, test.code)
+			}
+			expected := strings.ReplaceAll(strings.Join(test.lines, "\n"), "FILE", filename) + "\n"
+			if output != expected {
+				t.Errorf("output\n%s\nexpected\n%s", output, expected)
+			}
+		})
+	}
+}
+
+func TestCheckConfigMissingFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "missing.yaml")
+	code := 0
+	captureStdout(t, func() { code = checkConfig(filename) })
+	if code != 2 {
+		t.Errorf("exit code %d, expected 2", code)
+	}
+}